@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// CreateBroadcast starts fanning b out to its segment, counting the members it has now as
+// the total of the broadcast
+func (db *DBConnector) CreateBroadcast(ctx context.Context, b t.Broadcast) (t.Broadcast, error) {
+	var created t.Broadcast
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_service.broadcasts
+			(segment_id, payload, status, total, summary, available_at, created_at, updated_at)
+		SELECT $1, $2::jsonb, $3, count(*), '{}', $4::timestamp, $4::timestamp, $4::timestamp
+		FROM (` + segmentMembers + `) AS members
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query, b.SegmentID, b.Payload, t.BroadcastRunning, now)
+	if err != nil {
+		if isMissingRow(err) || isMissingReference(err) {
+			return t.Broadcast{}, ErrNotFound
+		}
+		db.Logger.Error("Error creating broadcast", zap.Error(err), zap.String("segment_id", b.SegmentID))
+		return t.Broadcast{}, err
+	}
+	return created, nil
+}
+
+func (db *DBConnector) GetBroadcast(ctx context.Context, id string) (t.Broadcast, error) {
+	var b t.Broadcast
+	query := `
+		SELECT *
+		FROM notification_service.broadcasts
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &b, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Broadcast{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching broadcast", zap.Error(err), zap.String("broadcast_id", id))
+		return t.Broadcast{}, err
+	}
+	return b, nil
+}
+
+// ClaimBroadcast reserves the running broadcast waiting the longest for its next page
+// until the lease ends, ErrNotFound when there is none
+func (db *DBConnector) ClaimBroadcast(ctx context.Context, lease time.Duration) (t.Broadcast, error) {
+	var claimed t.Broadcast
+	now := time.Now().UTC()
+	query := `
+		UPDATE notification_service.broadcasts
+		SET available_at = $1
+		WHERE id = (
+			SELECT id
+			FROM notification_service.broadcasts
+			WHERE
+				status = $2 AND
+				available_at <= $3
+			ORDER BY available_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &claimed, query, now.Add(lease), t.BroadcastRunning, now)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Broadcast{}, ErrNotFound
+		}
+		db.Logger.Error("Error claiming broadcast", zap.Error(err))
+		return t.Broadcast{}, err
+	}
+	return claimed, nil
+}
+
+// SaveBroadcastProgress records the pages sent so far and releases the lease, so the next
+// page can be claimed right away
+func (db *DBConnector) SaveBroadcastProgress(ctx context.Context, b t.Broadcast) error {
+	query := `
+		UPDATE notification_service.broadcasts
+		SET
+			status = $2,
+			total = $3,
+			processed = $4,
+			summary = $5,
+			last_recipient = $6,
+			available_at = $7,
+			updated_at = $7,
+			completed_at = $8
+		WHERE id = $1
+	`
+	_, err := db.q().ExecContext(ctx, query,
+		b.ID, b.Status, b.Total, b.Processed, b.Summary, b.LastRecipient, time.Now().UTC(), b.CompletedAt)
+	if err != nil {
+		db.Logger.Error("Error saving broadcast progress", zap.Error(err), zap.String("broadcast_id", b.ID))
+		return err
+	}
+	return nil
+}
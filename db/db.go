@@ -4,111 +4,468 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	t "notification_service/types"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
 // Database defines the interface for database operations
 type Database interface {
-	GetRateLimitRule(ctx context.Context, nType t.NotificationType) (t.RateLimitRule, error)
-	RecordNotification(ctx context.Context, input *t.InputInfo, notif t.Notifications)
-	GetLastNotification(ctx context.Context, current t.InputInfo) (t.Notifications, error)
+	// WithLock runs fn holding the lock of key; everything fn does through the given
+	// Database is committed atomically when it returns nil and rolled back otherwise
+	WithLock(ctx context.Context, key string, fn func(Database) error) error
+	// WithLocks is WithLock holding the locks of all keys
+	WithLocks(ctx context.Context, keys []string, fn func(Database) error) error
+
+	GetRateLimitRules(ctx context.Context, nType t.NotificationType, recipient string) ([]t.RateLimitRule, error)
+	RecordNotification(ctx context.Context, input *t.InputInfo, sentAt time.Time) error
+	GetNotificationsSince(ctx context.Context, current t.InputInfo, since time.Time) ([]time.Time, error)
+	GetBucket(ctx context.Context, ruleID, recipient string) (t.Bucket, error)
+	SaveBucket(ctx context.Context, b t.Bucket) error
+	// the batched forms of the above, for the recipients and types of a whole batch
+	GetRateLimitRulesOf(ctx context.Context, keys []t.LimitKey) (map[t.LimitKey][]t.RateLimitRule, error)
+	GetNotificationsSinceOf(ctx context.Context, keys []t.LimitKey, since time.Time) ([]t.SentNotification, error)
+	RecordNotifications(ctx context.Context, sent []t.SentNotification) error
+	GetBucketsOf(ctx context.Context, ruleIDs, recipients []string) ([]t.Bucket, error)
+	SaveBuckets(ctx context.Context, buckets []t.Bucket) error
+
+	EnqueueNotification(ctx context.Context, o t.OutboxMessage) (t.OutboxMessage, error)
+	RecordRateLimited(ctx context.Context, o t.OutboxMessage, reason string) (t.OutboxMessage, error)
+	InsertNotifications(ctx context.Context, batch []t.OutboxMessage) ([]t.OutboxMessage, error)
+	ClaimNotifications(ctx context.Context, limit int, lease time.Duration) ([]t.OutboxMessage, error)
+	MarkDelivered(ctx context.Context, id, reference string) error
+	RetryNotification(ctx context.Context, id, reason string, at time.Time) error
+	MarkFailed(ctx context.Context, id, reason string) error
+	GetNotification(ctx context.Context, id string) (t.OutboxMessage, error)
+	ListNotifications(ctx context.Context, f t.NotificationFilter) ([]t.OutboxMessage, error)
+
+	ListDeadLetters(ctx context.Context, channel t.Channel, recipient string) ([]t.DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id string) (t.DeadLetter, error)
+	RequeueDeadLetter(ctx context.Context, id string) (t.OutboxMessage, error)
+
+	GetIdempotencyKey(ctx context.Context, key string) (t.IdempotencyKey, error)
+	SaveIdempotencyKey(ctx context.Context, k t.IdempotencyKey) error
+
+	ListRateLimitRules(ctx context.Context, nType t.NotificationType, recipient, tenant string) ([]t.RateLimitRule, error)
+	GetRateLimitRule(ctx context.Context, id string) (t.RateLimitRule, error)
+	CreateRateLimitRule(ctx context.Context, rule t.RateLimitRule) (t.RateLimitRule, error)
+	UpdateRateLimitRule(ctx context.Context, rule t.RateLimitRule) (t.RateLimitRule, error)
+	DeleteRateLimitRule(ctx context.Context, id string) error
+
+	CreateRecipient(ctx context.Context, r t.Recipient) (t.Recipient, error)
+	UpdateRecipient(ctx context.Context, r t.Recipient) (t.Recipient, error)
+	GetRecipient(ctx context.Context, id string) (t.Recipient, error)
+	GetRecipients(ctx context.Context, ids []string) ([]t.Recipient, error)
+	DeleteRecipient(ctx context.Context, id string) error
+
+	GetPreference(ctx context.Context, recipient string, nType t.NotificationType) (t.Preference, error)
+	ListPreferences(ctx context.Context, recipient string) ([]t.Preference, error)
+	ListPreferencesOf(ctx context.Context, recipients []string) ([]t.Preference, error)
+	UpsertPreference(ctx context.Context, p t.Preference) (t.Preference, error)
+	OptOut(ctx context.Context, recipient string, nType t.NotificationType) error
+
+	ListSegments(ctx context.Context) ([]t.Segment, error)
+	GetSegment(ctx context.Context, id string) (t.Segment, error)
+	CreateSegment(ctx context.Context, segment t.Segment) (t.Segment, error)
+	UpdateSegment(ctx context.Context, segment t.Segment) (t.Segment, error)
+	DeleteSegment(ctx context.Context, id string) error
+	AddSegmentMember(ctx context.Context, segmentID, recipient string) error
+	RemoveSegmentMember(ctx context.Context, segmentID, recipient string) error
+	ListSegmentMembers(ctx context.Context, segmentID, after string, limit int) ([]string, error)
+
+	CreateBroadcast(ctx context.Context, b t.Broadcast) (t.Broadcast, error)
+	GetBroadcast(ctx context.Context, id string) (t.Broadcast, error)
+	ClaimBroadcast(ctx context.Context, lease time.Duration) (t.Broadcast, error)
+	SaveBroadcastProgress(ctx context.Context, b t.Broadcast) error
+
+	ScheduleNotification(ctx context.Context, sn t.ScheduledNotification) (t.ScheduledNotification, error)
+	GetScheduledNotification(ctx context.Context, id string) (t.ScheduledNotification, error)
+	ListScheduledNotifications(ctx context.Context, f t.ScheduledFilter) ([]t.ScheduledNotification, error)
+	CancelScheduledNotification(ctx context.Context, id string) (t.ScheduledNotification, error)
+	ClaimScheduledNotification(ctx context.Context, lease time.Duration) (t.ScheduledNotification, error)
+	MarkDispatched(ctx context.Context, sn t.ScheduledNotification) error
+
+	AddToDigest(ctx context.Context, dg t.Digest) (t.Digest, error)
+	GetDigest(ctx context.Context, id string) (t.Digest, error)
+	ClaimDigest(ctx context.Context, lease time.Duration) (t.Digest, error)
+	DeferDigest(ctx context.Context, id string, at time.Time) error
+	CloseDigest(ctx context.Context, dg t.Digest) error
+
+	CreateTemplate(ctx context.Context, tpl t.Template) (t.Template, error)
+	GetTemplate(ctx context.Context, name, locale string, version int) (t.Template, error)
+	ListTemplates(ctx context.Context) ([]t.Template, error)
+	ListTemplateVersions(ctx context.Context, name, locale string) ([]t.Template, error)
 }
 
 type DBConnector struct {
 	DB     *sqlx.DB
 	Logger *zap.Logger
+	// tx is set on the connector WithLock hands to its callback
+	tx *sqlx.Tx
+}
+
+var _ Database = (*DBConnector)(nil)
+
+// queryer is what *sqlx.DB and *sqlx.Tx have in common
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	GetContext(ctx context.Context, dest any, query string, args ...any) error
+	SelectContext(ctx context.Context, dest any, query string, args ...any) error
 }
 
-func (db *DBConnector) GetRateLimitRules(ctx context.Context, nType t.NotificationType) (t.RateLimitRule, error) {
-	var rule t.RateLimitRule
+// q returns the transaction of a locked connector, or the pool
+func (db *DBConnector) q() queryer {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.DB
+}
+
+// WithLock runs fn in a transaction holding the Postgres advisory lock of key, so callers
+// using the same key are serialized until it commits. The lock is released with the
+// transaction. Calls nested in fn reuse its transaction.
+func (db *DBConnector) WithLock(ctx context.Context, key string, fn func(Database) error) error {
+	return db.withTx(ctx, key, func(tx *sqlx.Tx) error { return db.lock(ctx, tx, key) }, fn)
+}
+
+// WithLocks is WithLock for several keys. The locks are taken in key order, so callers
+// locking overlapping keys cannot deadlock.
+func (db *DBConnector) WithLocks(ctx context.Context, keys []string, fn func(Database) error) error {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	return db.withTx(ctx, strings.Join(sorted, ","), func(tx *sqlx.Tx) error {
+		query := `
+			SELECT pg_advisory_xact_lock(hashtext(key))
+			FROM (SELECT key FROM unnest($1::text[]) AS key ORDER BY key) AS sorted
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(sorted)); err != nil {
+			db.Logger.Error("Error acquiring advisory locks", zap.Error(err), zap.Int("locks", len(sorted)))
+			return fmt.Errorf("could not acquire %d locks: %w", len(sorted), err)
+		}
+		return nil
+	}, fn)
+}
+
+// withTx runs fn in a transaction after lock succeeded, reusing the transaction of a
+// locked connector. name identifies the locks in logs.
+func (db *DBConnector) withTx(ctx context.Context, name string, lock func(*sqlx.Tx) error, fn func(Database) error) error {
+	if db.tx != nil {
+		if err := lock(db.tx); err != nil {
+			return err
+		}
+		return fn(db)
+	}
+
+	tx, err := db.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		db.Logger.Error("Error starting transaction", zap.Error(err), zap.String("lock", name))
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	if err := lock(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := fn(&DBConnector{DB: db.DB, Logger: db.Logger, tx: tx}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		db.Logger.Error("Error committing transaction", zap.Error(err), zap.String("lock", name))
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (db *DBConnector) lock(ctx context.Context, tx *sqlx.Tx, key string) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+		db.Logger.Error("Error acquiring advisory lock", zap.Error(err), zap.String("lock", key))
+		return fmt.Errorf("could not acquire lock %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetRateLimitRules returns the rules of nType that may apply to recipient: the global
+// ones, the overrides of the recipient tenant and the overrides of the recipient itself.
+// Which of them are enforced is decided by the service.
+func (db *DBConnector) GetRateLimitRules(ctx context.Context, nType t.NotificationType, recipient string) ([]t.RateLimitRule, error) {
+	rules := []t.RateLimitRule{}
 	query := `
 		SELECT  *
 		FROM notification_service.rate_limit_rules
-		WHERE notification_type = $1
+		WHERE
+			notification_type = $1 AND (
+				recipient = $2 OR
+				(recipient = '' AND tenant = '') OR
+				(recipient = '' AND tenant <> '' AND tenant = (
+					SELECT tenant FROM notification_service.recipients WHERE id = $2
+				))
+			)
+		ORDER BY duration, id
 	`
 
-	err := db.DB.GetContext(ctx, &rule, query, nType)
+	err := db.q().SelectContext(ctx, &rules, query, nType, recipient)
 	if err != nil {
-		db.Logger.Error("Error fetching rate limit rule",
+		db.Logger.Error("Error fetching rate limit rules",
 			zap.Error(err),
 			zap.String("notification_type", string(nType)),
+			zap.String("recipient", recipient),
 		)
-		return t.RateLimitRule{}, err
+		return nil, err
 	}
-	return rule, err
+	return rules, nil
 }
 
-func (db *DBConnector) GetLastNotification(ctx context.Context, current t.InputInfo) (t.Notifications, error) {
-	var notif t.Notifications
+// GetNotificationsSince returns the send times of the input recipient and type after since
+func (db *DBConnector) GetNotificationsSince(ctx context.Context, current t.InputInfo, since time.Time) ([]time.Time, error) {
+	sent := []time.Time{}
 	query := `
-		SELECT *
+		SELECT created_at
 		FROM notification_service.notifications
-		WHERE 
+		WHERE
 			notification_type = $1 AND
-			recipient = $2
-		order by created_at desc
-		limit 1
+			recipient = $2 AND
+			created_at > $3
+		ORDER BY created_at
 	`
-	err := db.DB.GetContext(ctx, &notif, query, current.NotificationGroup, current.Recipient)
+	err := db.q().SelectContext(ctx, &sent, query, current.NotificationGroup, current.Recipient, since)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			db.Logger.Error("Error fetching notifications",
-				zap.Error(err),
-				zap.String("notification_type", string(current.NotificationGroup)),
-			)
-			return t.Notifications{}, err
-		}
-		return t.Notifications{}, nil // not records yet
+		db.Logger.Error("Error fetching notifications",
+			zap.Error(err),
+			zap.String("notification_type", string(current.NotificationGroup)),
+		)
+		return nil, err
 	}
-	db.Logger.Info("Last notification was fetched",
-		zap.String("notification_id", notif.ID),
-		zap.String("counter", fmt.Sprint(notif.Counter)),
-	)
-	return notif, err
+	return sent, nil
 }
 
-func (db *DBConnector) RecordNotification(ctx context.Context, input *t.InputInfo, notif t.Notifications) error {
-
-	var (
-		query string
-		err   error
-	)
-	now := time.Now().UTC()
-	if notif.Counter == 0 {
-		query = `
-		INSERT INTO notification_service.notifications ( recipient, notification_type, counter, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5)
-		`
-		_, err = db.DB.ExecContext(ctx, query, input.Recipient, input.NotificationGroup, 1, now, now)
-	} else {
-		query = `
-			UPDATE notification_service.notifications 
-			SET 
-				updated_at = $1, counter = $2
+// RecordNotification appends a sent notification to the log used by the rate limiter and
+// drops the sends of the same recipient and type that are older than the longest rule
+// window of the type, which no rule counts anymore
+func (db *DBConnector) RecordNotification(ctx context.Context, input *t.InputInfo, sentAt time.Time) error {
+	query := `
+		WITH purged AS (
+			DELETE FROM notification_service.notifications
 			WHERE
-				id = $3
-		`
-		_, err = db.DB.ExecContext(ctx, query, now, notif.Counter, notif.ID)
-
-	}
-
+				recipient = $1 AND
+				notification_type = $2 AND
+				created_at <= $4::timestamp - make_interval(secs => (
+					SELECT COALESCE(MAX(duration), 0)
+					FROM notification_service.rate_limit_rules
+					WHERE notification_type = $2
+				)::double precision)
+		)
+		INSERT INTO notification_service.notifications (recipient, notification_type, counter, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := db.q().ExecContext(ctx, query, input.Recipient, input.NotificationGroup, 1, sentAt, sentAt)
 	if err != nil {
-		db.Logger.Error("Error upserting notification",
+		db.Logger.Error("Error recording notification",
 			zap.Error(err),
 			zap.String("recipient", input.Recipient),
 			zap.String("group_type", fmt.Sprint(input.NotificationGroup)),
 		)
-		return fmt.Errorf("error upserting notification: %w", err)
+		return fmt.Errorf("error recording notification: %w", err)
 	}
 
-	db.Logger.Info("Notification upserted successfully",
+	db.Logger.Info("Notification recorded successfully",
 		zap.String("recipient", input.Recipient),
 		zap.String("group_type", fmt.Sprint(input.NotificationGroup)),
 	)
 	return nil
 }
+
+// GetBucket returns the token bucket of rule for recipient, ErrNotFound when it was never used
+func (db *DBConnector) GetBucket(ctx context.Context, ruleID, recipient string) (t.Bucket, error) {
+	var b t.Bucket
+	query := `
+		SELECT *
+		FROM notification_service.token_buckets
+		WHERE
+			rule_id = $1 AND
+			recipient = $2
+	`
+	err := db.q().GetContext(ctx, &b, query, ruleID, recipient)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t.Bucket{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching token bucket",
+			zap.Error(err),
+			zap.String("rule_id", ruleID),
+			zap.String("recipient", recipient),
+		)
+		return t.Bucket{}, err
+	}
+	return b, nil
+}
+
+func (db *DBConnector) SaveBucket(ctx context.Context, b t.Bucket) error {
+	query := `
+		INSERT INTO notification_service.token_buckets (rule_id, recipient, tokens, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (rule_id, recipient) DO UPDATE
+		SET
+			tokens = EXCLUDED.tokens,
+			updated_at = EXCLUDED.updated_at
+	`
+	if _, err := db.q().ExecContext(ctx, query, b.RuleID, b.Recipient, b.Tokens, b.UpdatedAt); err != nil {
+		db.Logger.Error("Error saving token bucket",
+			zap.Error(err),
+			zap.String("rule_id", b.RuleID),
+			zap.String("recipient", b.Recipient),
+		)
+		return err
+	}
+	return nil
+}
+
+// limitKeyArrays splits keys into the recipient and type arrays unnested by the batched queries
+func limitKeyArrays(keys []t.LimitKey) (recipients, types []string) {
+	recipients, types = make([]string, len(keys)), make([]string, len(keys))
+	for i, k := range keys {
+		recipients[i], types[i] = k.Recipient, string(k.NotificationType)
+	}
+	return recipients, types
+}
+
+// GetRateLimitRulesOf is GetRateLimitRules for every key at once
+func (db *DBConnector) GetRateLimitRulesOf(ctx context.Context, keys []t.LimitKey) (map[t.LimitKey][]t.RateLimitRule, error) {
+	rows := []struct {
+		AppliesTo string `db:"applies_to"`
+		t.RateLimitRule
+	}{}
+	query := `
+		SELECT keys.recipient AS applies_to, rules.*
+		FROM unnest($1::text[], $2::text[]) AS keys (recipient, notification_type)
+		JOIN notification_service.rate_limit_rules AS rules ON
+			rules.notification_type = keys.notification_type::notification_service.notification_type AND (
+				rules.recipient = keys.recipient OR
+				(rules.recipient = '' AND rules.tenant = '') OR
+				(rules.recipient = '' AND rules.tenant <> '' AND rules.tenant = (
+					SELECT tenant FROM notification_service.recipients WHERE id = keys.recipient
+				))
+			)
+		ORDER BY rules.duration, rules.id
+	`
+	recipients, types := limitKeyArrays(keys)
+	if err := db.q().SelectContext(ctx, &rows, query, pq.Array(recipients), pq.Array(types)); err != nil {
+		db.Logger.Error("Error fetching rate limit rules", zap.Error(err), zap.Int("keys", len(keys)))
+		return nil, err
+	}
+	rules := make(map[t.LimitKey][]t.RateLimitRule, len(keys))
+	for _, row := range rows {
+		key := t.LimitKey{Recipient: row.AppliesTo, NotificationType: row.NotificationType}
+		rules[key] = append(rules[key], row.RateLimitRule)
+	}
+	return rules, nil
+}
+
+// GetNotificationsSinceOf returns the sends of every key after since, oldest first
+func (db *DBConnector) GetNotificationsSinceOf(ctx context.Context, keys []t.LimitKey, since time.Time) ([]t.SentNotification, error) {
+	sent := []t.SentNotification{}
+	query := `
+		SELECT notifications.recipient, notifications.notification_type, notifications.created_at
+		FROM unnest($1::text[], $2::text[]) AS keys (recipient, notification_type)
+		JOIN notification_service.notifications ON
+			notifications.recipient = keys.recipient AND
+			notifications.notification_type = keys.notification_type::notification_service.notification_type
+		WHERE notifications.created_at > $3
+		ORDER BY notifications.created_at
+	`
+	recipients, types := limitKeyArrays(keys)
+	if err := db.q().SelectContext(ctx, &sent, query, pq.Array(recipients), pq.Array(types), since); err != nil {
+		db.Logger.Error("Error fetching notifications", zap.Error(err), zap.Int("keys", len(keys)))
+		return nil, err
+	}
+	return sent, nil
+}
+
+// RecordNotifications is RecordNotification for many sends in one statement, purging the
+// log of each recipient and type as it does
+func (db *DBConnector) RecordNotifications(ctx context.Context, sent []t.SentNotification) error {
+	if len(sent) == 0 {
+		return nil
+	}
+	recipients, types, sentAt := make([]string, len(sent)), make([]string, len(sent)), make([]string, len(sent))
+	for i, n := range sent {
+		recipients[i], types[i], sentAt[i] = n.Recipient, string(n.NotificationType), n.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	query := `
+		WITH sent AS (
+			SELECT recipient, notification_type::notification_service.notification_type AS notification_type, created_at
+			FROM unnest($1::text[], $2::text[], $3::timestamp[]) AS s (recipient, notification_type, created_at)
+		), purged AS (
+			DELETE FROM notification_service.notifications
+			USING (
+				SELECT recipient, notification_type, MIN(created_at) AS sent_at
+				FROM sent
+				GROUP BY recipient, notification_type
+			) AS keys
+			WHERE
+				notifications.recipient = keys.recipient AND
+				notifications.notification_type = keys.notification_type AND
+				notifications.created_at <= keys.sent_at - make_interval(secs => (
+					SELECT COALESCE(MAX(duration), 0)
+					FROM notification_service.rate_limit_rules
+					WHERE notification_type = keys.notification_type
+				)::double precision)
+		)
+		INSERT INTO notification_service.notifications (recipient, notification_type, counter, created_at, updated_at)
+		SELECT recipient, notification_type, 1, created_at, created_at
+		FROM sent
+	`
+	if _, err := db.q().ExecContext(ctx, query, pq.Array(recipients), pq.Array(types), pq.Array(sentAt)); err != nil {
+		db.Logger.Error("Error recording notifications", zap.Error(err), zap.Int("notifications", len(sent)))
+		return fmt.Errorf("error recording notifications: %w", err)
+	}
+	return nil
+}
+
+// GetBucketsOf returns the token buckets of ruleIDs[i] for recipients[i] that were ever used
+func (db *DBConnector) GetBucketsOf(ctx context.Context, ruleIDs, recipients []string) ([]t.Bucket, error) {
+	buckets := []t.Bucket{}
+	query := `
+		SELECT token_buckets.*
+		FROM unnest($1::uuid[], $2::text[]) AS keys (rule_id, recipient)
+		JOIN notification_service.token_buckets USING (rule_id, recipient)
+	`
+	if err := db.q().SelectContext(ctx, &buckets, query, pq.Array(ruleIDs), pq.Array(recipients)); err != nil {
+		db.Logger.Error("Error fetching token buckets", zap.Error(err), zap.Int("buckets", len(ruleIDs)))
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// SaveBuckets is SaveBucket for many buckets in one statement
+func (db *DBConnector) SaveBuckets(ctx context.Context, buckets []t.Bucket) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	ruleIDs, recipients := make([]string, len(buckets)), make([]string, len(buckets))
+	tokens, updatedAt := make([]float64, len(buckets)), make([]string, len(buckets))
+	for i, b := range buckets {
+		ruleIDs[i], recipients[i] = b.RuleID, b.Recipient
+		tokens[i], updatedAt[i] = b.Tokens, b.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	query := `
+		INSERT INTO notification_service.token_buckets (rule_id, recipient, tokens, updated_at)
+		SELECT * FROM unnest($1::uuid[], $2::text[], $3::numeric[], $4::timestamp[])
+		ON CONFLICT (rule_id, recipient) DO UPDATE
+		SET
+			tokens = EXCLUDED.tokens,
+			updated_at = EXCLUDED.updated_at
+	`
+	_, err := db.q().ExecContext(ctx, query, pq.Array(ruleIDs), pq.Array(recipients), pq.Array(tokens), pq.Array(updatedAt))
+	if err != nil {
+		db.Logger.Error("Error saving token buckets", zap.Error(err), zap.Int("buckets", len(buckets)))
+		return err
+	}
+	return nil
+}
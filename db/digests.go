@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// AddToDigest appends the items of dg to the pending digest of its recipient and type,
+// starting one due at dg.DeliverAt when there is none
+func (db *DBConnector) AddToDigest(ctx context.Context, dg t.Digest) (t.Digest, error) {
+	var digest t.Digest
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_service.digests
+			(recipient, notification_type, status, items, item_count, deliver_at, available_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $7)
+		ON CONFLICT (recipient, notification_type) WHERE status = 'PENDING'
+		DO UPDATE SET
+			items = digests.items || EXCLUDED.items,
+			item_count = digests.item_count + EXCLUDED.item_count,
+			updated_at = EXCLUDED.updated_at
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &digest, query,
+		dg.Recipient, dg.NotificationGroup, t.DigestPending, dg.Items, len(dg.Items), dg.DeliverAt.UTC(), now)
+	if err != nil {
+		db.Logger.Error("Error adding to digest",
+			zap.Error(err),
+			zap.String("recipient", dg.Recipient),
+			zap.String("type", string(dg.NotificationGroup)),
+		)
+		return t.Digest{}, err
+	}
+	return digest, nil
+}
+
+func (db *DBConnector) GetDigest(ctx context.Context, id string) (t.Digest, error) {
+	var dg t.Digest
+	query := `
+		SELECT *
+		FROM notification_service.digests
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &dg, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Digest{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching digest", zap.Error(err), zap.String("id", id))
+		return t.Digest{}, err
+	}
+	return dg, nil
+}
+
+// ClaimDigest reserves the due digest waiting the longest until the lease ends,
+// ErrNotFound when none is due
+func (db *DBConnector) ClaimDigest(ctx context.Context, lease time.Duration) (t.Digest, error) {
+	var claimed t.Digest
+	now := time.Now().UTC()
+	query := `
+		UPDATE notification_service.digests
+		SET available_at = $1
+		WHERE id = (
+			SELECT id
+			FROM notification_service.digests
+			WHERE
+				status = $2 AND
+				available_at <= $3
+			ORDER BY available_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &claimed, query, now.Add(lease), t.DigestPending, now)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Digest{}, ErrNotFound
+		}
+		db.Logger.Error("Error claiming digest", zap.Error(err))
+		return t.Digest{}, err
+	}
+	return claimed, nil
+}
+
+// DeferDigest moves the delivery of a pending digest to at
+func (db *DBConnector) DeferDigest(ctx context.Context, id string, at time.Time) error {
+	query := `
+		UPDATE notification_service.digests
+		SET deliver_at = $2, available_at = $2, updated_at = $3
+		WHERE id = $1
+	`
+	if _, err := db.q().ExecContext(ctx, query, id, at.UTC(), time.Now().UTC()); err != nil {
+		db.Logger.Error("Error deferring digest", zap.Error(err), zap.String("id", id))
+		return err
+	}
+	return nil
+}
+
+// CloseDigest records the outcome of delivering a digest, its status, notification and
+// error, so it takes no more notifications
+func (db *DBConnector) CloseDigest(ctx context.Context, dg t.Digest) error {
+	now := time.Now().UTC()
+	query := `
+		UPDATE notification_service.digests
+		SET status = $2, notification_id = $3, error = $4, updated_at = $5, sent_at = $5
+		WHERE id = $1
+	`
+	if _, err := db.q().ExecContext(ctx, query, dg.ID, dg.Status, dg.NotificationID, dg.Error, now); err != nil {
+		db.Logger.Error("Error closing digest", zap.Error(err), zap.String("id", dg.ID))
+		return err
+	}
+	return nil
+}
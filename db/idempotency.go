@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// GetIdempotencyKey returns the unexpired key, ErrNotFound when there is none
+func (db *DBConnector) GetIdempotencyKey(ctx context.Context, key string) (t.IdempotencyKey, error) {
+	var k t.IdempotencyKey
+	query := `
+		SELECT *
+		FROM notification_service.idempotency_keys
+		WHERE key = $1 AND expires_at > $2
+	`
+	err := db.q().GetContext(ctx, &k, query, key, time.Now().UTC())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t.IdempotencyKey{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching idempotency key", zap.Error(err))
+		return t.IdempotencyKey{}, err
+	}
+	return k, nil
+}
+
+// SaveIdempotencyKey stores k, replacing an expired key of the same name, and purges the
+// other expired keys
+func (db *DBConnector) SaveIdempotencyKey(ctx context.Context, k t.IdempotencyKey) error {
+	query := `
+		WITH purged AS (
+			DELETE FROM notification_service.idempotency_keys
+			WHERE expires_at <= $4 AND key <> $1
+		)
+		INSERT INTO notification_service.idempotency_keys (key, request_hash, response, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = $2, response = $3, created_at = $4, expires_at = $5
+	`
+	_, err := db.q().ExecContext(ctx, query, k.Key, k.RequestHash, k.Response, k.CreatedAt, k.ExpiresAt)
+	if err != nil {
+		db.Logger.Error("Error saving idempotency key", zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// EnqueueNotification adds an accepted notification to the outbox, ready to be claimed
+func (db *DBConnector) EnqueueNotification(ctx context.Context, o t.OutboxMessage) (t.OutboxMessage, error) {
+	return db.insertNotification(ctx, o, t.Queued, "")
+}
+
+// RecordRateLimited keeps a notification rejected by the rate limit, so it can be looked
+// up like the accepted ones; reason is the rate limit error
+func (db *DBConnector) RecordRateLimited(ctx context.Context, o t.OutboxMessage, reason string) (t.OutboxMessage, error) {
+	return db.insertNotification(ctx, o, t.RateLimited, reason)
+}
+
+// insertNotification writes a new notification with the given status, along with its
+// ACCEPTED and status events
+func (db *DBConnector) insertNotification(ctx context.Context, o t.OutboxMessage, status t.DeliveryStatus, reason string) (t.OutboxMessage, error) {
+	var inserted t.OutboxMessage
+	now := time.Now().UTC()
+	query := `
+		WITH inserted AS (
+			INSERT INTO notification_service.outbox (
+				recipient, notification_type, channel, address, message_id, title, body, html_body,
+				data, unsubscribe_url, status, last_error, available_at, created_at, updated_at, priority
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $13, $13, $15)
+			RETURNING *
+		), events AS (
+			INSERT INTO notification_service.notification_events (notification_id, status, detail, created_at)
+			SELECT id, event.status, event.detail, $13
+			FROM inserted, (VALUES (1, $14, ''), (2, $11, $12)) AS event (position, status, detail)
+			ORDER BY event.position
+		)
+		SELECT * FROM inserted
+	`
+	err := db.q().GetContext(ctx, &inserted, query,
+		o.Recipient, o.NotificationGroup, o.Channel, o.Address, o.MessageID, o.Title, o.Body, o.HTMLBody,
+		o.Data, o.UnsubscribeURL, status, reason, now, t.Accepted, o.Priority.OrNormal())
+	if err != nil {
+		db.Logger.Error("Error inserting notification",
+			zap.Error(err),
+			zap.String("recipient", o.Recipient),
+			zap.String("notification_type", string(o.NotificationGroup)),
+			zap.String("status", string(status)),
+		)
+		return t.OutboxMessage{}, err
+	}
+	return inserted, nil
+}
+
+// InsertNotifications writes a batch of new notifications in a single statement, each
+// with its own status and last error, along with their ACCEPTED and status events. The
+// inserted notifications are returned in the order of batch.
+func (db *DBConnector) InsertNotifications(ctx context.Context, batch []t.OutboxMessage) ([]t.OutboxMessage, error) {
+	inserted := []t.OutboxMessage{}
+	if len(batch) == 0 {
+		return inserted, nil
+	}
+	cols := make([][]string, 12)
+	data := make([]sql.NullString, len(batch))
+	for i, o := range batch {
+		for c, v := range []string{o.Recipient, string(o.NotificationGroup), string(o.Channel), o.Address, o.MessageID,
+			o.Title, o.Body, o.HTMLBody, o.UnsubscribeURL, string(o.Status), o.LastError, string(o.Priority.OrNormal())} {
+			cols[c] = append(cols[c], v)
+		}
+		if o.Data != nil {
+			raw, err := json.Marshal(o.Data)
+			if err != nil {
+				return nil, fmt.Errorf("could not encode data of notification for %s: %w", o.Recipient, err)
+			}
+			data[i] = sql.NullString{String: string(raw), Valid: true}
+		}
+	}
+
+	now := time.Now().UTC()
+	query := `
+		WITH batch AS (
+			SELECT uuid_generate_v4() AS id, *
+			FROM unnest(
+				$1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[],
+				$7::text[], $8::text[], $9::text[], $10::text[], $11::text[], $12::text[], $13::text[]
+			) WITH ORDINALITY AS b (
+				recipient, notification_type, channel, address, message_id, title,
+				body, html_body, unsubscribe_url, status, last_error, priority, data, position
+			)
+		), inserted AS (
+			INSERT INTO notification_service.outbox (
+				id, recipient, notification_type, channel, address, message_id, title, body, html_body,
+				data, unsubscribe_url, status, last_error, available_at, created_at, updated_at, priority
+			)
+			SELECT
+				id, recipient, notification_type::notification_service.notification_type, channel, address,
+				message_id, title, body, html_body, data::jsonb, unsubscribe_url, status, last_error, $14, $14, $14, priority
+			FROM batch
+			RETURNING *
+		), events AS (
+			INSERT INTO notification_service.notification_events (notification_id, status, detail, created_at)
+			SELECT inserted.id, event.status, event.detail, $14
+			FROM inserted, LATERAL (VALUES (1, $15, ''), (2, inserted.status, inserted.last_error)) AS event (position, status, detail)
+			ORDER BY inserted.id, event.position
+		)
+		SELECT inserted.*
+		FROM inserted
+		JOIN batch USING (id)
+		ORDER BY batch.position
+	`
+	args := make([]any, 0, 15)
+	for _, c := range cols {
+		args = append(args, pq.Array(c))
+	}
+	args = append(args, pq.Array(data), now, t.Accepted)
+	if err := db.q().SelectContext(ctx, &inserted, query, args...); err != nil {
+		db.Logger.Error("Error inserting notifications", zap.Error(err), zap.Int("count", len(batch)))
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// priorityRank orders notifications from the most to the least urgent, as the pending
+// index of the outbox does
+const priorityRank = `array_position(ARRAY['critical', 'high', 'normal', 'low'], priority)`
+
+// ClaimNotifications leases up to limit claimable notifications to the caller until
+// now+lease: queued ones and those whose previous worker lost its lease, the most urgent
+// first and the oldest first within a priority. Concurrent workers never claim the same row.
+func (db *DBConnector) ClaimNotifications(ctx context.Context, limit int, lease time.Duration) ([]t.OutboxMessage, error) {
+	claimed := []t.OutboxMessage{}
+	now := time.Now().UTC()
+	query := `
+		WITH claimed AS (
+			UPDATE notification_service.outbox
+			SET
+				status = $1,
+				attempts = attempts + 1,
+				available_at = $2,
+				updated_at = $3
+			WHERE id IN (
+				SELECT id
+				FROM notification_service.outbox
+				WHERE
+					status IN ($4, $1) AND
+					available_at <= $3
+				ORDER BY ` + priorityRank + `, available_at
+				LIMIT $5
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		), events AS (
+			INSERT INTO notification_service.notification_events (notification_id, status, attempt, created_at)
+			SELECT id, status, attempts, $3
+			FROM claimed
+		)
+		SELECT * FROM claimed
+	`
+	err := db.q().SelectContext(ctx, &claimed, query, t.Sending, now.Add(lease), now, t.Queued, limit)
+	if err != nil {
+		db.Logger.Error("Error claiming notifications", zap.Error(err))
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// MarkDelivered records a successful delivery with the reference returned by the channel
+func (db *DBConnector) MarkDelivered(ctx context.Context, id, reference string) error {
+	query := `
+		WITH delivered AS (
+			UPDATE notification_service.outbox
+			SET status = $2, reference = $3, last_error = '', updated_at = $4
+			WHERE id = $1
+			RETURNING id, attempts
+		)
+		INSERT INTO notification_service.notification_events (notification_id, status, attempt, detail, created_at)
+		SELECT id, $2, attempts, $3, $4
+		FROM delivered
+	`
+	if _, err := db.q().ExecContext(ctx, query, id, t.Delivered, reference, time.Now().UTC()); err != nil {
+		db.Logger.Error("Error marking notification delivered", zap.Error(err), zap.String("id", id))
+		return err
+	}
+	return nil
+}
+
+// RetryNotification puts a notification whose delivery failed back in the queue, to be
+// claimed again from at
+func (db *DBConnector) RetryNotification(ctx context.Context, id, reason string, at time.Time) error {
+	query := `
+		WITH retried AS (
+			UPDATE notification_service.outbox
+			SET status = $2, last_error = $3, available_at = $4, updated_at = $5
+			WHERE id = $1
+			RETURNING id, attempts
+		)
+		INSERT INTO notification_service.notification_events (notification_id, status, attempt, detail, created_at)
+		SELECT id, $2, attempts, $3, $5
+		FROM retried
+	`
+	if _, err := db.q().ExecContext(ctx, query, id, t.Queued, reason, at, time.Now().UTC()); err != nil {
+		db.Logger.Error("Error rescheduling notification", zap.Error(err), zap.String("id", id))
+		return err
+	}
+	return nil
+}
+
+// MarkFailed records a delivery that will not be attempted again and files the
+// notification as a dead letter, in a single statement
+func (db *DBConnector) MarkFailed(ctx context.Context, id, reason string) error {
+	query := `
+		WITH failed AS (
+			UPDATE notification_service.outbox
+			SET status = $2, last_error = $3, updated_at = $4
+			WHERE id = $1
+			RETURNING id, recipient, notification_type, channel, attempts
+		), events AS (
+			INSERT INTO notification_service.notification_events (notification_id, status, attempt, detail, created_at)
+			SELECT id, $2, attempts, $3, $4
+			FROM failed
+		)
+		INSERT INTO notification_service.dead_letters (
+			notification_id, recipient, notification_type, channel, attempts, reason, created_at
+		)
+		SELECT id, recipient, notification_type, channel, attempts, $3, $4
+		FROM failed
+	`
+	if _, err := db.q().ExecContext(ctx, query, id, t.Failed, reason, time.Now().UTC()); err != nil {
+		db.Logger.Error("Error marking notification failed", zap.Error(err), zap.String("id", id))
+		return err
+	}
+	return nil
+}
+
+// GetNotification returns a notification with its status history
+func (db *DBConnector) GetNotification(ctx context.Context, id string) (t.OutboxMessage, error) {
+	var o t.OutboxMessage
+	query := `
+		SELECT *
+		FROM notification_service.outbox
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &o, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.OutboxMessage{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching notification", zap.Error(err), zap.String("id", id))
+		return t.OutboxMessage{}, err
+	}
+
+	o.Events = []t.NotificationEvent{}
+	query = `
+		SELECT *
+		FROM notification_service.notification_events
+		WHERE notification_id = $1
+		ORDER BY created_at, id
+	`
+	if err := db.q().SelectContext(ctx, &o.Events, query, id); err != nil {
+		db.Logger.Error("Error fetching notification events", zap.Error(err), zap.String("id", id))
+		return t.OutboxMessage{}, err
+	}
+	return o, nil
+}
+
+// ListNotifications returns the notifications matching f, without their history
+func (db *DBConnector) ListNotifications(ctx context.Context, f t.NotificationFilter) ([]t.OutboxMessage, error) {
+	notifications := []t.OutboxMessage{}
+	query := `
+		SELECT *
+		FROM notification_service.outbox
+		WHERE
+			($1 = '' OR recipient = $1) AND
+			($2 = '' OR notification_type::text = $2) AND
+			($3 = '' OR channel = $3) AND
+			($4 = '' OR status = $4)
+		ORDER BY created_at DESC, id
+		LIMIT $5
+	`
+	err := db.q().SelectContext(ctx, &notifications, query,
+		f.Recipient, string(f.NotificationGroup), string(f.Channel), string(f.Status), f.Limit)
+	if err != nil {
+		db.Logger.Error("Error listing notifications", zap.Error(err))
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// ListDeadLetters returns the dead letters matching every non empty filter, newest first
+func (db *DBConnector) ListDeadLetters(ctx context.Context, channel t.Channel, recipient string) ([]t.DeadLetter, error) {
+	letters := []t.DeadLetter{}
+	query := `
+		SELECT *
+		FROM notification_service.dead_letters
+		WHERE
+			($1 = '' OR channel = $1) AND
+			($2 = '' OR recipient = $2)
+		ORDER BY created_at DESC, id
+	`
+	if err := db.q().SelectContext(ctx, &letters, query, string(channel), recipient); err != nil {
+		db.Logger.Error("Error listing dead letters", zap.Error(err))
+		return nil, err
+	}
+	return letters, nil
+}
+
+func (db *DBConnector) GetDeadLetter(ctx context.Context, id string) (t.DeadLetter, error) {
+	var letter t.DeadLetter
+	query := `
+		SELECT *
+		FROM notification_service.dead_letters
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &letter, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.DeadLetter{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching dead letter", zap.Error(err), zap.String("id", id))
+		return t.DeadLetter{}, err
+	}
+	return letter, nil
+}
+
+// RequeueDeadLetter removes a dead letter and queues its notification again with a
+// fresh attempt count
+func (db *DBConnector) RequeueDeadLetter(ctx context.Context, id string) (t.OutboxMessage, error) {
+	var requeued t.OutboxMessage
+	now := time.Now().UTC()
+	query := `
+		WITH letter AS (
+			DELETE FROM notification_service.dead_letters
+			WHERE id = $1
+			RETURNING notification_id
+		), requeued AS (
+			UPDATE notification_service.outbox
+			SET status = $2, attempts = 0, last_error = '', available_at = $3, updated_at = $3
+			WHERE id IN (SELECT notification_id FROM letter)
+			RETURNING *
+		), events AS (
+			INSERT INTO notification_service.notification_events (notification_id, status, detail, created_at)
+			SELECT id, $2, 'requeued from dead letter', $3
+			FROM requeued
+		)
+		SELECT * FROM requeued
+	`
+	err := db.q().GetContext(ctx, &requeued, query, id, t.Queued, now)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.OutboxMessage{}, ErrNotFound
+		}
+		db.Logger.Error("Error requeuing dead letter", zap.Error(err), zap.String("id", id))
+		return t.OutboxMessage{}, err
+	}
+	return requeued, nil
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func (db *DBConnector) GetPreference(ctx context.Context, recipient string, nType t.NotificationType) (t.Preference, error) {
+	var p t.Preference
+	query := `
+		SELECT *
+		FROM notification_service.recipient_preferences
+		WHERE
+			recipient = $1 AND
+			notification_type = $2
+	`
+	err := db.q().GetContext(ctx, &p, query, recipient, nType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t.Preference{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching preference",
+			zap.Error(err),
+			zap.String("recipient", recipient),
+			zap.String("notification_type", string(nType)),
+		)
+		return t.Preference{}, err
+	}
+	return p, nil
+}
+
+func (db *DBConnector) ListPreferences(ctx context.Context, recipient string) ([]t.Preference, error) {
+	prefs := []t.Preference{}
+	query := `
+		SELECT *
+		FROM notification_service.recipient_preferences
+		WHERE recipient = $1
+		ORDER BY notification_type
+	`
+	if err := db.q().SelectContext(ctx, &prefs, query, recipient); err != nil {
+		db.Logger.Error("Error listing preferences", zap.Error(err), zap.String("recipient", recipient))
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// ListPreferencesOf returns the preferences of all the given recipients
+func (db *DBConnector) ListPreferencesOf(ctx context.Context, recipients []string) ([]t.Preference, error) {
+	prefs := []t.Preference{}
+	query := `
+		SELECT *
+		FROM notification_service.recipient_preferences
+		WHERE recipient = ANY($1)
+	`
+	if err := db.q().SelectContext(ctx, &prefs, query, pq.Array(recipients)); err != nil {
+		db.Logger.Error("Error listing preferences", zap.Error(err), zap.Int("recipients", len(recipients)))
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (db *DBConnector) UpsertPreference(ctx context.Context, p t.Preference) (t.Preference, error) {
+	var saved t.Preference
+	query := `
+		INSERT INTO notification_service.recipient_preferences
+			(recipient, notification_type, opted_out, quiet_hours_start, quiet_hours_end, preferred_channel, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (recipient, notification_type) DO UPDATE
+		SET
+			opted_out = EXCLUDED.opted_out,
+			quiet_hours_start = EXCLUDED.quiet_hours_start,
+			quiet_hours_end = EXCLUDED.quiet_hours_end,
+			preferred_channel = EXCLUDED.preferred_channel,
+			updated_at = EXCLUDED.updated_at
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &saved, query,
+		p.Recipient, p.NotificationType, p.OptedOut, p.QuietHoursStart, p.QuietHoursEnd, p.PreferredChannel, time.Now().UTC())
+	if err != nil {
+		db.Logger.Error("Error saving preference",
+			zap.Error(err),
+			zap.String("recipient", p.Recipient),
+			zap.String("notification_type", string(p.NotificationType)),
+		)
+		return t.Preference{}, err
+	}
+	return saved, nil
+}
+
+// OptOut marks the recipient as opted out of nType, keeping any other preference
+func (db *DBConnector) OptOut(ctx context.Context, recipient string, nType t.NotificationType) error {
+	query := `
+		INSERT INTO notification_service.recipient_preferences (recipient, notification_type, opted_out, updated_at)
+		VALUES ($1, $2, TRUE, $3)
+		ON CONFLICT (recipient, notification_type) DO UPDATE
+		SET
+			opted_out = TRUE,
+			updated_at = EXCLUDED.updated_at
+	`
+	if _, err := db.q().ExecContext(ctx, query, recipient, nType, time.Now().UTC()); err != nil {
+		db.Logger.Error("Error opting out recipient",
+			zap.Error(err),
+			zap.String("recipient", recipient),
+			zap.String("notification_type", string(nType)),
+		)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+const uniqueViolation = "23505"
+
+func (db *DBConnector) CreateRecipient(ctx context.Context, r t.Recipient) (t.Recipient, error) {
+	var created t.Recipient
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_service.recipients
+			(id, telegram_chat_id, email, webhook_url, tenant, preferred_channels, attributes, timezone, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, '{}'::jsonb), $8, $9, $10)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query,
+		r.ID, r.TelegramChatID, r.Email, r.WebhookURL, r.Tenant, r.PreferredChannels, r.Attributes, r.Timezone, now, now)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return t.Recipient{}, ErrAlreadyExists
+		}
+		db.Logger.Error("Error creating recipient", zap.Error(err), zap.String("recipient", r.ID))
+		return t.Recipient{}, err
+	}
+	return created, nil
+}
+
+func (db *DBConnector) UpdateRecipient(ctx context.Context, r t.Recipient) (t.Recipient, error) {
+	var updated t.Recipient
+	query := `
+		UPDATE notification_service.recipients
+		SET
+			telegram_chat_id = $2, email = $3, webhook_url = $4, tenant = $5, preferred_channels = $6,
+			attributes = COALESCE($7, '{}'::jsonb), timezone = $8, updated_at = $9
+		WHERE
+			id = $1
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &updated, query,
+		r.ID, r.TelegramChatID, r.Email, r.WebhookURL, r.Tenant, r.PreferredChannels, r.Attributes, r.Timezone, time.Now().UTC())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t.Recipient{}, ErrNotFound
+		}
+		db.Logger.Error("Error updating recipient", zap.Error(err), zap.String("recipient", r.ID))
+		return t.Recipient{}, err
+	}
+	return updated, nil
+}
+
+func (db *DBConnector) GetRecipient(ctx context.Context, id string) (t.Recipient, error) {
+	var r t.Recipient
+	query := `
+		SELECT *
+		FROM notification_service.recipients
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &r, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t.Recipient{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching recipient", zap.Error(err), zap.String("recipient", id))
+		return t.Recipient{}, err
+	}
+	return r, nil
+}
+
+// GetRecipients returns the registered recipients among ids, in no particular order
+func (db *DBConnector) GetRecipients(ctx context.Context, ids []string) ([]t.Recipient, error) {
+	recipients := []t.Recipient{}
+	query := `
+		SELECT *
+		FROM notification_service.recipients
+		WHERE id = ANY($1)
+	`
+	if err := db.q().SelectContext(ctx, &recipients, query, pq.Array(ids)); err != nil {
+		db.Logger.Error("Error fetching recipients", zap.Error(err), zap.Int("count", len(ids)))
+		return nil, err
+	}
+	return recipients, nil
+}
+
+func (db *DBConnector) DeleteRecipient(ctx context.Context, id string) error {
+	query := `
+		DELETE FROM notification_service.recipients
+		WHERE id = $1
+	`
+	res, err := db.q().ExecContext(ctx, query, id)
+	if err != nil {
+		db.Logger.Error("Error deleting recipient", zap.Error(err), zap.String("recipient", id))
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+const invalidTextRepresentation = "22P02"
+
+// isMissingRow reports whether err means no row has the requested id; ids that are
+// not UUIDs cannot name any row
+func isMissingRow(err error) bool {
+	var pqErr *pq.Error
+	return err == sql.ErrNoRows || (errors.As(err, &pqErr) && pqErr.Code == invalidTextRepresentation)
+}
+
+// ListRateLimitRules returns the rules matching every non empty filter
+func (db *DBConnector) ListRateLimitRules(ctx context.Context, nType t.NotificationType, recipient, tenant string) ([]t.RateLimitRule, error) {
+	rules := []t.RateLimitRule{}
+	query := `
+		SELECT *
+		FROM notification_service.rate_limit_rules
+		WHERE
+			($1 = '' OR notification_type::text = $1) AND
+			($2 = '' OR recipient = $2) AND
+			($3 = '' OR tenant = $3)
+		ORDER BY notification_type, recipient, tenant, duration, id
+	`
+	if err := db.q().SelectContext(ctx, &rules, query, string(nType), recipient, tenant); err != nil {
+		db.Logger.Error("Error listing rate limit rules", zap.Error(err))
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (db *DBConnector) GetRateLimitRule(ctx context.Context, id string) (t.RateLimitRule, error) {
+	var rule t.RateLimitRule
+	query := `
+		SELECT *
+		FROM notification_service.rate_limit_rules
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &rule, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.RateLimitRule{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching rate limit rule", zap.Error(err), zap.String("rule_id", id))
+		return t.RateLimitRule{}, err
+	}
+	return rule, nil
+}
+
+func (db *DBConnector) CreateRateLimitRule(ctx context.Context, rule t.RateLimitRule) (t.RateLimitRule, error) {
+	var created t.RateLimitRule
+	query := `
+		INSERT INTO notification_service.rate_limit_rules
+			(notification_type, max_count, duration, strategy, burst, refill_rate, recipient, tenant, critical_bypass)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query,
+		rule.NotificationType, rule.MaxCount, rule.Duration, rule.Strategy, rule.Burst, rule.RefillRate, rule.Recipient, rule.Tenant,
+		rule.CriticalBypass)
+	if err != nil {
+		db.Logger.Error("Error creating rate limit rule",
+			zap.Error(err),
+			zap.String("notification_type", string(rule.NotificationType)),
+		)
+		return t.RateLimitRule{}, err
+	}
+	return created, nil
+}
+
+func (db *DBConnector) UpdateRateLimitRule(ctx context.Context, rule t.RateLimitRule) (t.RateLimitRule, error) {
+	var updated t.RateLimitRule
+	query := `
+		UPDATE notification_service.rate_limit_rules
+		SET
+			notification_type = $2, max_count = $3, duration = $4, strategy = $5, burst = $6,
+			refill_rate = $7, recipient = $8, tenant = $9, critical_bypass = $10
+		WHERE
+			id = $1
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &updated, query,
+		rule.ID, rule.NotificationType, rule.MaxCount, rule.Duration, rule.Strategy, rule.Burst, rule.RefillRate, rule.Recipient, rule.Tenant,
+		rule.CriticalBypass)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.RateLimitRule{}, ErrNotFound
+		}
+		db.Logger.Error("Error updating rate limit rule", zap.Error(err), zap.String("rule_id", rule.ID))
+		return t.RateLimitRule{}, err
+	}
+	return updated, nil
+}
+
+func (db *DBConnector) DeleteRateLimitRule(ctx context.Context, id string) error {
+	query := `
+		DELETE FROM notification_service.rate_limit_rules
+		WHERE id = $1
+	`
+	res, err := db.q().ExecContext(ctx, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return ErrNotFound
+		}
+		db.Logger.Error("Error deleting rate limit rule", zap.Error(err), zap.String("rule_id", id))
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// ScheduleNotification keeps sn until its send_at
+func (db *DBConnector) ScheduleNotification(ctx context.Context, sn t.ScheduledNotification) (t.ScheduledNotification, error) {
+	var created t.ScheduledNotification
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_service.scheduled_notifications
+			(recipient, notification_type, payload, send_at, status, available_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $4, $6, $6)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query,
+		sn.Recipient, sn.NotificationGroup, sn.Payload, sn.SendAt.UTC(), t.Scheduled, now)
+	if err != nil {
+		db.Logger.Error("Error scheduling notification",
+			zap.Error(err),
+			zap.String("recipient", sn.Recipient),
+			zap.Time("send_at", sn.SendAt),
+		)
+		return t.ScheduledNotification{}, err
+	}
+	return created, nil
+}
+
+func (db *DBConnector) GetScheduledNotification(ctx context.Context, id string) (t.ScheduledNotification, error) {
+	var sn t.ScheduledNotification
+	query := `
+		SELECT *
+		FROM notification_service.scheduled_notifications
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &sn, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.ScheduledNotification{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching scheduled notification", zap.Error(err), zap.String("id", id))
+		return t.ScheduledNotification{}, err
+	}
+	return sn, nil
+}
+
+// ListScheduledNotifications returns the scheduled notifications matching every non empty
+// filter, the soonest first
+func (db *DBConnector) ListScheduledNotifications(ctx context.Context, f t.ScheduledFilter) ([]t.ScheduledNotification, error) {
+	scheduled := []t.ScheduledNotification{}
+	query := `
+		SELECT *
+		FROM notification_service.scheduled_notifications
+		WHERE
+			($1 = '' OR recipient = $1) AND
+			($2 = '' OR status = $2)
+		ORDER BY send_at, id
+		LIMIT $3
+	`
+	if err := db.q().SelectContext(ctx, &scheduled, query, f.Recipient, string(f.Status), f.Limit); err != nil {
+		db.Logger.Error("Error listing scheduled notifications", zap.Error(err))
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// CancelScheduledNotification cancels a notification still waiting for its send_at;
+// ErrNotFound when there is none with that id in SCHEDULED
+func (db *DBConnector) CancelScheduledNotification(ctx context.Context, id string) (t.ScheduledNotification, error) {
+	var cancelled t.ScheduledNotification
+	query := `
+		UPDATE notification_service.scheduled_notifications
+		SET status = $2, updated_at = $3
+		WHERE
+			id = $1 AND
+			status = $4
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &cancelled, query, id, t.Cancelled, time.Now().UTC(), t.Scheduled)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.ScheduledNotification{}, ErrNotFound
+		}
+		db.Logger.Error("Error cancelling scheduled notification", zap.Error(err), zap.String("id", id))
+		return t.ScheduledNotification{}, err
+	}
+	return cancelled, nil
+}
+
+// ClaimScheduledNotification reserves the due notification waiting the longest until the
+// lease ends, ErrNotFound when none is due
+func (db *DBConnector) ClaimScheduledNotification(ctx context.Context, lease time.Duration) (t.ScheduledNotification, error) {
+	var claimed t.ScheduledNotification
+	now := time.Now().UTC()
+	query := `
+		UPDATE notification_service.scheduled_notifications
+		SET available_at = $1
+		WHERE id = (
+			SELECT id
+			FROM notification_service.scheduled_notifications
+			WHERE
+				status = $2 AND
+				available_at <= $3
+			ORDER BY available_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &claimed, query, now.Add(lease), t.Scheduled, now)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.ScheduledNotification{}, ErrNotFound
+		}
+		db.Logger.Error("Error claiming scheduled notification", zap.Error(err))
+		return t.ScheduledNotification{}, err
+	}
+	return claimed, nil
+}
+
+// MarkDispatched records the outcome of sending a scheduled notification
+func (db *DBConnector) MarkDispatched(ctx context.Context, sn t.ScheduledNotification) error {
+	query := `
+		UPDATE notification_service.scheduled_notifications
+		SET status = $2, result = $3, notification_id = $4, error = $5, updated_at = $6
+		WHERE id = $1
+	`
+	_, err := db.q().ExecContext(ctx, query,
+		sn.ID, t.Dispatched, sn.Result, sn.NotificationID, sn.Error, time.Now().UTC())
+	if err != nil {
+		db.Logger.Error("Error marking scheduled notification dispatched", zap.Error(err), zap.String("id", sn.ID))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+const foreignKeyViolation = "23503"
+
+// segmentMembers selects the id of every member of the segment $1: its static members and,
+// unless its filter is empty, the registered recipients matching all the filter fields
+const segmentMembers = `
+	SELECT recipient AS id
+	FROM notification_service.segment_members
+	WHERE segment_id = $1
+	UNION
+	SELECT r.id
+	FROM notification_service.recipients r
+	JOIN notification_service.segments s ON s.id = $1
+	WHERE
+		s.filter <> '{}'::jsonb AND
+		r.tenant = COALESCE(s.filter->>'tenant', r.tenant) AND
+		(s.filter->'channels' IS NULL OR
+			r.preferred_channels && ARRAY(SELECT jsonb_array_elements_text(s.filter->'channels'))) AND
+		r.attributes @> COALESCE(s.filter->'attributes', '{}'::jsonb)
+`
+
+// isMissingReference reports whether err is a foreign key violation, the row referenced
+// by the insert does not exist
+func isMissingReference(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation
+}
+
+func (db *DBConnector) ListSegments(ctx context.Context) ([]t.Segment, error) {
+	segments := []t.Segment{}
+	query := `
+		SELECT *
+		FROM notification_service.segments
+		ORDER BY name
+	`
+	if err := db.q().SelectContext(ctx, &segments, query); err != nil {
+		db.Logger.Error("Error listing segments", zap.Error(err))
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (db *DBConnector) GetSegment(ctx context.Context, id string) (t.Segment, error) {
+	var segment t.Segment
+	query := `
+		SELECT *
+		FROM notification_service.segments
+		WHERE id = $1
+	`
+	err := db.q().GetContext(ctx, &segment, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Segment{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching segment", zap.Error(err), zap.String("segment_id", id))
+		return t.Segment{}, err
+	}
+	return segment, nil
+}
+
+func (db *DBConnector) CreateSegment(ctx context.Context, segment t.Segment) (t.Segment, error) {
+	var created t.Segment
+	now := time.Now().UTC()
+	query := `
+		INSERT INTO notification_service.segments (name, description, filter, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query, segment.Name, segment.Description, segment.Filter, now, now)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return t.Segment{}, ErrAlreadyExists
+		}
+		db.Logger.Error("Error creating segment", zap.Error(err), zap.String("name", segment.Name))
+		return t.Segment{}, err
+	}
+	return created, nil
+}
+
+func (db *DBConnector) UpdateSegment(ctx context.Context, segment t.Segment) (t.Segment, error) {
+	var updated t.Segment
+	query := `
+		UPDATE notification_service.segments
+		SET name = $2, description = $3, filter = $4, updated_at = $5
+		WHERE id = $1
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &updated, query,
+		segment.ID, segment.Name, segment.Description, segment.Filter, time.Now().UTC())
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case isMissingRow(err):
+			return t.Segment{}, ErrNotFound
+		case errors.As(err, &pqErr) && pqErr.Code == uniqueViolation:
+			return t.Segment{}, ErrAlreadyExists
+		}
+		db.Logger.Error("Error updating segment", zap.Error(err), zap.String("segment_id", segment.ID))
+		return t.Segment{}, err
+	}
+	return updated, nil
+}
+
+// DeleteSegment removes the segment along with its static members and broadcasts
+func (db *DBConnector) DeleteSegment(ctx context.Context, id string) error {
+	query := `
+		DELETE FROM notification_service.segments
+		WHERE id = $1
+	`
+	res, err := db.q().ExecContext(ctx, query, id)
+	if err != nil {
+		if isMissingRow(err) {
+			return ErrNotFound
+		}
+		db.Logger.Error("Error deleting segment", zap.Error(err), zap.String("segment_id", id))
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddSegmentMember makes recipient a static member of the segment; adding a member twice
+// is not an error
+func (db *DBConnector) AddSegmentMember(ctx context.Context, segmentID, recipient string) error {
+	query := `
+		INSERT INTO notification_service.segment_members (segment_id, recipient, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (segment_id, recipient) DO NOTHING
+	`
+	if _, err := db.q().ExecContext(ctx, query, segmentID, recipient, time.Now().UTC()); err != nil {
+		if isMissingRow(err) || isMissingReference(err) {
+			return ErrNotFound
+		}
+		db.Logger.Error("Error adding segment member",
+			zap.Error(err),
+			zap.String("segment_id", segmentID),
+			zap.String("recipient", recipient),
+		)
+		return err
+	}
+	return nil
+}
+
+// RemoveSegmentMember removes a static member; recipients selected by the filter stay
+// members until they no longer match it
+func (db *DBConnector) RemoveSegmentMember(ctx context.Context, segmentID, recipient string) error {
+	query := `
+		DELETE FROM notification_service.segment_members
+		WHERE segment_id = $1 AND recipient = $2
+	`
+	res, err := db.q().ExecContext(ctx, query, segmentID, recipient)
+	if err != nil {
+		if isMissingRow(err) {
+			return ErrNotFound
+		}
+		db.Logger.Error("Error removing segment member",
+			zap.Error(err),
+			zap.String("segment_id", segmentID),
+			zap.String("recipient", recipient),
+		)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListSegmentMembers returns up to limit members of the segment coming after the recipient
+// after, in recipient order, so that the whole segment can be walked a page at a time
+func (db *DBConnector) ListSegmentMembers(ctx context.Context, segmentID, after string, limit int) ([]string, error) {
+	members := []string{}
+	query := `
+		SELECT id
+		FROM (` + segmentMembers + `) AS members
+		WHERE id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+	if err := db.q().SelectContext(ctx, &members, query, segmentID, after, limit); err != nil {
+		if isMissingRow(err) {
+			return nil, ErrNotFound
+		}
+		db.Logger.Error("Error listing segment members", zap.Error(err), zap.String("segment_id", segmentID))
+		return nil, err
+	}
+	return members, nil
+}
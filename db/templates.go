@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	t "notification_service/types"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// CreateTemplate saves tpl as the next version of its name and locale, the first one
+// when there is none yet. Callers creating versions of the same template concurrently
+// must serialize, otherwise all but one fail with ErrAlreadyExists.
+func (db *DBConnector) CreateTemplate(ctx context.Context, tpl t.Template) (t.Template, error) {
+	var created t.Template
+	query := `
+		INSERT INTO notification_service.templates
+			(name, locale, version, title, body, html_body, variables, created_at)
+		SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, $5, $6, $7
+		FROM notification_service.templates
+		WHERE name = $1 AND locale = $2
+		RETURNING *
+	`
+	err := db.q().GetContext(ctx, &created, query,
+		tpl.Name, tpl.Locale, tpl.Title, tpl.Body, tpl.HTMLBody, tpl.Variables, time.Now().UTC())
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return t.Template{}, ErrAlreadyExists
+		}
+		db.Logger.Error("Error creating template",
+			zap.Error(err),
+			zap.String("name", tpl.Name),
+			zap.String("locale", tpl.Locale),
+		)
+		return t.Template{}, err
+	}
+	return created, nil
+}
+
+// GetTemplate returns the version of the template name in locale, the latest one when
+// version is zero
+func (db *DBConnector) GetTemplate(ctx context.Context, name, locale string, version int) (t.Template, error) {
+	var tpl t.Template
+	query := `
+		SELECT *
+		FROM notification_service.templates
+		WHERE name = $1 AND locale = $2 AND ($3 = 0 OR version = $3)
+		ORDER BY version DESC
+		LIMIT 1
+	`
+	err := db.q().GetContext(ctx, &tpl, query, name, locale, version)
+	if err != nil {
+		if isMissingRow(err) {
+			return t.Template{}, ErrNotFound
+		}
+		db.Logger.Error("Error fetching template",
+			zap.Error(err),
+			zap.String("name", name),
+			zap.String("locale", locale),
+			zap.Int("version", version),
+		)
+		return t.Template{}, err
+	}
+	return tpl, nil
+}
+
+// ListTemplates returns the latest version of every template in every locale
+func (db *DBConnector) ListTemplates(ctx context.Context) ([]t.Template, error) {
+	templates := []t.Template{}
+	query := `
+		SELECT DISTINCT ON (name, locale) *
+		FROM notification_service.templates
+		ORDER BY name, locale, version DESC
+	`
+	if err := db.q().SelectContext(ctx, &templates, query); err != nil {
+		db.Logger.Error("Error listing templates", zap.Error(err))
+		return nil, err
+	}
+	return templates, nil
+}
+
+// ListTemplateVersions returns every version of the template name, in every locale when
+// locale is empty, the latest first
+func (db *DBConnector) ListTemplateVersions(ctx context.Context, name, locale string) ([]t.Template, error) {
+	templates := []t.Template{}
+	query := `
+		SELECT *
+		FROM notification_service.templates
+		WHERE name = $1 AND ($2 = '' OR locale = $2)
+		ORDER BY locale, version DESC
+	`
+	if err := db.q().SelectContext(ctx, &templates, query, name, locale); err != nil {
+		db.Logger.Error("Error listing template versions", zap.Error(err), zap.String("name", name))
+		return nil, err
+	}
+	return templates, nil
+}
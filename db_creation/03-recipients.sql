@@ -0,0 +1,9 @@
+CREATE TABLE notification_service.recipients (
+    id VARCHAR(255) PRIMARY KEY,
+    telegram_chat_id BIGINT,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    webhook_url TEXT NOT NULL DEFAULT '',
+    preferred_channels TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
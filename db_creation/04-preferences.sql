@@ -0,0 +1,10 @@
+CREATE TABLE notification_service.recipient_preferences (
+    recipient VARCHAR(255) NOT NULL,
+    notification_type notification_service.notification_type NOT NULL,
+    opted_out BOOLEAN NOT NULL DEFAULT FALSE,
+    quiet_hours_start VARCHAR(5) NOT NULL DEFAULT '',
+    quiet_hours_end VARCHAR(5) NOT NULL DEFAULT '',
+    preferred_channel TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (recipient, notification_type)
+);
@@ -0,0 +1,3 @@
+-- notifications is a sliding log: one row per sent notification, counted by created_at
+CREATE INDEX notifications_recipient_type_created_at_idx
+    ON notification_service.notifications (recipient, notification_type, created_at);
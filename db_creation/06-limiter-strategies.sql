@@ -0,0 +1,16 @@
+CREATE TYPE notification_service.limiter_strategy AS ENUM ('FIXED_WINDOW', 'SLIDING_WINDOW', 'TOKEN_BUCKET');
+
+-- burst is the bucket capacity and refill_rate the tokens added per second; when left at 0
+-- they default to max_count and max_count / duration
+ALTER TABLE notification_service.rate_limit_rules
+    ADD COLUMN strategy notification_service.limiter_strategy NOT NULL DEFAULT 'SLIDING_WINDOW',
+    ADD COLUMN burst INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN refill_rate NUMERIC NOT NULL DEFAULT 0;
+
+CREATE TABLE notification_service.token_buckets (
+    rule_id UUID NOT NULL REFERENCES notification_service.rate_limit_rules (id) ON DELETE CASCADE,
+    recipient VARCHAR(255) NOT NULL,
+    tokens NUMERIC NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (rule_id, recipient)
+);
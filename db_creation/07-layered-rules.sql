@@ -0,0 +1,7 @@
+-- a notification type may have several rules, all of them must allow a send
+CREATE INDEX rate_limit_rules_notification_type_idx
+    ON notification_service.rate_limit_rules (notification_type);
+
+INSERT INTO notification_service.rate_limit_rules (notification_type, max_count, duration)
+VALUES
+    ('MARKETING', 10, EXTRACT(EPOCH FROM INTERVAL '1 day'));
@@ -0,0 +1,17 @@
+ALTER TABLE notification_service.recipients
+    ADD COLUMN tenant VARCHAR(255) NOT NULL DEFAULT '';
+
+-- a rule with a recipient or a tenant overrides the global rules of its notification type
+-- for that recipient or tenant: recipient rules win over tenant rules, which win over global ones
+ALTER TABLE notification_service.rate_limit_rules
+    ADD COLUMN recipient VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN tenant VARCHAR(255) NOT NULL DEFAULT '',
+    ADD CONSTRAINT rate_limit_rules_single_scope CHECK (recipient = '' OR tenant = '');
+
+CREATE INDEX rate_limit_rules_recipient_idx
+    ON notification_service.rate_limit_rules (notification_type, recipient)
+    WHERE recipient <> '';
+
+CREATE INDEX rate_limit_rules_tenant_idx
+    ON notification_service.rate_limit_rules (notification_type, tenant)
+    WHERE tenant <> '';
@@ -0,0 +1,27 @@
+-- accepted notifications waiting for delivery; rows are written in the transaction that
+-- records the send against the rate limit and claimed by the delivery workers
+CREATE TABLE notification_service.outbox (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    recipient VARCHAR(255) NOT NULL,
+    notification_type notification_service.notification_type NOT NULL,
+    channel TEXT NOT NULL,
+    address TEXT NOT NULL,
+    message_id VARCHAR(255) NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT '',
+    html_body TEXT NOT NULL DEFAULT '',
+    data JSONB,
+    unsubscribe_url TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'QUEUED',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    -- when a worker may claim the row: now for queued rows, the lease end for rows being sent
+    available_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    reference TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX outbox_pending_idx
+    ON notification_service.outbox (available_at)
+    WHERE status IN ('QUEUED', 'SENDING');
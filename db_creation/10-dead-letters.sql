@@ -0,0 +1,15 @@
+-- notifications whose delivery failed for good; the outbox row stays FAILED and is
+-- queued again when its dead letter is requeued
+CREATE TABLE notification_service.dead_letters (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    notification_id UUID NOT NULL REFERENCES notification_service.outbox (id) ON DELETE CASCADE,
+    recipient VARCHAR(255) NOT NULL,
+    notification_type notification_service.notification_type NOT NULL,
+    channel TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX dead_letters_created_at_idx
+    ON notification_service.dead_letters (created_at);
@@ -0,0 +1,21 @@
+-- status history of the notifications of the outbox, which also keeps the rate limited ones
+CREATE TABLE notification_service.notification_events (
+    id BIGSERIAL PRIMARY KEY,
+    notification_id UUID NOT NULL REFERENCES notification_service.outbox (id) ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    -- delivery attempt the event belongs to, 0 before the first one
+    attempt INTEGER NOT NULL DEFAULT 0,
+    -- error of a failed attempt or channel reference of a delivery
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX notification_events_notification_idx
+    ON notification_service.notification_events (notification_id, created_at);
+
+-- newest first listing of the outbox, for one recipient or for all of them
+CREATE INDEX outbox_recipient_created_at_idx
+    ON notification_service.outbox (recipient, created_at);
+
+CREATE INDEX outbox_created_at_idx
+    ON notification_service.outbox (created_at);
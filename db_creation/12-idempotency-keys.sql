@@ -0,0 +1,12 @@
+-- responses to /V1/notify requests sent with an Idempotency-Key header, replayed when
+-- the same key is used again before it expires
+CREATE TABLE notification_service.idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    response JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx
+    ON notification_service.idempotency_keys (expires_at);
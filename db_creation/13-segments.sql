@@ -0,0 +1,47 @@
+-- free form attributes of a recipient, such as {"service": "billing"}, matched by segment filters
+ALTER TABLE notification_service.recipients
+    ADD COLUMN attributes JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX recipients_attributes_idx
+    ON notification_service.recipients USING GIN (attributes);
+
+-- named groups of recipients: the static members plus, when the filter is not empty, every
+-- registered recipient matching all of its tenant, channels and attributes
+CREATE TABLE notification_service.segments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    filter JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- static members need not be registered, like the recipients of /V1/notify
+CREATE TABLE notification_service.segment_members (
+    segment_id UUID NOT NULL REFERENCES notification_service.segments (id) ON DELETE CASCADE,
+    recipient VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (segment_id, recipient)
+);
+
+-- a notification fanned out to the members of a segment, page by page in recipient order;
+-- last_recipient is where the next page starts and available_at the end of the lease of the
+-- worker sending it
+CREATE TABLE notification_service.broadcasts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    segment_id UUID NOT NULL REFERENCES notification_service.segments (id) ON DELETE CASCADE,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'RUNNING',
+    total INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    summary JSONB NOT NULL DEFAULT '{}',
+    last_recipient VARCHAR(255) NOT NULL DEFAULT '',
+    available_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX broadcasts_running_idx
+    ON notification_service.broadcasts (available_at)
+    WHERE status = 'RUNNING';
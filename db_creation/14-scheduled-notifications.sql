@@ -0,0 +1,25 @@
+-- notifications to send later. The payload goes through the preferences and rate limits
+-- when it is dispatched at send_at; notification_id is then the notification it became and
+-- result its outcome. available_at is when a worker may claim it: send_at at first, the end
+-- of the lease of the worker dispatching it afterwards.
+CREATE TABLE notification_service.scheduled_notifications (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    recipient VARCHAR(255) NOT NULL,
+    notification_type notification_service.notification_type NOT NULL,
+    payload JSONB NOT NULL,
+    send_at TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'SCHEDULED',
+    result TEXT NOT NULL DEFAULT '',
+    notification_id TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    available_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX scheduled_notifications_due_idx
+    ON notification_service.scheduled_notifications (available_at)
+    WHERE status = 'SCHEDULED';
+
+CREATE INDEX scheduled_notifications_recipient_idx
+    ON notification_service.scheduled_notifications (recipient, send_at);
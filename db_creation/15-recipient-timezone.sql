@@ -0,0 +1,4 @@
+-- IANA time zone of a recipient, such as Europe/Madrid; quiet hours and send_at times without
+-- an offset are read in it, UTC when it is empty
+ALTER TABLE notification_service.recipients
+    ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,28 @@
+-- notifications of the types in digest mode rejected by the rate limit, waiting to be sent
+-- together as one summary. A recipient has at most one PENDING digest per type, items
+-- holds the payloads in arrival order; notification_id is the summary once it is SENT.
+-- available_at is when a worker may claim it: deliver_at at first, the end of the lease
+-- of the worker delivering it afterwards.
+CREATE TABLE notification_service.digests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    recipient VARCHAR(255) NOT NULL,
+    notification_type notification_service.notification_type NOT NULL,
+    status TEXT NOT NULL DEFAULT 'PENDING',
+    items JSONB NOT NULL DEFAULT '[]',
+    item_count INT NOT NULL DEFAULT 0,
+    deliver_at TIMESTAMP NOT NULL,
+    notification_id TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    available_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX digests_pending_idx
+    ON notification_service.digests (recipient, notification_type)
+    WHERE status = 'PENDING';
+
+CREATE INDEX digests_due_idx
+    ON notification_service.digests (available_at)
+    WHERE status = 'PENDING';
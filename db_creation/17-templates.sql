@@ -0,0 +1,15 @@
+-- the texts of the messages, by name and locale. Versions are never changed: saving a
+-- template adds the next version, and notifications use the latest one unless they ask
+-- for another. variables are the names a request has to set to render it.
+CREATE TABLE notification_service.templates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    locale VARCHAR(35) NOT NULL,
+    version INT NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT '',
+    html_body TEXT NOT NULL DEFAULT '',
+    variables TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (name, locale, version)
+);
@@ -0,0 +1,18 @@
+-- critical notifications are never rejected by the rules with critical_bypass set, though
+-- they still count against them; admins opt rules in through the rules API
+ALTER TABLE notification_service.rate_limit_rules
+    ADD COLUMN critical_bypass BOOLEAN NOT NULL DEFAULT false;
+
+-- the delivery workers claim the most urgent notifications first, the oldest first within
+-- a priority
+ALTER TABLE notification_service.outbox
+    ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal';
+
+DROP INDEX notification_service.outbox_pending_idx;
+
+CREATE INDEX outbox_pending_idx
+    ON notification_service.outbox (
+        (array_position(ARRAY['critical', 'high', 'normal', 'low'], priority)),
+        available_at
+    )
+    WHERE status IN ('QUEUED', 'SENDING');
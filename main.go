@@ -8,6 +8,8 @@ import (
 	s "notification_service/setup"
 
 	_ "github.com/lib/pq"
+	// the alpine image has no zoneinfo for the time zones of the recipients
+	_ "time/tzdata"
 )
 
 func main() {
@@ -17,8 +19,56 @@ func main() {
 		log.Fatalf("could not configure db: %v", err)
 		return
 	}
-	s := service.NewNotificationService(db.Logger, db)
+	channels, err := s.SetupChannels(db.Logger)
+	if err != nil {
+		log.Fatalf("could not configure channels: %v", err)
+		return
+	}
+	unsubscribe, err := s.SetupUnsubscribe()
+	if err != nil {
+		log.Fatalf("could not configure unsubscribe links: %v", err)
+		return
+	}
+	retries, err := s.SetupRetryPolicies(channels)
+	if err != nil {
+		log.Fatalf("could not configure delivery retries: %v", err)
+		return
+	}
+	idempotencyTTL, err := s.SetupIdempotency()
+	if err != nil {
+		log.Fatalf("could not configure idempotency keys: %v", err)
+		return
+	}
+	broadcastPageSize, err := s.SetupBroadcasts()
+	if err != nil {
+		log.Fatalf("could not configure broadcasts: %v", err)
+		return
+	}
+	digests, err := s.SetupDigests()
+	if err != nil {
+		log.Fatalf("could not configure digests: %v", err)
+		return
+	}
+	quietHoursBypass, err := s.SetupQuietHoursBypass()
+	if err != nil {
+		log.Fatalf("could not configure quiet hours: %v", err)
+		return
+	}
+	svc := service.NewNotificationService(db.Logger, db, channels)
+	svc.Unsubscribe = unsubscribe
+	svc.Retries = retries
+	svc.IdempotencyTTL = idempotencyTTL
+	svc.BroadcastPageSize = broadcastPageSize
+	svc.Digests = digests
+	svc.QuietHoursBypass = quietHoursBypass
+
+	workers, err := s.SetupWorkers(svc)
+	if err != nil {
+		log.Fatalf("could not configure delivery workers: %v", err)
+		return
+	}
+	go workers.Run(ctx)
 
 	// Create server
-	server.ServerSetup(s)
+	server.ServerSetup(svc)
 }
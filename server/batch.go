@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"notification_service/types"
+)
+
+const (
+	maxBatchSize  = 1000
+	maxBatchBytes = 16 << 20
+)
+
+// ValidateBatch decodes a JSON array of notifications. Items failing ValidateInputData are
+// reported as invalid results; the valid ones are returned along with their index.
+func ValidateBatch(body []byte) ([]types.InputInfo, []int, []types.BatchResult, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, nil, nil, errors.New("invalid JSON format, expected an array of notifications")
+	}
+	if len(raw) == 0 {
+		return nil, nil, nil, errors.New("the batch is empty")
+	}
+	if len(raw) > maxBatchSize {
+		return nil, nil, nil, fmt.Errorf("the batch exceeds %d notifications", maxBatchSize)
+	}
+
+	items := make([]types.InputInfo, 0, len(raw))
+	indexes := make([]int, 0, len(raw))
+	invalid := []types.BatchResult{}
+	for i, item := range raw {
+		in, err := ValidateInputData(bytes.NewReader(item))
+		if err == nil && in.SendAt != "" {
+			err = errors.New("send_at is not supported in a batch")
+		}
+		if err != nil {
+			invalid = append(invalid, types.BatchResult{Index: i, Status: types.BatchInvalid, Error: err.Error()})
+			continue
+		}
+		items = append(items, in)
+		indexes = append(indexes, i)
+	}
+	return items, indexes, invalid, nil
+}
+
+// SendBatchHandler accepts an array of notifications and answers with the outcome of
+// each of them; a batch where some items are rejected is still a success
+func (s *server) SendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxBatchBytes)); err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		s.writeError(w, status, fmt.Errorf("could not read batch: %w", err))
+		return
+	}
+	items, indexes, invalid, err := ValidateBatch(buf.Bytes())
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	results := make([]types.BatchResult, len(items)+len(invalid))
+	rendered, renderedIndexes := items[:0], indexes[:0]
+	for j, in := range items {
+		status, err := s.applyTemplate(r.Context(), &in)
+		if status == http.StatusInternalServerError {
+			s.writeError(w, status, fmt.Errorf("could not send batch: %w", err))
+			return
+		}
+		if err != nil {
+			invalid = append(invalid, types.BatchResult{Index: indexes[j], Status: types.BatchInvalid, Error: err.Error()})
+			continue
+		}
+		rendered, renderedIndexes = append(rendered, in), append(renderedIndexes, indexes[j])
+	}
+	items, indexes = rendered, renderedIndexes
+	for _, res := range invalid {
+		results[res.Index] = res
+	}
+	if len(items) > 0 {
+		sent, err := s.Svc.SendBatch(r.Context(), items)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not send batch: %w", err))
+			return
+		}
+		for j, res := range sent {
+			res.Index = indexes[j]
+			results[res.Index] = res
+		}
+	}
+
+	summary := types.BatchSummary{}
+	for _, res := range results {
+		summary[res.Status]++
+	}
+	s.writeJSON(w, http.StatusOK, types.BatchResponse{Results: results, Summary: summary})
+}
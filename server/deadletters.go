@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *server) ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	channel := types.Channel(strings.ToUpper(q.Get("channel")))
+	if channel != "" && !types.IsValidChannel(channel) {
+		s.writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("invalid channel: %s", channel))
+		return
+	}
+
+	letters, err := s.Svc.DB.ListDeadLetters(r.Context(), channel, q.Get("recipient"))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list dead letters: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, letters)
+}
+
+func (s *server) GetDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get dead letter: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+// RequeueDeadLetterHandler queues the notification of a dead letter again; the workers
+// deliver it with a fresh attempt count
+func (s *server) RequeueDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.RequeueDeadLetter(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not requeue dead letter: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusAccepted, out)
+}
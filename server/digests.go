@@ -0,0 +1,18 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// GetDigestHandler returns a digest with the notifications it gathered
+func (s *server) GetDigestHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetDigest(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get digest: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
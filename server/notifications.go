@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultNotificationsLimit = 100
+	maxNotificationsLimit     = 1000
+)
+
+// ParseNotificationFilter reads the filters of the notification list from the query
+func ParseNotificationFilter(q map[string][]string) (types.NotificationFilter, error) {
+	get := func(key string) string {
+		if v := q[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	f := types.NotificationFilter{Recipient: get("recipient"), Limit: defaultNotificationsLimit}
+
+	if raw := get("group"); raw != "" {
+		group, err := parseGroup(raw)
+		if err != nil {
+			return types.NotificationFilter{}, err
+		}
+		f.NotificationGroup = group
+	}
+	if raw := get("channel"); raw != "" {
+		f.Channel = types.Channel(strings.ToUpper(raw))
+		if !types.IsValidChannel(f.Channel) {
+			return types.NotificationFilter{}, fmt.Errorf("invalid channel: %s", f.Channel)
+		}
+	}
+	if raw := get("status"); raw != "" {
+		f.Status = types.DeliveryStatus(strings.ToUpper(raw))
+		if !types.IsValidDeliveryStatus(f.Status) {
+			return types.NotificationFilter{}, fmt.Errorf("invalid status: %s", f.Status)
+		}
+	}
+	if raw := get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxNotificationsLimit {
+			return types.NotificationFilter{}, fmt.Errorf("limit must be between 1 and %d", maxNotificationsLimit)
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+func (s *server) ListNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseNotificationFilter(r.URL.Query())
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	notifications, err := s.Svc.DB.ListNotifications(r.Context(), f)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list notifications: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, notifications)
+}
+
+// GetNotificationHandler returns a notification with its status history
+func (s *server) GetNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetNotification(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get notification: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
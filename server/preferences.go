@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"notification_service/service"
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ValidatePreference decodes and validates a preference update for one notification type
+func ValidatePreference(body io.Reader) (types.Preference, error) {
+	var p types.Preference
+	if err := json.NewDecoder(body).Decode(&p); err != nil {
+		return types.Preference{}, errors.New("invalid JSON format")
+	}
+
+	if (p.QuietHoursStart == "") != (p.QuietHoursEnd == "") {
+		return types.Preference{}, errors.New("quiet_hours_start and quiet_hours_end must be set together")
+	}
+	for _, v := range []string{p.QuietHoursStart, p.QuietHoursEnd} {
+		if v == "" {
+			continue
+		}
+		if _, err := service.ParseClock(v); err != nil {
+			return types.Preference{}, err
+		}
+	}
+
+	if p.PreferredChannel != "" {
+		p.PreferredChannel = types.Channel(strings.ToUpper(string(p.PreferredChannel)))
+		if !types.IsValidChannel(p.PreferredChannel) {
+			return types.Preference{}, fmt.Errorf("invalid channel: %s", p.PreferredChannel)
+		}
+	}
+	return p, nil
+}
+
+func parseGroup(raw string) (types.NotificationType, error) {
+	group := types.NotificationType(strings.ToUpper(raw))
+	if !types.IsValidNotificationType(group) {
+		return "", fmt.Errorf("invalid notification type: %s", group)
+	}
+	return group, nil
+}
+
+func (s *server) ListPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := s.Svc.DB.ListPreferences(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list preferences: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, prefs)
+}
+
+func (s *server) UpdatePreferenceHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := parseGroup(mux.Vars(r)["group"])
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	p, err := ValidatePreference(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	p.Recipient = mux.Vars(r)["id"]
+	p.NotificationType = group
+
+	saved, err := s.Svc.DB.UpsertPreference(r.Context(), p)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not save preference: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, saved)
+}
+
+// unsubscribePage asks a recipient following an unsubscribe link to confirm, since link
+// scanners and prefetching mail clients open it too, then tells them it is done
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>{{.Recipient}} no longer receives {{.Group}} notifications.</p>
+{{else}}<form method="post" action="{{.Action}}">
+<p>Stop sending {{.Group}} notifications to {{.Recipient}}?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type unsubscribeView struct {
+	Recipient string
+	Group     types.NotificationType
+	Action    string
+	Done      bool
+}
+
+// UnsubscribeHandler serves the signed one-click unsubscribe links sent with
+// notifications. It is public: the signature is the only credential. GET only renders a
+// confirmation page; the opt out is made by the POST of that page or of a mail client
+// honouring List-Unsubscribe-Post.
+func (s *server) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Svc.Unsubscribe == nil {
+		s.writeError(w, http.StatusNotFound, errors.New("unsubscribe links are not enabled"))
+		return
+	}
+
+	q := r.URL.Query()
+	recipient := q.Get("recipient")
+	group, err := parseGroup(q.Get("group"))
+	if err != nil || recipient == "" || !s.Svc.Unsubscribe.Verify(recipient, group, q.Get("sig")) {
+		s.writeError(w, http.StatusForbidden, errors.New("invalid unsubscribe link"))
+		return
+	}
+
+	view := unsubscribeView{Recipient: recipient, Group: group, Action: "?" + r.URL.RawQuery}
+	if r.Method != http.MethodPost {
+		s.writeUnsubscribePage(w, view)
+		return
+	}
+	if err := s.Svc.DB.OptOut(r.Context(), recipient, group); err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not unsubscribe: %w", err))
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		view.Done = true
+		s.writeUnsubscribePage(w, view)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, types.Output{
+		Recipient:         recipient,
+		NotificationGroup: group,
+		Message:           "Unsubscribed successfully",
+	})
+}
+
+func (s *server) writeUnsubscribePage(w http.ResponseWriter, view unsubscribeView) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := unsubscribePage.Execute(w, view); err != nil {
+		s.Logger.Error("could not render unsubscribe page", zap.Error(err))
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"notification_service/types"
+)
+
+// QuotaHandler answers whether a notification of the priority query parameter, normal by
+// default, would be allowed now, without sending or recording anything
+func (s *server) QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	recipient := q.Get("recipient")
+	if recipient == "" || q.Get("group") == "" {
+		s.writeError(w, http.StatusUnprocessableEntity, errors.New("missing required fields"))
+		return
+	}
+	group, err := parseGroup(q.Get("group"))
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	priority := types.Priority(strings.ToLower(q.Get("priority")))
+	if priority != "" && !types.IsValidPriority(priority) {
+		s.writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("invalid priority: %s", priority))
+		return
+	}
+
+	quota, err := s.Svc.Quota(r.Context(), recipient, group, priority)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not get quota: %w", err))
+		return
+	}
+	if quota.Rule != nil {
+		setRateLimitHeaders(w.Header(), types.RateLimitDecision{Limit: quota.Limit, Remaining: quota.Remaining, ResetAt: quota.ResetAt})
+	}
+	s.writeJSON(w, http.StatusOK, quota)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	d "notification_service/db"
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+// ValidateRecipient decodes and validates a recipient registration
+func ValidateRecipient(body io.Reader) (types.Recipient, error) {
+	var r types.Recipient
+	if err := json.NewDecoder(body).Decode(&r); err != nil {
+		return types.Recipient{}, errors.New("invalid JSON format")
+	}
+
+	if r.Email != "" {
+		if _, err := mail.ParseAddress(r.Email); err != nil {
+			return types.Recipient{}, fmt.Errorf("invalid email: %s", r.Email)
+		}
+	}
+	if r.WebhookURL != "" {
+		u, err := url.Parse(r.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return types.Recipient{}, fmt.Errorf("invalid webhook_url: %s", r.WebhookURL)
+		}
+	}
+
+	if r.Timezone != "" {
+		if _, err := time.LoadLocation(r.Timezone); err != nil {
+			return types.Recipient{}, fmt.Errorf("invalid timezone: %s", r.Timezone)
+		}
+	}
+
+	channels := make(types.ChannelList, 0, len(r.PreferredChannels))
+	for _, c := range r.PreferredChannels {
+		c = types.Channel(strings.ToUpper(string(c)))
+		if !types.IsValidChannel(c) {
+			return types.Recipient{}, fmt.Errorf("invalid channel: %s", c)
+		}
+		if r.Address(c) == "" {
+			return types.Recipient{}, fmt.Errorf("preferred channel %s has no address", c)
+		}
+		channels = append(channels, c)
+	}
+	r.PreferredChannels = channels
+
+	return r, nil
+}
+
+func (s *server) CreateRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateRecipient(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if in.ID == "" {
+		s.writeError(w, http.StatusUnprocessableEntity, errors.New("missing required fields"))
+		return
+	}
+
+	out, err := s.Svc.DB.CreateRecipient(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not create recipient: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, out)
+}
+
+func (s *server) GetRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetRecipient(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get recipient: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) UpdateRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateRecipient(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	in.ID = mux.Vars(r)["id"]
+
+	out, err := s.Svc.DB.UpdateRecipient(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not update recipient: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) DeleteRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Svc.DB.DeleteRecipient(r.Context(), mux.Vars(r)["id"]); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not delete recipient: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeErrorStatus maps the sentinel errors of the db package to HTTP statuses
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, d.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, d.ErrAlreadyExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
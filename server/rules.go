@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"notification_service/service"
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+// ValidateRule decodes and validates a rate limit rule. A rule with a recipient or a
+// tenant is an override of the global rules of its notification type.
+func ValidateRule(body io.Reader) (types.RateLimitRule, error) {
+	var rule types.RateLimitRule
+	if err := json.NewDecoder(body).Decode(&rule); err != nil {
+		return types.RateLimitRule{}, errors.New("invalid JSON format")
+	}
+
+	group, err := parseGroup(string(rule.NotificationType))
+	if err != nil {
+		return types.RateLimitRule{}, err
+	}
+	rule.NotificationType = group
+
+	if rule.MaxCount < 0 {
+		return types.RateLimitRule{}, errors.New("max_count must not be negative")
+	}
+	if rule.Duration <= 0 {
+		return types.RateLimitRule{}, errors.New("duration must be positive")
+	}
+	if rule.Burst < 0 || rule.RefillRate < 0 {
+		return types.RateLimitRule{}, errors.New("burst and refill_rate must not be negative")
+	}
+
+	rule.Strategy = types.LimiterStrategy(strings.ToUpper(string(rule.Strategy)))
+	if rule.Strategy == "" {
+		rule.Strategy = types.SlidingWindow
+	}
+	if _, err := service.LimiterFor(rule.Strategy); err != nil {
+		return types.RateLimitRule{}, err
+	}
+
+	if rule.Recipient != "" && rule.Tenant != "" {
+		return types.RateLimitRule{}, errors.New("a rule overrides either a recipient or a tenant, not both")
+	}
+	return rule, nil
+}
+
+func (s *server) ListRulesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var group types.NotificationType
+	if raw := q.Get("group"); raw != "" {
+		var err error
+		if group, err = parseGroup(raw); err != nil {
+			s.writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+
+	rules, err := s.Svc.DB.ListRateLimitRules(r.Context(), group, q.Get("recipient"), q.Get("tenant"))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list rules: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, rules)
+}
+
+func (s *server) CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateRule(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	out, err := s.Svc.DB.CreateRateLimitRule(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not create rule: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, out)
+}
+
+func (s *server) GetRuleHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetRateLimitRule(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get rule: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) UpdateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateRule(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	in.ID = mux.Vars(r)["id"]
+
+	out, err := s.Svc.DB.UpdateRateLimitRule(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not update rule: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) DeleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Svc.DB.DeleteRateLimitRule(r.Context(), mux.Vars(r)["id"]); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not delete rule: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
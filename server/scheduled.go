@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"notification_service/service"
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+// ParseScheduledFilter reads the filters of the scheduled notification list from the query
+func ParseScheduledFilter(q map[string][]string) (types.ScheduledFilter, error) {
+	get := func(key string) string {
+		if v := q[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	f := types.ScheduledFilter{Recipient: get("recipient"), Limit: defaultNotificationsLimit}
+
+	if raw := get("status"); raw != "" {
+		f.Status = types.ScheduleStatus(strings.ToUpper(raw))
+		if !types.IsValidScheduleStatus(f.Status) {
+			return types.ScheduledFilter{}, fmt.Errorf("invalid status: %s", f.Status)
+		}
+	}
+	if raw := get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxNotificationsLimit {
+			return types.ScheduledFilter{}, fmt.Errorf("limit must be between 1 and %d", maxNotificationsLimit)
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+func (s *server) ListScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseScheduledFilter(r.URL.Query())
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	scheduled, err := s.Svc.DB.ListScheduledNotifications(r.Context(), f)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list scheduled notifications: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, scheduled)
+}
+
+func (s *server) GetScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetScheduledNotification(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get scheduled notification: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+// CancelScheduledHandler cancels a notification before its send_at; once dispatched or
+// cancelled it answers with a conflict
+func (s *server) CancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.CancelScheduled(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, service.ErrNotCancellable) {
+		s.writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not cancel scheduled notification: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
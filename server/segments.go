@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+const maxSegmentNameLength = 255
+
+// ValidateSegment decodes and validates a segment definition
+func ValidateSegment(body io.Reader) (types.Segment, error) {
+	var segment types.Segment
+	if err := json.NewDecoder(body).Decode(&segment); err != nil {
+		return types.Segment{}, errors.New("invalid JSON format")
+	}
+
+	segment.Name = strings.TrimSpace(segment.Name)
+	if segment.Name == "" {
+		return types.Segment{}, errors.New("missing required fields")
+	}
+	if len(segment.Name) > maxSegmentNameLength {
+		return types.Segment{}, fmt.Errorf("name exceeds %d characters", maxSegmentNameLength)
+	}
+
+	channels := make(types.ChannelList, 0, len(segment.Filter.Channels))
+	for _, c := range segment.Filter.Channels {
+		c = types.Channel(strings.ToUpper(string(c)))
+		if !types.IsValidChannel(c) {
+			return types.Segment{}, fmt.Errorf("invalid channel: %s", c)
+		}
+		channels = append(channels, c)
+	}
+	segment.Filter.Channels = channels
+
+	return segment, nil
+}
+
+// ValidateBroadcast decodes and validates the notification sent to a segment, which
+// takes its recipients from the segment
+func ValidateBroadcast(body io.Reader) (types.InputInfo, error) {
+	var in types.InputInfo
+	if err := json.NewDecoder(body).Decode(&in); err != nil {
+		return types.InputInfo{}, errors.New("invalid JSON format")
+	}
+	if in.Recipient != "" {
+		return types.InputInfo{}, errors.New("a broadcast is sent to the members of the segment, not to a recipient")
+	}
+	if in.NotificationGroup == "" {
+		return types.InputInfo{}, errors.New("missing required fields")
+	}
+	if in.SendAt != "" {
+		return types.InputInfo{}, errors.New("send_at is not supported in a broadcast")
+	}
+	if err := normalizeInput(&in); err != nil {
+		return types.InputInfo{}, err
+	}
+	return in, nil
+}
+
+func (s *server) ListSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	segments, err := s.Svc.DB.ListSegments(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list segments: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, segments)
+}
+
+func (s *server) CreateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateSegment(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	out, err := s.Svc.DB.CreateSegment(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not create segment: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, out)
+}
+
+func (s *server) GetSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetSegment(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get segment: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) UpdateSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateSegment(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	in.ID = mux.Vars(r)["id"]
+
+	out, err := s.Svc.DB.UpdateSegment(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not update segment: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) DeleteSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.Svc.DB.DeleteSegment(r.Context(), mux.Vars(r)["id"]); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not delete segment: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSegmentMembersHandler returns a page of the members of a segment, static and
+// filtered alike, in recipient order; the next page starts after the next field
+func (s *server) ListSegmentMembersHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	limit := defaultNotificationsLimit
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxNotificationsLimit {
+			s.writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("limit must be between 1 and %d", maxNotificationsLimit))
+			return
+		}
+		limit = n
+	}
+
+	if _, err := s.Svc.DB.GetSegment(r.Context(), id); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get segment: %w", err))
+		return
+	}
+	members, err := s.Svc.DB.ListSegmentMembers(r.Context(), id, q.Get("after"), limit)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not list segment members: %w", err))
+		return
+	}
+	out := types.SegmentMembers{Members: members}
+	if len(members) == limit {
+		out.Next = members[len(members)-1]
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) AddSegmentMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.Svc.DB.AddSegmentMember(r.Context(), vars["id"], vars["recipient"]); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not add segment member: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) RemoveSegmentMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.Svc.DB.RemoveSegmentMember(r.Context(), vars["id"], vars["recipient"]); err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not remove segment member: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BroadcastHandler starts sending a notification to every member of a segment and answers
+// with the broadcast, whose progress is read from /V1/broadcasts/{id}
+func (s *server) BroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateBroadcast(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	// every member gets the same variables, so the template is rendered once
+	if status, err := s.applyTemplate(r.Context(), &in); err != nil {
+		s.writeError(w, status, err)
+		return
+	}
+
+	out, err := s.Svc.Broadcast(r.Context(), mux.Vars(r)["id"], in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), err)
+		return
+	}
+	s.writeJSON(w, http.StatusAccepted, out)
+}
+
+func (s *server) GetBroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Svc.DB.GetBroadcast(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get broadcast: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
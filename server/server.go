@@ -7,16 +7,30 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	d "notification_service/db"
 	"notification_service/login"
 	"notification_service/service"
 	"notification_service/types"
 	t "notification_service/types"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
 
+const (
+	maxTitleLength          = 255
+	maxMessageIDLength      = 255
+	maxIdempotencyKeyLength = 255
+
+	// IdempotencyKeyHeader makes /V1/notify answer retries of a request with its first response
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for an idempotency key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
 type Server interface {
 	SendHandler(w http.ResponseWriter, r *http.Request)
 }
@@ -44,13 +58,57 @@ func ValidateInputData(body io.Reader) (types.InputInfo, error) {
 	if in.Recipient == "" || in.NotificationGroup == "" {
 		return types.InputInfo{}, errors.New("missing required fields")
 	}
+	if err := normalizeInput(&in); err != nil {
+		return types.InputInfo{}, err
+	}
+	return in, nil
+}
 
+// normalizeInput validates the fields of a notification but its recipient, upper casing
+// its group and channel
+func normalizeInput(in *types.InputInfo) error {
 	in.NotificationGroup = types.NotificationType(strings.ToUpper(string(in.NotificationGroup)))
 	if !types.IsValidNotificationType(in.NotificationGroup) {
-		return types.InputInfo{}, fmt.Errorf("invalid notification type: %s", in.NotificationGroup)
+		return fmt.Errorf("invalid notification type: %s", in.NotificationGroup)
 	}
 
-	return in, nil
+	if len(in.Title) > maxTitleLength {
+		return fmt.Errorf("title exceeds %d characters", maxTitleLength)
+	}
+	if len(in.MessageID) > maxMessageIDLength {
+		return fmt.Errorf("message_id exceeds %d characters", maxMessageIDLength)
+	}
+
+	if in.Channel != "" {
+		in.Channel = types.Channel(strings.ToUpper(string(in.Channel)))
+		if !types.IsValidChannel(in.Channel) {
+			return fmt.Errorf("invalid channel: %s", in.Channel)
+		}
+	}
+
+	if in.Priority != "" {
+		in.Priority = types.Priority(strings.ToLower(string(in.Priority)))
+		if !types.IsValidPriority(in.Priority) {
+			return fmt.Errorf("invalid priority: %s", in.Priority)
+		}
+	}
+
+	if in.Template != nil {
+		if in.Title != "" || in.Body != "" || in.HTMLBody != "" {
+			return errors.New("title, body and html_body are rendered from the template and cannot be given with it")
+		}
+		if err := normalizeTemplateRef(in.Template); err != nil {
+			return err
+		}
+	}
+
+	// local times are read in the recipient time zone later on, only their format is checked here
+	if in.SendAt != "" {
+		if _, err := service.ParseSendAt(in.SendAt, time.UTC); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *server) SendHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,53 +119,128 @@ func (s *server) SendHandler(w http.ResponseWriter, r *http.Request) {
 
 	in, err := ValidateInputData(r.Body)
 	if err != nil {
-		errorResponse := t.ErrorResponse{
-			Code:    http.StatusUnprocessableEntity,
-			Message: err.Error(),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		if err := json.NewEncoder(w).Encode(errorResponse); err != nil {
-			s.Logger.Sugar().Errorf("could not encoder response: ", err)
-		}
+		s.writeError(w, http.StatusUnprocessableEntity, err)
 		return
 	}
 
-	s.Svc.Input = in
-	out, err := s.Svc.SendNotification(s.ctx)
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		s.writeStored(w, s.notify(r.Context(), s.Svc, in))
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		s.writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("%s exceeds %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+	hash, err := service.RequestHash(in)
 	if err != nil {
-		errorResponse := t.ErrorResponse{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(errorResponse); err != nil {
-			s.Logger.Sugar().Errorf("could not encoder response: ", err)
-		}
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, replayed, err := s.Svc.Once(r.Context(), key, hash, func(db d.Database) t.StoredResponse {
+		return s.notify(r.Context(), s.Svc.WithDB(db), in)
+	})
+	switch {
+	case errors.Is(err, service.ErrIdempotencyConflict):
+		s.writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		s.writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if replayed {
+		w.Header().Set(IdempotentReplayedHeader, "true")
+	}
+	s.writeStored(w, res)
+}
+
+// notify renders the template of in, then sends or schedules it through svc, and returns
+// the response to answer with
+func (s *server) notify(ctx context.Context, svc *service.NotificationService, in t.InputInfo) t.StoredResponse {
+	if status, err := s.applyTemplate(ctx, &in); err != nil {
+		return s.stored(status, nil, t.ErrorResponse{Code: status, Message: err.Error()})
+	}
+	send := svc.SendNotification
+	if in.SendAt != "" {
+		send = svc.Schedule
+	}
+	out, err := send(ctx, in)
+	if err == nil {
+		return s.stored(http.StatusAccepted, nil, out)
+	}
+
+	var rateLimitErr *service.RateLimitError
+	status := http.StatusInternalServerError
+	header := http.Header{}
+	switch {
+	case errors.Is(err, service.ErrOptedOut):
+		status = http.StatusForbidden
+	case errors.Is(err, service.ErrSendAtInPast), errors.Is(err, service.ErrUnregisteredWebhook):
+		status = http.StatusUnprocessableEntity
+	case errors.As(err, &rateLimitErr):
+		status = http.StatusTooManyRequests
+		setRateLimitHeaders(header, rateLimitErr.Decision)
+		header.Set("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter(time.Now()).Seconds())))
+	}
+	errorResponse := t.ErrorResponse{
+		Code:    status,
+		Message: err.Error(),
+	}
+	if rateLimitErr != nil {
+		errorResponse.Rule = &rateLimitErr.Decision.Rule
+		errorResponse.ID = rateLimitErr.NotificationID
+	}
+	return s.stored(status, header, errorResponse)
+}
 
-	response, err := json.Marshal(out)
+// stored encodes v as the JSON body of a response
+func (s *server) stored(status int, header http.Header, v any) t.StoredResponse {
+	body, err := json.Marshal(v)
 	if err != nil {
-		errorResponse := t.ErrorResponse{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(errorResponse); err != nil {
-			s.Logger.Sugar().Errorf("could not encoder response: ", err)
+		body, _ = json.Marshal(t.ErrorResponse{Code: http.StatusInternalServerError, Message: err.Error()})
+		return t.StoredResponse{StatusCode: http.StatusInternalServerError, Body: body}
+	}
+	return t.StoredResponse{StatusCode: status, Header: header, Body: body}
+}
+
+// writeStored sends a response produced by notify, live or replayed
+func (s *server) writeStored(w http.ResponseWriter, res t.StoredResponse) {
+	for name, values := range res.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
 		}
-		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write(response); err != nil {
-		s.Logger.Error("could not send status OK")
+	w.WriteHeader(res.StatusCode)
+	body := make([]byte, 0, len(res.Body)+1)
+	if _, err := w.Write(append(append(body, res.Body...), '\n')); err != nil {
+		s.Logger.Error("could not write response", zap.Error(err))
+	}
+}
+
+// setRateLimitHeaders reports the state of the rule behind decision: its limit, the sends
+// it still allows and when it resets, as a Unix timestamp rounded up to the second
+func setRateLimitHeaders(h http.Header, decision t.RateLimitDecision) {
+	reset := decision.ResetAt.Add(time.Second - time.Nanosecond).Unix()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+}
+
+// writeJSON encodes v as the response body with the given status
+func (s *server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Logger.Sugar().Errorf("could not encoder response: %v", err)
 	}
 }
 
+// writeError sends err as an ErrorResponse with the given status
+func (s *server) writeError(w http.ResponseWriter, status int, err error) {
+	s.writeJSON(w, status, t.ErrorResponse{Code: status, Message: err.Error()})
+}
+
 func ServerSetup(svc *service.NotificationService) *server {
 	s := NewServer(context.Background(), svc)
 	l := &login.Login{
@@ -118,10 +251,48 @@ func ServerSetup(svc *service.NotificationService) *server {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/login", l.LoginHandler).Methods("POST")
+	router.HandleFunc("/unsubscribe", s.UnsubscribeHandler).Methods("GET", "POST")
 
 	protectedRoutes := router.PathPrefix("/V1").Subrouter()
 	protectedRoutes.Use(l.ValidateJWTMiddleware)
 	protectedRoutes.HandleFunc("/notify", s.SendHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/notify/batch", s.SendBatchHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/quota", s.QuotaHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/notifications", s.ListNotificationsHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/notifications/{id}", s.GetNotificationHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/recipients", s.CreateRecipientHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/recipients/{id}", s.GetRecipientHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/recipients/{id}", s.UpdateRecipientHandler).Methods("PUT")
+	protectedRoutes.HandleFunc("/recipients/{id}", s.DeleteRecipientHandler).Methods("DELETE")
+	protectedRoutes.HandleFunc("/recipients/{id}/preferences", s.ListPreferencesHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/recipients/{id}/preferences/{group}", s.UpdatePreferenceHandler).Methods("PUT")
+	protectedRoutes.HandleFunc("/rules", s.ListRulesHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/rules", s.CreateRuleHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/rules/{id}", s.GetRuleHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/rules/{id}", s.UpdateRuleHandler).Methods("PUT")
+	protectedRoutes.HandleFunc("/rules/{id}", s.DeleteRuleHandler).Methods("DELETE")
+	protectedRoutes.HandleFunc("/dead-letters", s.ListDeadLettersHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/dead-letters/{id}", s.GetDeadLetterHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/dead-letters/{id}/requeue", s.RequeueDeadLetterHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/segments", s.ListSegmentsHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/segments", s.CreateSegmentHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/segments/{id}", s.GetSegmentHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/segments/{id}", s.UpdateSegmentHandler).Methods("PUT")
+	protectedRoutes.HandleFunc("/segments/{id}", s.DeleteSegmentHandler).Methods("DELETE")
+	protectedRoutes.HandleFunc("/segments/{id}/members", s.ListSegmentMembersHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/segments/{id}/members/{recipient}", s.AddSegmentMemberHandler).Methods("PUT")
+	protectedRoutes.HandleFunc("/segments/{id}/members/{recipient}", s.RemoveSegmentMemberHandler).Methods("DELETE")
+	protectedRoutes.HandleFunc("/segments/{id}/notify", s.BroadcastHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/broadcasts/{id}", s.GetBroadcastHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/scheduled", s.ListScheduledHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/scheduled/{id}", s.GetScheduledHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/scheduled/{id}/cancel", s.CancelScheduledHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/digests/{id}", s.GetDigestHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/templates", s.ListTemplatesHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/templates", s.CreateTemplateHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/templates/{name}", s.GetTemplateHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/templates/{name}/versions", s.ListTemplateVersionsHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/templates/{name}/preview", s.PreviewTemplateHandler).Methods("POST")
 
 	port := ":8080"
 	s.Logger.Sugar().Infof("Listening port: %s", port)
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"notification_service/service"
+	"notification_service/types"
+
+	"github.com/gorilla/mux"
+)
+
+const maxTemplateNameLength = 255
+
+// templateNamePattern keeps template names usable as a path segment
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidateTemplate decodes and validates a template version. Its locale defaults to
+// service.DefaultLocale and its title, body and HTML body have to parse.
+func ValidateTemplate(body io.Reader) (types.Template, error) {
+	var tpl types.Template
+	if err := json.NewDecoder(body).Decode(&tpl); err != nil {
+		return types.Template{}, errors.New("invalid JSON format")
+	}
+
+	tpl.Name = strings.TrimSpace(tpl.Name)
+	if tpl.Name == "" || (tpl.Title == "" && tpl.Body == "" && tpl.HTMLBody == "") {
+		return types.Template{}, errors.New("missing required fields")
+	}
+	if err := validateTemplateName(tpl.Name); err != nil {
+		return types.Template{}, err
+	}
+	locale, err := normalizeLocale(tpl.Locale)
+	if err != nil {
+		return types.Template{}, err
+	}
+	tpl.Locale = locale
+
+	variables := make([]string, 0, len(tpl.Variables))
+	for _, v := range tpl.Variables {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return types.Template{}, errors.New("template variables cannot be empty")
+		}
+		if !slices.Contains(variables, v) {
+			variables = append(variables, v)
+		}
+	}
+	tpl.Variables = variables
+
+	if err := service.ParseTemplate(tpl); err != nil {
+		return types.Template{}, err
+	}
+	return tpl, nil
+}
+
+func validateTemplateName(name string) error {
+	if len(name) > maxTemplateNameLength {
+		return fmt.Errorf("template name exceeds %d characters", maxTemplateNameLength)
+	}
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name: %s, expected letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// normalizeLocale normalizes a requested locale, service.DefaultLocale when it is empty
+func normalizeLocale(raw string) (string, error) {
+	if raw == "" {
+		return service.DefaultLocale, nil
+	}
+	return service.NormalizeLocale(raw)
+}
+
+// normalizeTemplateRef validates the template a notification is rendered with. An empty
+// locale is left empty, so the template is looked up in service.DefaultLocale.
+func normalizeTemplateRef(ref *types.TemplateRef) error {
+	ref.Name = strings.TrimSpace(ref.Name)
+	if ref.Name == "" {
+		return errors.New("missing template name")
+	}
+	if err := validateTemplateName(ref.Name); err != nil {
+		return err
+	}
+	if ref.Locale != "" {
+		locale, err := service.NormalizeLocale(ref.Locale)
+		if err != nil {
+			return err
+		}
+		ref.Locale = locale
+	}
+	if ref.Version < 0 {
+		return errors.New("template version cannot be negative")
+	}
+	return nil
+}
+
+// templateErrorStatus is the status answering err, returned while rendering a template
+func templateErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrUnknownTemplate),
+		errors.Is(err, service.ErrMissingVariables),
+		errors.Is(err, service.ErrRenderTemplate):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// applyTemplate renders the template of in into its title and bodies, checking the
+// rendered title like a given one, and returns the status to answer with on error
+func (s *server) applyTemplate(ctx context.Context, in *types.InputInfo) (int, error) {
+	if err := s.Svc.ApplyTemplate(ctx, in); err != nil {
+		return templateErrorStatus(err), err
+	}
+	if len(in.Title) > maxTitleLength {
+		return http.StatusUnprocessableEntity, fmt.Errorf("rendered title exceeds %d characters", maxTitleLength)
+	}
+	return 0, nil
+}
+
+func (s *server) ListTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := s.Svc.DB.ListTemplates(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list templates: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, templates)
+}
+
+// CreateTemplateHandler saves a template as the next version of its name and locale
+func (s *server) CreateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	in, err := ValidateTemplate(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	out, err := s.Svc.CreateTemplate(r.Context(), in)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), err)
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, out)
+}
+
+// GetTemplateHandler returns a version of a template in exactly the requested locale,
+// the latest one unless the version query parameter is set
+func (s *server) GetTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	locale, err := normalizeLocale(q.Get("locale"))
+	if err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	version := 0
+	if raw := q.Get("version"); raw != "" {
+		version, err = strconv.Atoi(raw)
+		if err != nil || version < 1 {
+			s.writeError(w, http.StatusUnprocessableEntity, errors.New("version must be a positive integer"))
+			return
+		}
+	}
+
+	out, err := s.Svc.DB.GetTemplate(r.Context(), mux.Vars(r)["name"], locale, version)
+	if err != nil {
+		s.writeError(w, storeErrorStatus(err), fmt.Errorf("could not get template: %w", err))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
+
+// ListTemplateVersionsHandler returns every version of a template, in the locale query
+// parameter or in all of them
+func (s *server) ListTemplateVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	locale := r.URL.Query().Get("locale")
+	if locale != "" {
+		var err error
+		if locale, err = service.NormalizeLocale(locale); err != nil {
+			s.writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+
+	versions, err := s.Svc.DB.ListTemplateVersions(r.Context(), mux.Vars(r)["name"], locale)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, fmt.Errorf("could not list template versions: %w", err))
+		return
+	}
+	if len(versions) == 0 {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("could not list template versions: %w", service.ErrUnknownTemplate))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, versions)
+}
+
+// PreviewTemplateHandler renders a template with the variables of the request, picking
+// it like a notification would, without sending anything
+func (s *server) PreviewTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var ref types.TemplateRef
+	if err := json.NewDecoder(r.Body).Decode(&ref); err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, errors.New("invalid JSON format"))
+		return
+	}
+	ref.Name = mux.Vars(r)["name"]
+	if err := normalizeTemplateRef(&ref); err != nil {
+		s.writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	out, err := s.Svc.PreviewTemplate(r.Context(), ref)
+	if err != nil {
+		status := templateErrorStatus(err)
+		if errors.Is(err, service.ErrUnknownTemplate) {
+			status = http.StatusNotFound
+		}
+		s.writeError(w, status, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// MaxBatchLocks is how many rate limit locks a batch holds in one transaction. Every
+// advisory lock takes a slot of the shared lock table sized by max_locks_per_transaction,
+// so larger batches are split into several transactions.
+const MaxBatchLocks = 100
+
+// SendBatch accepts many notifications at once, each one evaluated as SendNotification
+// would, and reports the outcome of every item in the order of items: sent, rate limited,
+// rejected by the recipient preferences, deferred to the end of their quiet hours, added
+// to a digest or failed to route. The preferences and recipients of the whole batch are
+// loaded together. The items are then split into transactions holding the locks of at
+// most MaxBatchLocks recipients and types; each one reads the rate limit rules, history
+// and buckets of its items in one query each, and writes the sends, the buckets and all
+// the notifications, rate limited ones included, in one statement each. Only a database
+// error fails the batch, which keeps the transactions committed before it.
+func (s *NotificationService) SendBatch(ctx context.Context, items []t.InputInfo) ([]t.BatchResult, error) {
+	return s.sendBatch(ctx, s.DB, items)
+}
+
+// sendBatch is SendBatch through db, which may be a locked connector
+func (s *NotificationService) sendBatch(ctx context.Context, db d.Database, items []t.InputInfo) ([]t.BatchResult, error) {
+	cache, err := s.prefetch(ctx, db, items)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]t.BatchResult, len(items))
+	messages := make([]t.OutboxMessage, len(items))
+	pending := []int{}
+	deferred := map[int]*QuietHoursError{}
+	for i, in := range items {
+		results[i] = t.BatchResult{Index: i, Recipient: in.Recipient}
+		o, err := s.prepare(ctx, cache, in)
+		var quietErr *QuietHoursError
+		if errors.As(err, &quietErr) {
+			deferred[i] = quietErr
+			continue
+		}
+		if err != nil {
+			results[i].Status, results[i].Error = t.BatchFailed, err.Error()
+			if errors.Is(err, ErrOptedOut) {
+				results[i].Status = t.BatchRejected
+			}
+			continue
+		}
+		messages[i] = o
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 && len(deferred) == 0 {
+		return results, nil
+	}
+
+	chunks := splitByLocks(items, pending)
+	if len(chunks) == 0 {
+		chunks = [][]int{nil}
+	}
+	for c, chunk := range chunks {
+		keys := make([]string, len(chunk))
+		for j, i := range chunk {
+			keys[j] = rateLimitKey(items[i])
+		}
+		err := db.WithLocks(ctx, keys, func(db d.Database) error {
+			if c == 0 {
+				for i, quietErr := range deferred {
+					sn, err := s.deferQuiet(ctx, db, items[i], quietErr)
+					if err != nil {
+						return err
+					}
+					sendAt := sn.SendAt.UTC()
+					results[i].Status, results[i].ID, results[i].SendAt = t.BatchDeferred, sn.ID, &sendAt
+				}
+			}
+			if len(chunk) == 0 {
+				return nil
+			}
+			return s.queueBatch(ctx, cache.with(db), items, chunk, messages, results)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.Logger.Info("notification batch is queued", zap.Int("items", len(items)), zap.Int("evaluated", len(pending)),
+		zap.Int("deferred", len(deferred)), zap.Int("transactions", len(chunks)))
+	return results, nil
+}
+
+// splitByLocks groups the pending items into chunks of at most MaxBatchLocks rate limit
+// keys. The items of a key stay in one chunk, in order, so they consume its quota one
+// after the other.
+func splitByLocks(items []t.InputInfo, pending []int) [][]int {
+	chunks := [][]int{}
+	chunkOf := map[string]int{}
+	keys := 0
+	for _, i := range pending {
+		key := rateLimitKey(items[i])
+		c, ok := chunkOf[key]
+		if !ok {
+			if len(chunks) == 0 || keys == MaxBatchLocks {
+				chunks, keys = append(chunks, nil), 0
+			}
+			c, keys = len(chunks)-1, keys+1
+			chunkOf[key] = c
+		}
+		chunks[c] = append(chunks[c], i)
+	}
+	return chunks
+}
+
+// queueBatch evaluates the rate limits of the chunk items, already prepared into messages,
+// and inserts their notifications. It must run under the rate limit locks of the chunk.
+func (s *NotificationService) queueBatch(ctx context.Context, db d.Database, items []t.InputInfo, chunk []int,
+	messages []t.OutboxMessage, results []t.BatchResult) error {
+	limits, err := loadLimits(ctx, db, items, chunk)
+	if err != nil {
+		return err
+	}
+
+	batch := make([]t.OutboxMessage, 0, len(chunk))
+	queued := make([]int, 0, len(chunk))
+	for _, i := range chunk {
+		o := messages[i]
+		o.Status = t.Queued
+		var rateLimitErr *RateLimitError
+		if err := s.checkAndRecord(ctx, limits, items[i]); errors.As(err, &rateLimitErr) {
+			dg, ok, digestErr := s.digest(ctx, limits, items[i], rateLimitErr)
+			if digestErr != nil {
+				return digestErr
+			}
+			if ok {
+				deliverAt := dg.DeliverAt.UTC()
+				results[i].Status, results[i].ID, results[i].SendAt = t.BatchDigested, dg.ID, &deliverAt
+				continue
+			}
+			o.Status, o.LastError = t.RateLimited, err.Error()
+			results[i].Rule = &rateLimitErr.Decision.Rule
+			results[i].ResetAt = &rateLimitErr.Decision.ResetAt
+		} else if err != nil {
+			return err
+		}
+		batch = append(batch, o)
+		queued = append(queued, i)
+	}
+	if err := limits.flush(ctx); err != nil {
+		return fmt.Errorf("could not update rate limit state: %w", err)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	inserted, err := db.InsertNotifications(ctx, batch)
+	if err != nil {
+		return fmt.Errorf("could not enqueue notifications: %w", err)
+	}
+	for j, i := range queued {
+		results[i].ID, results[i].Channel = inserted[j].ID, inserted[j].Channel
+		results[i].Status = t.BatchSent
+		if inserted[j].Status == t.RateLimited {
+			results[i].Status, results[i].Error = t.BatchRateLimited, inserted[j].LastError
+		}
+	}
+	return nil
+}
+
+// loadLimits reads the rate limit rules, the sends still in their windows and the token
+// buckets of the recipients and types of the chunk items, so that evaluating them does
+// not query them item by item
+func loadLimits(ctx context.Context, db d.Database, items []t.InputInfo, chunk []int) (*limitCache, error) {
+	now := time.Now().UTC()
+	keys := []t.LimitKey{}
+	seen := map[t.LimitKey]bool{}
+	for _, i := range chunk {
+		key := t.LimitKey{Recipient: items[i].Recipient, NotificationType: items[i].NotificationGroup}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	rules, err := db.GetRateLimitRulesOf(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch rate limit rules: %w", err)
+	}
+	c := &limitCache{
+		Database: db,
+		rules:    rules,
+		sent:     make(map[t.LimitKey][]time.Time, len(keys)),
+		buckets:  map[bucketKey]t.Bucket{},
+	}
+	var window time.Duration
+	ruleIDs, recipients := []string{}, []string{}
+	for _, key := range keys {
+		for _, rule := range rules[key] {
+			window = max(window, RuleWindow(rule))
+			if rule.Strategy == t.TokenBucket {
+				ruleIDs, recipients = append(ruleIDs, rule.ID), append(recipients, key.Recipient)
+			}
+		}
+	}
+	if len(rules) > 0 {
+		// the windows of the items evaluated later start later, so they are all covered
+		sent, err := db.GetNotificationsSinceOf(ctx, keys, now.Add(-window))
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch notifications: %w", err)
+		}
+		for _, n := range sent {
+			key := t.LimitKey{Recipient: n.Recipient, NotificationType: n.NotificationType}
+			c.sent[key] = append(c.sent[key], n.CreatedAt)
+		}
+	}
+	if len(ruleIDs) > 0 {
+		buckets, err := db.GetBucketsOf(ctx, ruleIDs, recipients)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch token buckets: %w", err)
+		}
+		for _, b := range buckets {
+			c.buckets[bucketKey{b.RuleID, b.Recipient}] = b
+		}
+	}
+	return c, nil
+}
+
+// limitCache answers the rate limit reads of a batch from what loadLimits fetched and
+// keeps the sends and buckets recorded meanwhile, which flush writes
+type limitCache struct {
+	d.Database
+	rules    map[t.LimitKey][]t.RateLimitRule
+	sent     map[t.LimitKey][]time.Time
+	buckets  map[bucketKey]t.Bucket
+	recorded []t.SentNotification
+	saved    []bucketKey
+}
+
+type bucketKey struct {
+	ruleID, recipient string
+}
+
+func (c *limitCache) GetRateLimitRules(_ context.Context, nType t.NotificationType, recipient string) ([]t.RateLimitRule, error) {
+	return c.rules[t.LimitKey{Recipient: recipient, NotificationType: nType}], nil
+}
+
+func (c *limitCache) GetNotificationsSince(_ context.Context, current t.InputInfo, since time.Time) ([]time.Time, error) {
+	sent := []time.Time{}
+	for _, at := range c.sent[t.LimitKey{Recipient: current.Recipient, NotificationType: current.NotificationGroup}] {
+		if at.After(since) {
+			sent = append(sent, at)
+		}
+	}
+	return sent, nil
+}
+
+func (c *limitCache) RecordNotification(_ context.Context, input *t.InputInfo, sentAt time.Time) error {
+	key := t.LimitKey{Recipient: input.Recipient, NotificationType: input.NotificationGroup}
+	c.sent[key] = append(c.sent[key], sentAt)
+	c.recorded = append(c.recorded, t.SentNotification{Recipient: input.Recipient, NotificationType: input.NotificationGroup, CreatedAt: sentAt})
+	return nil
+}
+
+func (c *limitCache) GetBucket(_ context.Context, ruleID, recipient string) (t.Bucket, error) {
+	b, ok := c.buckets[bucketKey{ruleID, recipient}]
+	if !ok {
+		return t.Bucket{}, d.ErrNotFound
+	}
+	return b, nil
+}
+
+func (c *limitCache) SaveBucket(_ context.Context, b t.Bucket) error {
+	key := bucketKey{b.RuleID, b.Recipient}
+	if !slices.Contains(c.saved, key) {
+		c.saved = append(c.saved, key)
+	}
+	c.buckets[key] = b
+	return nil
+}
+
+// flush writes the sends and the buckets recorded since loadLimits
+func (c *limitCache) flush(ctx context.Context) error {
+	if err := c.Database.RecordNotifications(ctx, c.recorded); err != nil {
+		return err
+	}
+	buckets := make([]t.Bucket, len(c.saved))
+	for i, key := range c.saved {
+		buckets[i] = c.buckets[key]
+	}
+	return c.Database.SaveBuckets(ctx, buckets)
+}
+
+// prefetch loads the preferences and registrations of the recipients of items, so that
+// preparing the batch does not query them one by one
+func (s *NotificationService) prefetch(ctx context.Context, db d.Database, items []t.InputInfo) (*prefetched, error) {
+	ids := make([]string, 0, len(items))
+	seen := make(map[string]bool, len(items))
+	for _, in := range items {
+		if !seen[in.Recipient] {
+			seen[in.Recipient] = true
+			ids = append(ids, in.Recipient)
+		}
+	}
+
+	prefs, err := db.ListPreferencesOf(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch preferences: %w", err)
+	}
+	recipients, err := db.GetRecipients(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch recipients: %w", err)
+	}
+
+	p := &prefetched{
+		Database:   db,
+		prefs:      make(map[string]t.Preference, len(prefs)),
+		recipients: make(map[string]t.Recipient, len(recipients)),
+	}
+	for _, pref := range prefs {
+		p.prefs[pref.Recipient+"\x00"+string(pref.NotificationType)] = pref
+	}
+	for _, r := range recipients {
+		p.recipients[r.ID] = r
+	}
+	return p, nil
+}
+
+// prefetched answers preference and recipient lookups from what prefetch loaded
+type prefetched struct {
+	d.Database
+	prefs      map[string]t.Preference
+	recipients map[string]t.Recipient
+}
+
+// with returns p answering everything else through db
+func (p *prefetched) with(db d.Database) *prefetched {
+	return &prefetched{Database: db, prefs: p.prefs, recipients: p.recipients}
+}
+
+func (p *prefetched) GetPreference(_ context.Context, recipient string, nType t.NotificationType) (t.Preference, error) {
+	pref, ok := p.prefs[recipient+"\x00"+string(nType)]
+	if !ok {
+		return t.Preference{}, d.ErrNotFound
+	}
+	return pref, nil
+}
+
+func (p *prefetched) GetRecipient(_ context.Context, id string) (t.Recipient, error) {
+	r, ok := p.recipients[id]
+	if !ok {
+		return t.Recipient{}, d.ErrNotFound
+	}
+	return r, nil
+}
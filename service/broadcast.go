@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// DefaultBroadcastPageSize is how many members of a segment a broadcast sends to at once.
+// A page is sent in the transaction that saves the progress, holding the rate limit lock
+// of every member, so it is at most MaxBatchLocks.
+const DefaultBroadcastPageSize = MaxBatchLocks
+
+// Broadcast starts sending in to every member of the segment; in has no recipient. The
+// fan-out happens in the background, the returned broadcast reports its progress.
+func (s *NotificationService) Broadcast(ctx context.Context, segmentID string, in t.InputInfo) (t.Broadcast, error) {
+	b, err := s.DB.CreateBroadcast(ctx, t.Broadcast{SegmentID: segmentID, Payload: in})
+	if err != nil {
+		return t.Broadcast{}, fmt.Errorf("could not start broadcast: %w", err)
+	}
+	s.Logger.Info("broadcast is started",
+		zap.String("id", b.ID),
+		zap.String("segment_id", segmentID),
+		zap.String("type", string(in.NotificationGroup)),
+		zap.Int("total", b.Total),
+	)
+	return b, nil
+}
+
+// AdvanceBroadcast claims a running broadcast and sends it to its next page of members,
+// each of them going through the preferences and rate limits as in SendBatch. The page
+// and the progress of the broadcast are committed together, so a page interrupted by a
+// restart is sent again as a whole and never twice. It reports whether there was a
+// broadcast to advance.
+func (s *NotificationService) AdvanceBroadcast(ctx context.Context, lease time.Duration) (bool, error) {
+	claimed, err := s.DB.ClaimBroadcast(ctx, lease)
+	if errors.Is(err, d.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = s.DB.WithLock(ctx, "broadcast:"+claimed.ID, func(db d.Database) error {
+		b, err := db.GetBroadcast(ctx, claimed.ID)
+		if err != nil || b.Status != t.BroadcastRunning {
+			return err
+		}
+		members, err := db.ListSegmentMembers(ctx, b.SegmentID, b.LastRecipient, s.broadcastPageSize())
+		if err != nil {
+			return fmt.Errorf("could not list members of segment %s: %w", b.SegmentID, err)
+		}
+
+		if len(members) > 0 {
+			items := make([]t.InputInfo, len(members))
+			for i, recipient := range members {
+				items[i] = b.Payload
+				items[i].Recipient = recipient
+			}
+			results, err := s.sendBatch(ctx, db, items)
+			if err != nil {
+				return err
+			}
+			summary := maps.Clone(b.Summary)
+			if summary == nil {
+				summary = t.BatchSummary{}
+			}
+			for _, res := range results {
+				summary[res.Status]++
+			}
+			b.Summary = summary
+			b.Processed += len(members)
+			b.LastRecipient = members[len(members)-1]
+		}
+		if len(members) < s.broadcastPageSize() {
+			now := time.Now().UTC()
+			b.Status, b.CompletedAt = t.BroadcastCompleted, &now
+		}
+		// members added after the broadcast started are sent to as well
+		b.Total = max(b.Total, b.Processed)
+		if err := db.SaveBroadcastProgress(ctx, b); err != nil {
+			return fmt.Errorf("could not save broadcast progress: %w", err)
+		}
+		s.Logger.Info("broadcast page is sent",
+			zap.String("id", b.ID),
+			zap.Int("members", len(members)),
+			zap.Int("processed", b.Processed),
+			zap.Int("total", b.Total),
+			zap.String("status", string(b.Status)),
+		)
+		return nil
+	})
+	return true, err
+}
+
+func (s *NotificationService) broadcastPageSize() int {
+	if s.BroadcastPageSize > 0 {
+		return s.BroadcastPageSize
+	}
+	return DefaultBroadcastPageSize
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	t "notification_service/types"
+)
+
+// Sender delivers a message through a single channel
+type Sender interface {
+	Channel() t.Channel
+	Send(ctx context.Context, msg t.Message) (t.Receipt, error)
+}
+
+// Registry keeps the senders available to the service, keyed by channel.
+// Requests that do not ask for a channel are routed to the default one.
+type Registry struct {
+	mu             sync.RWMutex
+	senders        map[t.Channel]Sender
+	defaultChannel t.Channel
+}
+
+func NewRegistry(defaultChannel t.Channel, senders ...Sender) *Registry {
+	r := &Registry{
+		senders:        make(map[t.Channel]Sender),
+		defaultChannel: defaultChannel,
+	}
+	for _, s := range senders {
+		r.Register(s)
+	}
+	return r
+}
+
+// Register adds a sender, replacing any previous sender for the same channel
+func (r *Registry) Register(s Sender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.senders[s.Channel()] = s
+}
+
+// Sender returns the sender for the given channel, or the default one when channel is empty
+func (r *Registry) Sender(channel t.Channel) (Sender, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if channel == "" {
+		channel = r.defaultChannel
+	}
+	s, ok := r.senders[channel]
+	if !ok {
+		return nil, fmt.Errorf("no sender registered for channel %q", channel)
+	}
+	return s, nil
+}
+
+// Channels lists the registered channels in a stable order
+func (r *Registry) Channels() []t.Channel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	channels := make([]t.Channel, 0, len(r.senders))
+	for c := range r.senders {
+		channels = append(channels, c)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i] < channels[j] })
+	return channels
+}
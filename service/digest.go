@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// DigestPolicy puts the rate limited notifications of a type in a digest of their recipient
+// instead of dropping them. The digest is sent as one summary at the "HH:MM" time At, in
+// the time zone of the recipient, or when At is empty, once the rate limit that rejected
+// its first notification resets.
+type DigestPolicy struct {
+	At string
+}
+
+// digestAt returns when the digest a notification rejected by rateLimitErr starts is due
+func (p DigestPolicy) digestAt(ctx context.Context, db d.Database, in t.InputInfo, rateLimitErr *RateLimitError) (time.Time, error) {
+	if p.At == "" {
+		return rateLimitErr.Decision.ResetAt, nil
+	}
+	loc := time.UTC
+	r, err := db.GetRecipient(ctx, in.Recipient)
+	switch {
+	case err == nil:
+		loc = r.Location()
+	case !errors.Is(err, d.ErrNotFound):
+		return time.Time{}, fmt.Errorf("could not fetch recipient: %w", err)
+	}
+	return NextClock(p.At, time.Now().In(loc))
+}
+
+// digest adds in, rejected by rateLimitErr, to the digest of its recipient when its type
+// is in digest mode; ok is false otherwise. It must run under the rate limit lock of in,
+// which DeliverDigest takes too, so no notification joins a digest being delivered.
+func (s *NotificationService) digest(ctx context.Context, db d.Database, in t.InputInfo, rateLimitErr *RateLimitError) (dg t.Digest, ok bool, err error) {
+	policy, ok := s.Digests[in.NotificationGroup]
+	if !ok {
+		return t.Digest{}, false, nil
+	}
+	at, err := policy.digestAt(ctx, db, in, rateLimitErr)
+	if err != nil {
+		return t.Digest{}, true, err
+	}
+	dg, err = db.AddToDigest(ctx, t.Digest{
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Items:             t.DigestItems{in},
+		DeliverAt:         at,
+	})
+	if err != nil {
+		return t.Digest{}, true, fmt.Errorf("could not add notification to digest: %w", err)
+	}
+	s.Logger.Info("rate limited notification is added to digest",
+		zap.String("digest", dg.ID),
+		zap.String("recipient", in.Recipient),
+		zap.String("type", string(in.NotificationGroup)),
+		zap.Int("items", dg.ItemCount),
+	)
+	return dg, true, nil
+}
+
+// digestOutput answers a notify request for in, added to dg
+func digestOutput(dg t.Digest, in t.InputInfo) t.Output {
+	deliverAt := dg.DeliverAt.UTC()
+	return t.Output{
+		ID:                dg.ID,
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Channel:           in.Channel,
+		MessageID:         in.MessageID,
+		TimeStamp:         time.Now(),
+		SendAt:            &deliverAt,
+		Message:           "Notification rate limited and added to the digest",
+	}
+}
+
+// DigestSummary combines the notifications of dg into the one message that is sent: a
+// line per notification in the body, and every notification under "digest" in the data.
+// It goes to the channel the first notification asked for.
+func DigestSummary(dg t.Digest) t.InputInfo {
+	lines := make([]string, 0, len(dg.Items))
+	items := make([]any, 0, len(dg.Items))
+	for _, item := range dg.Items {
+		line := item.Title
+		switch {
+		case line == "":
+			line = item.Body
+		case item.Body != "":
+			line += ": " + item.Body
+		}
+		if line != "" {
+			lines = append(lines, "- "+line)
+		}
+		items = append(items, map[string]any{
+			"message_id": item.MessageID,
+			"title":      item.Title,
+			"body":       item.Body,
+			"data":       item.Data,
+		})
+	}
+
+	summary := t.InputInfo{
+		Recipient:         dg.Recipient,
+		NotificationGroup: dg.NotificationGroup,
+		Title:             fmt.Sprintf("%d %s notifications", len(dg.Items), strings.ToLower(string(dg.NotificationGroup))),
+		Body:              strings.Join(lines, "\n"),
+		Data:              map[string]any{"digest": items},
+	}
+	if len(dg.Items) > 0 {
+		summary.Channel = dg.Items[0].Channel
+	}
+	return summary
+}
+
+// DeliverDigest claims a due digest and queues its summary for delivery. The summary is
+// not rate limited, its notifications already were, but the preferences still apply: it
+// is deferred to the end of the quiet hours of the recipient and dropped when the
+// recipient opted out. It reports whether a digest was due.
+func (s *NotificationService) DeliverDigest(ctx context.Context, lease time.Duration) (bool, error) {
+	claimed, err := s.DB.ClaimDigest(ctx, lease)
+	if errors.Is(err, d.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	key := rateLimitKey(t.InputInfo{Recipient: claimed.Recipient, NotificationGroup: claimed.NotificationGroup})
+	err = s.DB.WithLock(ctx, key, func(db d.Database) error {
+		dg, err := db.GetDigest(ctx, claimed.ID)
+		if err != nil || dg.Status != t.DigestPending {
+			return err
+		}
+
+		// the summary stands in for notifications the rate limit already counted, so it is
+		// not counted again: prepare checks the preferences without touching the limit
+		o, err := s.prepare(ctx, db, DigestSummary(dg))
+		var quietErr *QuietHoursError
+		switch {
+		case errors.As(err, &quietErr):
+			if err := db.DeferDigest(ctx, dg.ID, quietErr.Until); err != nil {
+				return fmt.Errorf("could not defer digest: %w", err)
+			}
+			return nil
+		case err != nil:
+			dg.Status, dg.Error = t.DigestDropped, err.Error()
+		default:
+			queued, err := db.EnqueueNotification(ctx, o)
+			if err != nil {
+				return fmt.Errorf("could not enqueue digest: %w", err)
+			}
+			dg.Status, dg.NotificationID = t.DigestSent, queued.ID
+		}
+		if err := db.CloseDigest(ctx, dg); err != nil {
+			return fmt.Errorf("could not close digest: %w", err)
+		}
+		s.Logger.Info("digest is delivered",
+			zap.String("id", dg.ID),
+			zap.String("status", string(dg.Status)),
+			zap.String("notification_id", dg.NotificationID),
+			zap.Int("items", dg.ItemCount),
+		)
+		return nil
+	})
+	return true, err
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+const defaultSMTPTimeout = 10 * time.Second
+
+// EmailSender delivers messages over SMTP. The message address is the
+// destination mailbox; an HTML alternative is included when the message has one.
+type EmailSender struct {
+	Config t.SMTPConfig
+	Logger *zap.Logger
+}
+
+func NewEmailSender(config t.SMTPConfig, logger *zap.Logger) *EmailSender {
+	if config.Timeout == 0 {
+		config.Timeout = defaultSMTPTimeout
+	}
+	if config.TLSMode == "" {
+		config.TLSMode = t.SMTPTLSStartTLS
+	}
+	return &EmailSender{Config: config, Logger: logger}
+}
+
+func (s *EmailSender) Channel() t.Channel {
+	return t.Email
+}
+
+func (s *EmailSender) Send(ctx context.Context, msg t.Message) (t.Receipt, error) {
+	to, err := mail.ParseAddress(msg.Address)
+	if err != nil {
+		return t.Receipt{}, Permanent(fmt.Errorf("invalid email address %q: %w", msg.Address, err))
+	}
+	from, err := mail.ParseAddress(s.Config.From)
+	if err != nil {
+		return t.Receipt{}, Permanent(fmt.Errorf("invalid sender address %q: %w", s.Config.From, err))
+	}
+
+	messageID, err := newMessageID(s.Config.Host)
+	if err != nil {
+		return t.Receipt{}, err
+	}
+	data, err := buildEmail(from, to, messageID, msg)
+	if err != nil {
+		return t.Receipt{}, Permanent(fmt.Errorf("could not build email: %w", err))
+	}
+
+	client, err := s.dial(ctx)
+	if err != nil {
+		return t.Receipt{}, err
+	}
+	defer client.Close()
+
+	if err := s.deliver(client, from.Address, to.Address, data); err != nil {
+		return t.Receipt{}, err
+	}
+
+	s.Logger.Info("Email sent",
+		zap.String("recipient", msg.Recipient),
+		zap.String("message_id", messageID),
+	)
+	return t.Receipt{Channel: t.Email, Reference: messageID}, nil
+}
+
+// dial opens the SMTP session, upgrading it to TLS as configured
+func (s *EmailSender) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.Config.Host, strconv.Itoa(s.Config.Port))
+	tlsConfig := &tls.Config{
+		ServerName:         s.Config.Host,
+		InsecureSkipVerify: s.Config.InsecureSkipVerify, //nolint:gosec // opt-in for self-signed relays
+	}
+
+	deadline := time.Now().Add(s.Config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Deadline: deadline}
+	if s.Config.TLSMode == t.SMTPTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to SMTP server %s: %w", addr, err)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set SMTP deadline: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, s.Config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not start SMTP session: %w", err)
+	}
+
+	if s.Config.TLSMode == t.SMTPTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, fmt.Errorf("SMTP server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("could not start TLS: %w", err)
+		}
+	}
+
+	if s.Config.Username != "" {
+		auth := smtp.PlainAuth("", s.Config.Username, s.Config.Password, s.Config.Host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("could not authenticate with SMTP server: %w", err)
+		}
+	}
+	return client, nil
+}
+
+func (s *EmailSender) deliver(client *smtp.Client, from, to string, data []byte) error {
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM rejected: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("SMTP RCPT TO rejected: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA rejected: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("could not write email body: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected email: %w", err)
+	}
+	return client.Quit()
+}
+
+// buildEmail renders msg as a MIME message, multipart/alternative when it has an HTML body
+func buildEmail(from, to *mail.Address, messageID string, msg t.Message) ([]byte, error) {
+	subject := msg.Title
+	if subject == "" {
+		subject = fmt.Sprintf("New %s notification", msg.Group)
+	}
+	text := msg.Body
+	if text == "" {
+		text = msg.Text()
+	}
+
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	header.Set("To", to.String())
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header.Set("Date", time.Now().UTC().Format(time.RFC1123Z))
+	header.Set("Message-ID", messageID)
+	header.Set("MIME-Version", "1.0")
+	if msg.UnsubscribeURL != "" {
+		header.Set("List-Unsubscribe", "<"+msg.UnsubscribeURL+">")
+		header.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+
+	if msg.HTMLBody == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buf, header)
+		if err := writeQuotedPrintable(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", msg.HTMLBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	writeHeader(&buf, header)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "List-Unsubscribe", "List-Unsubscribe-Post", "Content-Type", "Content-Transfer-Encoding"} {
+		if v := header.Get(key); v != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, v)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func newMessageID(host string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate message ID: %w", err)
+	}
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), host), nil
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	t "notification_service/types"
+)
+
+// RateLimitError is returned when a rate limit rule rejects a notification
+type RateLimitError struct {
+	Recipient string
+	Decision  t.RateLimitDecision
+	// NotificationID identifies the rejected notification once it is recorded
+	NotificationID string
+}
+
+func (e *RateLimitError) Error() string {
+	r := e.Decision.Rule
+	return fmt.Sprintf("rate limit exceeded for recipient %s: rule %s allows %d %s per %s",
+		e.Recipient, r.ID, r.MaxCount, r.NotificationType, RuleWindow(r))
+}
+
+// RetryAfter returns how long the caller has to wait before the notification can be
+// allowed, rounded up to whole seconds and never less than one
+func (e *RateLimitError) RetryAfter(now time.Time) time.Duration {
+	seconds := math.Ceil(e.Decision.ResetAt.Sub(now).Seconds())
+	return time.Duration(max(seconds, 1)) * time.Second
+}
+
+// QuietHoursError is returned when a notification falls in the quiet hours of its
+// recipient; Until is when the window ends. It matches ErrQuietHours.
+type QuietHoursError struct {
+	Recipient string
+	Until     time.Time
+}
+
+func (e *QuietHoursError) Error() string {
+	return fmt.Sprintf("recipient %s is in quiet hours for this notification type until %s",
+		e.Recipient, e.Until.Format(time.RFC3339))
+}
+
+func (e *QuietHoursError) Is(target error) bool {
+	return target == ErrQuietHours
+}
+
+// DeliveryError is returned when a channel fails to deliver an accepted notification
+type DeliveryError struct {
+	Channel t.Channel
+	Err     error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("could not send %s message: %v", e.Channel, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
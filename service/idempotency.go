@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+var (
+	ErrIdempotencyConflict = errors.New("idempotency key was already used with a different request")
+	// errNotKept rolls back a request answered with a server error
+	errNotKept = errors.New("server errors are not kept")
+)
+
+// RequestHash identifies the payload of a request sent with an idempotency key
+func RequestHash(payload any) (string, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("could not encode request: %w", err)
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Once produces the response to a request sent with an idempotency key. The first request
+// with key runs fn and its response is kept for IdempotencyTTL; later requests with the
+// same key and hash get that response back, reported as replayed, and requests reusing the
+// key for another payload fail with ErrIdempotencyConflict. Requests with the same key are
+// serialized, so a retry arriving while the first request runs waits for its response.
+//
+// fn runs in the transaction holding the lock of key and must write through the given
+// Database, so what it does is committed along with its response: a request whose key
+// cannot be saved fails as a whole and its retry runs it once. Server errors roll back
+// what fn wrote and are not kept, the request can be retried with the same key.
+func (s *NotificationService) Once(ctx context.Context, key, hash string, fn func(db d.Database) t.StoredResponse) (t.StoredResponse, bool, error) {
+	var res t.StoredResponse
+	replayed := false
+	err := s.DB.WithLock(ctx, "idempotency:"+key, func(db d.Database) error {
+		stored, err := db.GetIdempotencyKey(ctx, key)
+		switch {
+		case err == nil:
+			if stored.RequestHash != hash {
+				return ErrIdempotencyConflict
+			}
+			res, replayed = stored.Response, true
+			return nil
+		case !errors.Is(err, d.ErrNotFound):
+			return fmt.Errorf("could not get idempotency key: %w", err)
+		}
+
+		res = fn(db)
+		if res.StatusCode >= 500 {
+			return errNotKept
+		}
+		ttl := s.IdempotencyTTL
+		if ttl == 0 {
+			ttl = DefaultIdempotencyTTL
+		}
+		now := time.Now().UTC()
+		k := t.IdempotencyKey{Key: key, RequestHash: hash, Response: res, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+		if err := db.SaveIdempotencyKey(ctx, k); err != nil {
+			return fmt.Errorf("could not save idempotency key: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, errNotKept) {
+		s.Logger.Warn("server error is not kept for idempotency key",
+			zap.String("key", key),
+			zap.Int("status", res.StatusCode),
+		)
+		return res, false, nil
+	}
+	return res, replayed, err
+}
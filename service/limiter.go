@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+)
+
+// LimitStore is the persistence the limiters read and update
+type LimitStore interface {
+	GetNotificationsSince(ctx context.Context, current t.InputInfo, since time.Time) ([]time.Time, error)
+	GetBucket(ctx context.Context, ruleID, recipient string) (t.Bucket, error)
+	SaveBucket(ctx context.Context, b t.Bucket) error
+}
+
+// Limiter enforces one rate limit strategy. Evaluate never changes state, so it can
+// be used to answer "would this be allowed"; Consume records an accepted send
+// against the rule. Window strategies count the notifications log, which the
+// service appends to once per send, so their Consume is a no-op.
+type Limiter interface {
+	Evaluate(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) (t.RateLimitDecision, error)
+	Consume(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) error
+}
+
+var limiters = map[t.LimiterStrategy]Limiter{
+	t.FixedWindow:   fixedWindowLimiter{},
+	t.SlidingWindow: slidingWindowLimiter{},
+	t.TokenBucket:   tokenBucketLimiter{},
+}
+
+// LimiterFor returns the limiter of a strategy; rules without one use a sliding window
+func LimiterFor(strategy t.LimiterStrategy) (Limiter, error) {
+	if strategy == "" {
+		strategy = t.SlidingWindow
+	}
+	l, ok := limiters[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limit strategy %q", strategy)
+	}
+	return l, nil
+}
+
+type slidingWindowLimiter struct{}
+
+func (slidingWindowLimiter) Evaluate(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) (t.RateLimitDecision, error) {
+	sent, err := store.GetNotificationsSince(ctx, in, now.Add(-RuleWindow(rule)))
+	if err != nil {
+		return t.RateLimitDecision{}, err
+	}
+	return EvaluateSlidingWindow(rule, sent, now), nil
+}
+
+func (slidingWindowLimiter) Consume(context.Context, LimitStore, t.RateLimitRule, t.InputInfo, time.Time) error {
+	return nil
+}
+
+type fixedWindowLimiter struct{}
+
+func (fixedWindowLimiter) Evaluate(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) (t.RateLimitDecision, error) {
+	// the query bound is exclusive, step back so sends at the window start are counted
+	sent, err := store.GetNotificationsSince(ctx, in, FixedWindowStart(rule, now).Add(-time.Nanosecond))
+	if err != nil {
+		return t.RateLimitDecision{}, err
+	}
+	return EvaluateFixedWindow(rule, sent, now), nil
+}
+
+func (fixedWindowLimiter) Consume(context.Context, LimitStore, t.RateLimitRule, t.InputInfo, time.Time) error {
+	return nil
+}
+
+type tokenBucketLimiter struct{}
+
+func (tokenBucketLimiter) Evaluate(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) (t.RateLimitDecision, error) {
+	b, err := loadBucket(ctx, store, rule, in, now)
+	if err != nil {
+		return t.RateLimitDecision{}, err
+	}
+	decision, _ := EvaluateTokenBucket(rule, b, now)
+	return decision, nil
+}
+
+func (tokenBucketLimiter) Consume(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) error {
+	b, err := loadBucket(ctx, store, rule, in, now)
+	if err != nil {
+		return err
+	}
+	_, b = EvaluateTokenBucket(rule, b, now)
+	// critical sends bypassing an empty bucket do not overdraw it, otherwise it would stay
+	// empty long after they stop
+	b.Tokens = max(b.Tokens-1, 0)
+	return store.SaveBucket(ctx, b)
+}
+
+// loadBucket returns the stored bucket, or a full one for a recipient never seen
+func loadBucket(ctx context.Context, store LimitStore, rule t.RateLimitRule, in t.InputInfo, now time.Time) (t.Bucket, error) {
+	b, err := store.GetBucket(ctx, rule.ID, in.Recipient)
+	if errors.Is(err, d.ErrNotFound) {
+		capacity, _ := BucketParams(rule)
+		return t.Bucket{RuleID: rule.ID, Recipient: in.Recipient, Tokens: capacity, UpdatedAt: now}, nil
+	}
+	return b, err
+}
+
+// RuleWindow returns the length of the rule window
+func RuleWindow(rule t.RateLimitRule) time.Duration {
+	return time.Duration(rule.Duration * float64(time.Second))
+}
+
+// EvaluateSlidingWindow applies rule to the send times of a recipient (sliding log).
+//
+// The window is the half open interval (now-window, now]: a notification sent exactly
+// one window ago no longer counts. A new notification is allowed while fewer than
+// MaxCount notifications were sent inside the window. When it is not allowed, ResetAt
+// is the first instant at which enough sends have left the window to allow one more;
+// when it is, ResetAt is when the oldest counted send leaves the window (or now if
+// there is none).
+func EvaluateSlidingWindow(rule t.RateLimitRule, sent []time.Time, now time.Time) t.RateLimitDecision {
+	window := RuleWindow(rule)
+	since := now.Add(-window)
+
+	inWindow := make([]time.Time, 0, len(sent))
+	for _, at := range sent {
+		if at.After(since) && !at.After(now) {
+			inWindow = append(inWindow, at)
+		}
+	}
+	sort.Slice(inWindow, func(i, j int) bool { return inWindow[i].Before(inWindow[j]) })
+
+	decision := t.RateLimitDecision{
+		Allowed:   len(inWindow) < rule.MaxCount,
+		Rule:      rule,
+		Limit:     rule.MaxCount,
+		Remaining: rule.MaxCount - len(inWindow),
+		ResetAt:   now,
+	}
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+
+	switch {
+	case !decision.Allowed && rule.MaxCount <= 0:
+		// nothing is ever allowed: report the end of the current window
+		decision.ResetAt = now.Add(window)
+	case !decision.Allowed:
+		// the send that has to expire so only MaxCount-1 remain in the window
+		decision.ResetAt = inWindow[len(inWindow)-rule.MaxCount].Add(window)
+	case len(inWindow) > 0:
+		decision.ResetAt = inWindow[0].Add(window)
+	}
+	return decision
+}
+
+// FixedWindowStart returns the start of the fixed window containing now. Windows are
+// aligned to the Unix epoch so every recipient shares the same boundaries.
+func FixedWindowStart(rule t.RateLimitRule, now time.Time) time.Time {
+	window := RuleWindow(rule)
+	if window <= 0 {
+		return now
+	}
+	return time.Unix(0, now.UnixNano()-now.UnixNano()%int64(window)).In(now.Location())
+}
+
+// EvaluateFixedWindow applies rule counting the sends in the fixed window [start, start+window)
+// that contains now. The quota is fully restored at the end of the window, which is ResetAt.
+func EvaluateFixedWindow(rule t.RateLimitRule, sent []time.Time, now time.Time) t.RateLimitDecision {
+	start := FixedWindowStart(rule, now)
+	count := 0
+	for _, at := range sent {
+		if !at.Before(start) && !at.After(now) {
+			count++
+		}
+	}
+	return t.RateLimitDecision{
+		Allowed:   count < rule.MaxCount,
+		Rule:      rule,
+		Limit:     rule.MaxCount,
+		Remaining: max(rule.MaxCount-count, 0),
+		ResetAt:   start.Add(RuleWindow(rule)),
+	}
+}
+
+// BucketParams returns the capacity and refill rate (tokens per second) of a token
+// bucket rule. Burst defaults to MaxCount and RefillRate to MaxCount per Duration.
+func BucketParams(rule t.RateLimitRule) (float64, float64) {
+	capacity := float64(rule.Burst)
+	if capacity <= 0 {
+		capacity = float64(rule.MaxCount)
+	}
+	rate := rule.RefillRate
+	if rate <= 0 && rule.Duration > 0 {
+		rate = float64(rule.MaxCount) / rule.Duration
+	}
+	return capacity, rate
+}
+
+// EvaluateTokenBucket refills b up to now and decides whether one token can be taken.
+// It returns the refilled bucket, which the caller persists after taking the token.
+// ResetAt is when the next whole token becomes available, or now if the bucket is full.
+func EvaluateTokenBucket(rule t.RateLimitRule, b t.Bucket, now time.Time) (t.RateLimitDecision, t.Bucket) {
+	capacity, rate := BucketParams(rule)
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*rate)
+		b.UpdatedAt = now
+	}
+
+	decision := t.RateLimitDecision{
+		Allowed:   b.Tokens >= 1,
+		Rule:      rule,
+		Limit:     int(capacity),
+		Remaining: int(math.Floor(b.Tokens)),
+		ResetAt:   now,
+	}
+	if b.Tokens < capacity && rate > 0 {
+		missing := math.Floor(b.Tokens) + 1 - b.Tokens
+		decision.ResetAt = now.Add(time.Duration(math.Ceil(missing / rate * float64(time.Second))))
+	}
+	return decision, b
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+)
+
+var (
+	ErrOptedOut   = errors.New("recipient opted out of this notification type")
+	ErrQuietHours = errors.New("recipient is in quiet hours for this notification type")
+)
+
+// UnsubscribeSigner builds and verifies one-click unsubscribe links
+type UnsubscribeSigner struct {
+	Secret  []byte
+	BaseURL string
+}
+
+// Link returns the signed URL that opts recipient out of nType
+func (u *UnsubscribeSigner) Link(recipient string, nType t.NotificationType) string {
+	q := url.Values{}
+	q.Set("recipient", recipient)
+	q.Set("group", string(nType))
+	q.Set("sig", u.sign(recipient, nType))
+	return strings.TrimRight(u.BaseURL, "/") + "/unsubscribe?" + q.Encode()
+}
+
+// Verify reports whether sig was issued for recipient and nType
+func (u *UnsubscribeSigner) Verify(recipient string, nType t.NotificationType, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(u.sign(recipient, nType)))
+}
+
+func (u *UnsubscribeSigner) sign(recipient string, nType t.NotificationType) string {
+	mac := hmac.New(sha256.New, u.Secret)
+	mac.Write([]byte(recipient))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nType))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseClock parses an "HH:MM" quiet hours bound into minutes since midnight
+func ParseClock(v string) (int, error) {
+	c, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", v)
+	}
+	return c.Hour()*60 + c.Minute(), nil
+}
+
+// InQuietHours reports whether now falls in the [start, end) window. Windows
+// where start is after end wrap around midnight, e.g. 22:00-07:00.
+func InQuietHours(start, end string, now time.Time) (bool, error) {
+	if start == "" || end == "" {
+		return false, nil
+	}
+	from, err := ParseClock(start)
+	if err != nil {
+		return false, err
+	}
+	to, err := ParseClock(end)
+	if err != nil {
+		return false, err
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if from <= to {
+		return minute >= from && minute < to, nil
+	}
+	return minute >= from || minute < to, nil
+}
+
+// QuietUntil returns when the [start, end) window that now falls in ends, in the location
+// of now, or the zero time when now is outside of it
+func QuietUntil(start, end string, now time.Time) (time.Time, error) {
+	quiet, err := InQuietHours(start, end, now)
+	if err != nil || !quiet {
+		return time.Time{}, err
+	}
+	return NextClock(end, now)
+}
+
+// NextClock returns the first time after now the "HH:MM" clock v is read in the location of now
+func NextClock(v string, now time.Time) (time.Time, error) {
+	clock, err := ParseClock(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), clock/60, clock%60, 0, 0, now.Location())
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, clock/60, clock%60, 0, 0, now.Location())
+	}
+	return next, nil
+}
+
+// checkPreference returns the recipient preference for the input type, or an error when
+// the notification must be suppressed: ErrOptedOut, or a *QuietHoursError when it has to
+// wait for the quiet hours of the recipient, read in its time zone, to end
+func (s *NotificationService) checkPreference(ctx context.Context, db d.Database, in t.InputInfo) (t.Preference, error) {
+	p, err := db.GetPreference(ctx, in.Recipient, in.NotificationGroup)
+	if errors.Is(err, d.ErrNotFound) {
+		return t.Preference{}, nil
+	}
+	if err != nil {
+		return t.Preference{}, fmt.Errorf("could not fetch preferences: %w", err)
+	}
+
+	if p.OptedOut {
+		return p, ErrOptedOut
+	}
+	if s.QuietHoursBypass[in.NotificationGroup] || p.QuietHoursStart == "" {
+		return p, nil
+	}
+
+	loc := time.UTC
+	r, err := db.GetRecipient(ctx, in.Recipient)
+	switch {
+	case err == nil:
+		loc = r.Location()
+	case !errors.Is(err, d.ErrNotFound):
+		return p, fmt.Errorf("could not fetch recipient: %w", err)
+	}
+	until, err := QuietUntil(p.QuietHoursStart, p.QuietHoursEnd, time.Now().In(loc))
+	if err != nil {
+		return p, fmt.Errorf("invalid quiet hours for recipient %s: %w", in.Recipient, err)
+	}
+	if !until.IsZero() {
+		return p, &QuietHoursError{Recipient: in.Recipient, Until: until}
+	}
+	return p, nil
+}
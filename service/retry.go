@@ -0,0 +1,87 @@
+package service
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/textproto"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// RetryPolicy decides how a channel retries failed deliveries. The delay before retry n
+// is Backoff*2^(n-1), capped at MaxBackoff; Jitter is the fraction of that delay taken
+// off at random so notifications failing together do not come back together.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt; a notification failing that many times is dead
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is between 0, for fixed delays, and 1
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     30 * time.Second,
+	MaxBackoff:  time.Hour,
+	Jitter:      0.2,
+}
+
+// Delay returns how long to wait before retrying a notification that failed its attempt-th attempt
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+	return delay - time.Duration(p.Jitter*rand.Float64()*float64(delay))
+}
+
+// PermanentError marks a delivery error retrying cannot fix, such as an invalid address
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err as a PermanentError
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// Retryable reports whether a delivery that failed with err may succeed if attempted
+// again. Errors are retryable unless a sender marked them permanent or the remote end
+// rejected the message itself: webhook 4xx statuses other than 408 and 429, SMTP 5xx
+// replies and Telegram requests refused as bad, forbidden or unauthorized.
+func Retryable(err error) bool {
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	var status *WebhookStatusError
+	if errors.As(err, &status) {
+		code := status.StatusCode
+		return code >= 500 || code == 408 || code == 429
+	}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code < 500
+	}
+	var telegramErr tgbotapi.Error
+	if errors.As(err, &telegramErr) {
+		for _, prefix := range []string{"Bad Request", "Forbidden", "Unauthorized"} {
+			if strings.HasPrefix(telegramErr.Message, prefix) {
+				return false
+			}
+		}
+	}
+	return true
+}
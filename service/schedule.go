@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	d "notification_service/db"
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSendAtInPast   = errors.New("send_at is in the past")
+	ErrNotCancellable = errors.New("the notification is no longer scheduled")
+)
+
+// localSendAtLayouts are the send_at layouts without an offset, read in the time zone of
+// the recipient
+var localSendAtLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+// ParseSendAt parses the send_at of a notification: RFC 3339 times are absolute, local
+// times are read in loc
+func ParseSendAt(raw string, loc *time.Location) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, raw); err == nil {
+		return at, nil
+	}
+	for _, layout := range localSendAtLayouts {
+		if at, err := time.ParseInLocation(layout, raw, loc); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid send_at %q, expected an RFC 3339 time or a local 2006-01-02T15:04 time", raw)
+}
+
+// Schedule keeps in until its send_at, read in the time zone of the recipient when it has
+// no offset. Nothing is checked against the preferences or rate limits until it is
+// dispatched, so the returned output only carries the ID of the scheduled notification.
+func (s *NotificationService) Schedule(ctx context.Context, in t.InputInfo) (t.Output, error) {
+	loc := time.UTC
+	r, err := s.DB.GetRecipient(ctx, in.Recipient)
+	switch {
+	case err == nil:
+		loc = r.Location()
+	case !errors.Is(err, d.ErrNotFound):
+		return t.Output{}, fmt.Errorf("could not fetch recipient: %w", err)
+	}
+	at, err := ParseSendAt(in.SendAt, loc)
+	if err != nil {
+		return t.Output{}, err
+	}
+	if !at.After(time.Now()) {
+		return t.Output{}, ErrSendAtInPast
+	}
+
+	sn, err := s.schedule(ctx, s.DB, in, at)
+	if err != nil {
+		return t.Output{}, err
+	}
+	return scheduledOutput(sn, in, "Notification scheduled"), nil
+}
+
+// deferQuiet schedules in, which fell in the quiet hours of its recipient, for when they end
+func (s *NotificationService) deferQuiet(ctx context.Context, db d.Database, in t.InputInfo, quietErr *QuietHoursError) (t.ScheduledNotification, error) {
+	in.SendAt = ""
+	sn, err := s.schedule(ctx, db, in, quietErr.Until)
+	if err != nil {
+		return t.ScheduledNotification{}, err
+	}
+	s.Logger.Info("notification is deferred to the end of quiet hours",
+		zap.String("id", sn.ID),
+		zap.String("recipient", in.Recipient),
+		zap.String("type", string(in.NotificationGroup)),
+	)
+	return sn, nil
+}
+
+// schedule keeps in through db until at
+func (s *NotificationService) schedule(ctx context.Context, db d.Database, in t.InputInfo, at time.Time) (t.ScheduledNotification, error) {
+	sn, err := db.ScheduleNotification(ctx, t.ScheduledNotification{
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Payload:           in,
+		SendAt:            at,
+	})
+	if err != nil {
+		return t.ScheduledNotification{}, fmt.Errorf("could not schedule notification: %w", err)
+	}
+	s.Logger.Info("notification is scheduled",
+		zap.String("id", sn.ID),
+		zap.String("recipient", in.Recipient),
+		zap.String("type", string(in.NotificationGroup)),
+		zap.Time("send_at", at),
+	)
+	return sn, nil
+}
+
+// scheduledOutput answers a notify request for in, kept as sn until its send_at
+func scheduledOutput(sn t.ScheduledNotification, in t.InputInfo, message string) t.Output {
+	sendAt := sn.SendAt.UTC()
+	return t.Output{
+		ID:                sn.ID,
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Channel:           in.Channel,
+		MessageID:         in.MessageID,
+		TimeStamp:         time.Now(),
+		SendAt:            &sendAt,
+		Message:           message,
+	}
+}
+
+// DispatchNext claims a scheduled notification whose send_at has come and sends it as a
+// batch of one, so the preferences and rate limits apply at dispatch time. Its outcome is
+// committed with the notification it became, so a dispatch interrupted by a restart is
+// retried and never sent twice. It reports whether a notification was due.
+func (s *NotificationService) DispatchNext(ctx context.Context, lease time.Duration) (bool, error) {
+	claimed, err := s.DB.ClaimScheduledNotification(ctx, lease)
+	if errors.Is(err, d.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = s.DB.WithLock(ctx, scheduleKey(claimed.ID), func(db d.Database) error {
+		sn, err := db.GetScheduledNotification(ctx, claimed.ID)
+		if err != nil || sn.Status != t.Scheduled {
+			return err
+		}
+		in := sn.Payload
+		in.SendAt = ""
+		results, err := s.sendBatch(ctx, db, []t.InputInfo{in})
+		if err != nil {
+			return err
+		}
+		sn.Result, sn.NotificationID, sn.Error = results[0].Status, results[0].ID, results[0].Error
+		if err := db.MarkDispatched(ctx, sn); err != nil {
+			return fmt.Errorf("could not mark scheduled notification dispatched: %w", err)
+		}
+		s.Logger.Info("scheduled notification is dispatched",
+			zap.String("id", sn.ID),
+			zap.String("notification_id", sn.NotificationID),
+			zap.String("result", string(sn.Result)),
+		)
+		return nil
+	})
+	return true, err
+}
+
+// CancelScheduled cancels a notification waiting for its send_at. Dispatched and
+// cancelled notifications cannot be cancelled.
+func (s *NotificationService) CancelScheduled(ctx context.Context, id string) (t.ScheduledNotification, error) {
+	var cancelled t.ScheduledNotification
+	err := s.DB.WithLock(ctx, scheduleKey(id), func(db d.Database) error {
+		// looked up before the update: an id that is not a UUID fails the statement and
+		// aborts the transaction, so nothing could run after it
+		sn, err := db.GetScheduledNotification(ctx, id)
+		if err != nil {
+			return err
+		}
+		if sn.Status != t.Scheduled {
+			return ErrNotCancellable
+		}
+		cancelled, err = db.CancelScheduledNotification(ctx, id)
+		return err
+	})
+	return cancelled, err
+}
+
+// scheduleKey is the lock serializing the dispatch and the cancellation of a scheduled notification
+func scheduleKey(id string) string {
+	return "scheduled:" + id
+}
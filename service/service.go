@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,103 +14,344 @@ import (
 
 type Service interface {
 	SendNotification(ctx context.Context, input t.InputInfo) (t.Output, error)
-	IsAllowed(ctx context.Context, nType t.NotificationType) bool
+	IsAllowed(ctx context.Context, recipient string, nType t.NotificationType) bool
 }
 
+var _ Service = (*NotificationService)(nil)
+
+// NotificationService is shared by every request: its fields are set up once before
+// serving and never written afterwards, and all per-request state travels as arguments,
+// so it is safe for concurrent use.
 type NotificationService struct {
-	DB                  *d.DBConnector
-	Logger              *zap.Logger
-	CurrentNotification t.Notifications
-	Input               t.InputInfo
+	DB          d.Database
+	Logger      *zap.Logger
+	Channels    *Registry
+	Unsubscribe *UnsubscribeSigner
+	// Retries holds the retry policy of each channel; channels without one use DefaultRetryPolicy
+	Retries map[t.Channel]RetryPolicy
+	// IdempotencyTTL is how long responses to idempotency keys are kept, DefaultIdempotencyTTL when zero
+	IdempotencyTTL time.Duration
+	// BroadcastPageSize is how many members a broadcast sends to at once, DefaultBroadcastPageSize when zero
+	BroadcastPageSize int
+	// Digests holds the types in digest mode, whose rate limited notifications are sent later in a digest
+	Digests map[t.NotificationType]DigestPolicy
+	// QuietHoursBypass holds the types sent in the quiet hours of their recipients instead of being deferred
+	QuietHoursBypass map[t.NotificationType]bool
 }
 
-func NewNotificationService(logger *zap.Logger, conn *d.DBConnector) *NotificationService {
-	return &NotificationService{Logger: logger, DB: conn}
+func NewNotificationService(logger *zap.Logger, conn d.Database, channels *Registry) *NotificationService {
+	return &NotificationService{Logger: logger, DB: conn, Channels: channels}
 }
 
-func (s *NotificationService) SendNotification(ctx context.Context) (t.Output, error) {
-	if !s.IsAllowed(ctx, s.Input.NotificationGroup) {
-		return t.Output{}, fmt.Errorf("rate limit exceeded for recipient %s", s.Input.Recipient)
-	}
+// WithDB returns a copy of the service reading and writing through db, such as the
+// Database a lock hands over, so that what it does commits with the lock transaction
+func (s *NotificationService) WithDB(db d.Database) *NotificationService {
+	c := *s
+	c.DB = db
+	return &c
+}
 
-	if err := s.DB.RecordNotification(ctx, &s.Input, s.CurrentNotification); err != nil {
-		return t.Output{}, fmt.Errorf("could not update notifications table: %v", err)
+// SendNotification accepts a notification for delivery. The rate limit is checked and
+// recorded and the notification is written to the outbox in a single transaction; the
+// delivery workers send it afterwards, so the returned output only carries its ID. A
+// notification in the quiet hours of its recipient is scheduled for when they end instead,
+// and the output carries the ID of the scheduled notification and its send_at; one rate
+// limited in a type in digest mode is added to the digest of its recipient, and the output
+// carries the ID of the digest and when it is sent.
+func (s *NotificationService) SendNotification(ctx context.Context, in t.InputInfo) (t.Output, error) {
+	o, err := s.prepare(ctx, s.DB, in)
+	var quietErr *QuietHoursError
+	if errors.As(err, &quietErr) {
+		sn, err := s.deferQuiet(ctx, s.DB, in, quietErr)
+		if err != nil {
+			return t.Output{}, err
+		}
+		return scheduledOutput(sn, in, "Notification deferred until the quiet hours end"), nil
 	}
-	if err := sendTelegramMessage(5751493884, "HOLA ROMI ENVIADO!"); err != nil {
-		return t.Output{}, fmt.Errorf("could not send telegram message: %v", err)
+	if err != nil {
+		return t.Output{}, err
 	}
-	// TODO: Implement sending logic here
-	s.Logger.Info("notification is sent",
-		zap.String("recipient", s.Input.Recipient),
-		zap.String("type", string(s.Input.NotificationGroup)),
+	var digested t.Digest
+	if err := s.DB.WithLock(ctx, rateLimitKey(in), func(db d.Database) error {
+		err := s.checkAndRecord(ctx, db, in)
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			dg, ok, digestErr := s.digest(ctx, db, in, rateLimitErr)
+			if digestErr != nil {
+				return digestErr
+			}
+			if ok {
+				digested = dg
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		queued, err := db.EnqueueNotification(ctx, o)
+		if err != nil {
+			return fmt.Errorf("could not enqueue notification: %w", err)
+		}
+		o = queued
+		return nil
+	}); err != nil {
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			s.recordRateLimited(ctx, o, rateLimitErr)
+		}
+		return t.Output{}, err
+	}
+	if digested.ID != "" {
+		return digestOutput(digested, in), nil
+	}
+	s.Logger.Info("notification is queued",
+		zap.String("id", o.ID),
+		zap.String("recipient", in.Recipient),
+		zap.String("type", string(in.NotificationGroup)),
+		zap.String("channel", string(o.Channel)),
+		zap.String("priority", string(o.Priority)),
 	)
+
 	output := t.Output{
-		Recipient:         s.Input.Recipient,
-		NotificationGroup: s.Input.NotificationGroup,
+		ID:                o.ID,
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Channel:           o.Channel,
+		MessageID:         in.MessageID,
 		TimeStamp:         time.Now(),
-		Message:           "Notification sent successfully",
+		Message:           "Notification accepted for delivery",
 	}
-
 	return output, nil
 }
 
-func (s *NotificationService) IsAllowed(ctx context.Context, nType t.NotificationType) bool {
-	lastNotification := make(chan t.Notifications)
-	rateLimitRules := make(chan t.RateLimitRule)
+// recordRateLimited keeps the notification rejected by rateLimitErr and sets its ID on the
+// error. The rejection stands when it cannot be recorded.
+func (s *NotificationService) recordRateLimited(ctx context.Context, o t.OutboxMessage, rateLimitErr *RateLimitError) {
+	rejected, err := s.DB.RecordRateLimited(ctx, o, rateLimitErr.Error())
+	if err != nil {
+		s.Logger.Error("could not record rate limited notification",
+			zap.String("recipient", o.Recipient),
+			zap.String("type", string(o.NotificationGroup)),
+			zap.Error(err),
+		)
+		return
+	}
+	rateLimitErr.NotificationID = rejected.ID
+}
 
-	errChan := make(chan error)
+// prepare checks the recipient preferences for in and builds the outbox message that
+// delivers it, without touching the rate limit
+func (s *NotificationService) prepare(ctx context.Context, db d.Database, in t.InputInfo) (t.OutboxMessage, error) {
+	pref, err := s.checkPreference(ctx, db, in)
+	if err != nil {
+		return t.OutboxMessage{}, err
+	}
+	sender, address, err := s.resolveDestination(ctx, db, in, pref.PreferredChannel)
+	if err != nil {
+		return t.OutboxMessage{}, err
+	}
+
+	o := t.OutboxMessage{
+		Recipient:         in.Recipient,
+		NotificationGroup: in.NotificationGroup,
+		Channel:           sender.Channel(),
+		Address:           address,
+		MessageID:         in.MessageID,
+		Title:             in.Title,
+		Body:              in.Body,
+		HTMLBody:          in.HTMLBody,
+		Data:              in.Data,
+		Priority:          in.Priority.OrNormal(),
+	}
+	if s.Unsubscribe != nil {
+		o.UnsubscribeURL = s.Unsubscribe.Link(in.Recipient, in.NotificationGroup)
+	}
+	return o, nil
+}
+
+// rateLimitKey is the lock serializing the sends that count against the same rules
+func rateLimitKey(in t.InputInfo) string {
+	return fmt.Sprintf("rate_limit:%s:%s", in.NotificationGroup, in.Recipient)
+}
+
+// checkAndRecord evaluates the rate limit of in and records the send when it is allowed.
+// It must run under the rate limit lock of in, otherwise concurrent sends may all see
+// the same history and exceed the limit together.
+func (s *NotificationService) checkAndRecord(ctx context.Context, db d.Database, in t.InputInfo) error {
+	// read the clock under the lock so sends are recorded in the order they were allowed
+	now := time.Now().UTC()
+	decisions, err := s.evaluate(ctx, db, in, now)
+	if err != nil {
+		return fmt.Errorf("could not evaluate rate limit: %w", err)
+	}
+	if decision := CombineDecisions(decisions); !decision.Allowed {
+		return &RateLimitError{Recipient: in.Recipient, Decision: decision}
+	}
+
+	if err := db.RecordNotification(ctx, &in, now); err != nil {
+		return fmt.Errorf("could not update notifications table: %v", err)
+	}
+	if err := s.consume(ctx, db, decisions, in, now); err != nil {
+		return fmt.Errorf("could not update rate limit state: %v", err)
+	}
+	return nil
+}
 
-	go func() {
-		n, err := s.DB.GetLastNotification(ctx, s.Input)
+// resolveDestination picks the sender and address used to reach the input recipient.
+// Registered recipients are reached on the requested channel, or else on the first of
+// preferred (the type preference) and their preferred channels that has an address;
+// unregistered recipients are used as the raw address on the requested, preferred or
+// default channel, except for webhooks: the service would call any URL a caller names.
+func (s *NotificationService) resolveDestination(ctx context.Context, db d.Database, in t.InputInfo, preferred t.Channel) (Sender, string, error) {
+	r, err := db.GetRecipient(ctx, in.Recipient)
+	if errors.Is(err, d.ErrNotFound) {
+		channel := in.Channel
+		if channel == "" {
+			channel = preferred
+		}
+		sender, err := s.Channels.Sender(channel)
 		if err != nil {
-			errChan <- err
-			return
+			return nil, "", err
+		}
+		if sender.Channel() == t.Webhook {
+			return nil, "", fmt.Errorf("%w: %s", ErrUnregisteredWebhook, in.Recipient)
 		}
-		lastNotification <- n
+		return sender, in.Recipient, nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("could not fetch recipient: %w", err)
+	}
 
-		r, err := s.DB.GetRateLimitRules(ctx, nType)
+	candidates := []t.Channel{in.Channel}
+	if in.Channel == "" {
+		candidates = append([]t.Channel{preferred}, r.PreferredChannels...)
+		candidates = append(candidates, s.Channels.Channels()...)
+	}
+	for _, c := range candidates {
+		address := r.Address(c)
+		if address == "" {
+			continue
+		}
+		sender, err := s.Channels.Sender(c)
 		if err != nil {
-			errChan <- err
-			return
+			continue
 		}
-		rateLimitRules <- r
-	}()
-	// Handle go routines results
-	var n t.Notifications
-	var r t.RateLimitRule
-	var err error
+		return sender, address, nil
+	}
+	if in.Channel != "" {
+		return nil, "", fmt.Errorf("recipient %s cannot be reached on channel %s", in.Recipient, in.Channel)
+	}
+	return nil, "", fmt.Errorf("recipient %s has no address on any available channel", in.Recipient)
+}
 
-	for i := 0; i < 2; i++ {
-		select {
-		case n = <-lastNotification:
-		case r = <-rateLimitRules:
-		case err = <-errChan:
-			s.Logger.Error("Error retrieving data", zap.Error(err))
-			return false
-		}
+// IsAllowed reports whether a notification of nType can be sent now to recipient
+func (s *NotificationService) IsAllowed(ctx context.Context, recipient string, nType t.NotificationType) bool {
+	quota, err := s.Quota(ctx, recipient, nType, t.Normal)
+	if err != nil {
+		s.Logger.Error("Error retrieving data", zap.Error(err))
+		return false
 	}
+	return quota.Allowed
+}
 
-	if n == (t.Notifications{}) || n.ID == "" {
-		return true // first notif
+// Quota evaluates the rate limit rules of nType for recipient as a send of the given
+// priority would, without recording anything
+func (s *NotificationService) Quota(ctx context.Context, recipient string, nType t.NotificationType, priority t.Priority) (t.Quota, error) {
+	now := time.Now().UTC()
+	decisions, err := s.evaluate(ctx, s.DB, t.InputInfo{Recipient: recipient, NotificationGroup: nType, Priority: priority}, now)
+	if err != nil {
+		return t.Quota{}, fmt.Errorf("could not evaluate rate limit: %w", err)
 	}
 
-	if isGreaterDuration(r.Duration, n.CreatedAt) {
-		return true // notif is allowed to be sent because time to send new notif of this type is reached
+	quota := t.Quota{Recipient: recipient, NotificationGroup: nType, Allowed: true, ResetAt: now}
+	if len(decisions) > 0 {
+		decision := CombineDecisions(decisions)
+		quota.Allowed = decision.Allowed
+		quota.Limit = decision.Limit
+		quota.Remaining = decision.Remaining
+		quota.ResetAt = decision.ResetAt
+		quota.Rule = &decision.Rule
 	}
+	return quota, nil
+}
 
-	if r.MaxCount > n.Counter { // if current notif < maxcount send message & incr counter
-		s.CurrentNotification = n
-		s.CurrentNotification.Counter = n.Counter + 1
-		return true
+// evaluate applies the rate limit rules of the input type that are enforced for the
+// recipient to its send history. Critical inputs are allowed by the rules they bypass,
+// which still report their state and are consumed like the others.
+func (s *NotificationService) evaluate(ctx context.Context, db d.Database, in t.InputInfo, now time.Time) ([]t.RateLimitDecision, error) {
+	rules, err := db.GetRateLimitRules(ctx, in.NotificationGroup, in.Recipient)
+	if err != nil {
+		return nil, err
 	}
+	rules = ResolveRules(rules)
+	decisions := make([]t.RateLimitDecision, 0, len(rules))
+	for _, rule := range rules {
+		limiter, err := LimiterFor(rule.Strategy)
+		if err != nil {
+			return nil, err
+		}
+		decision, err := limiter.Evaluate(ctx, db, rule, in, now)
+		if err != nil {
+			return nil, err
+		}
+		if in.Priority == t.Critical && rule.CriticalBypass {
+			decision.Allowed = true
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
 
-	return false
+// consume records an accepted send against every rule that allowed it
+func (s *NotificationService) consume(ctx context.Context, db d.Database, decisions []t.RateLimitDecision, in t.InputInfo, now time.Time) error {
+	for _, decision := range decisions {
+		limiter, err := LimiterFor(decision.Rule.Strategy)
+		if err != nil {
+			return err
+		}
+		if err := limiter.Consume(ctx, db, decision.Rule, in, now); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// isGreaterDuration returns true if timeSince creation is greater than the rate limit duration
-func isGreaterDuration(durationSeconds float64, creation time.Time) bool {
-	now := time.Now().UTC()
-	timeSince := now.Sub(creation).Seconds()
-	v := timeSince > durationSeconds
-	return v
+// ResolveRules returns the rules enforced out of those that may apply to a recipient.
+// Overrides replace rather than add to less specific rules: when the recipient has rules
+// of its own only those are enforced, otherwise the rules of its tenant, otherwise the
+// global ones.
+func ResolveRules(rules []t.RateLimitRule) []t.RateLimitRule {
+	scope := t.GlobalScope
+	for _, rule := range rules {
+		scope = max(scope, rule.Scope())
+	}
+	resolved := make([]t.RateLimitRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Scope() == scope {
+			resolved = append(resolved, rule)
+		}
+	}
+	return resolved
+}
+
+// CombineDecisions folds the decisions of layered rules into the one reported to callers.
+// A send is allowed only if every rule allows it. When some rule rejects it, the result
+// is the rejecting rule that resets last, since all of them have to clear; otherwise it is
+// the rule with the fewest sends remaining. Types without rules are not limited.
+func CombineDecisions(decisions []t.RateLimitDecision) t.RateLimitDecision {
+	if len(decisions) == 0 {
+		return t.RateLimitDecision{Allowed: true}
+	}
+	result := decisions[0]
+	for _, d := range decisions[1:] {
+		switch {
+		case result.Allowed && !d.Allowed:
+			result = d
+		case !result.Allowed && !d.Allowed && d.ResetAt.After(result.ResetAt):
+			result = d
+		case result.Allowed && d.Allowed && d.Remaining < result.Remaining:
+			result = d
+		}
+	}
+	return result
 }
@@ -1,29 +1,50 @@
 package service
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"os"
+	"strconv"
+
+	t "notification_service/types"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"go.uber.org/zap"
 )
 
-func getToken() string {
-	return os.Getenv("TELEGRAM_TOKEN")
+// TelegramSender delivers messages to Telegram chats through a bot.
+// Addresses are chat IDs; any other address fails permanently.
+type TelegramSender struct {
+	Token  string
+	Logger *zap.Logger
+}
+
+func NewTelegramSender(token string, logger *zap.Logger) *TelegramSender {
+	return &TelegramSender{Token: token, Logger: logger}
+}
+
+func (s *TelegramSender) Channel() t.Channel {
+	return t.Telegram
 }
-func sendTelegramMessage(chatID int64, message string) error {
-	bot, err := tgbotapi.NewBotAPI(getToken())
+
+func (s *TelegramSender) Send(ctx context.Context, msg t.Message) (t.Receipt, error) {
+	chatID, err := strconv.ParseInt(msg.Address, 10, 64)
 	if err != nil {
-		return fmt.Errorf("could not initialize Telegram bot: %w", err)
+		return t.Receipt{}, Permanent(fmt.Errorf("recipient %q has no telegram chat id", msg.Recipient))
 	}
 
-	msg := tgbotapi.NewMessage(chatID, message)
+	bot, err := tgbotapi.NewBotAPI(s.Token)
+	if err != nil {
+		return t.Receipt{}, fmt.Errorf("could not initialize Telegram bot: %w", err)
+	}
 
-	_, err = bot.Send(msg)
+	sent, err := bot.Send(tgbotapi.NewMessage(chatID, msg.Text()))
 	if err != nil {
-		return fmt.Errorf("could not send message: %w", err)
+		return t.Receipt{}, fmt.Errorf("could not send message: %w", err)
 	}
 
-	log.Printf("Message sent to chat ID: %d", chatID)
-	return nil
+	s.Logger.Info("Message sent to Telegram chat",
+		zap.Int64("chat_id", chatID),
+		zap.String("recipient", msg.Recipient),
+	)
+	return t.Receipt{Channel: t.Telegram, Reference: strconv.Itoa(sent.MessageID)}, nil
 }
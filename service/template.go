@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+
+	d "notification_service/db"
+	t "notification_service/types"
+)
+
+// DefaultLocale is the locale templates fall back to when there is none closer to the
+// requested one
+const DefaultLocale = "en"
+
+var (
+	ErrUnknownTemplate  = errors.New("unknown template")
+	ErrMissingVariables = errors.New("missing template variables")
+	ErrRenderTemplate   = errors.New("could not render template")
+)
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// NormalizeLocale validates a locale such as "pt-BR" or "pt_br", lower casing its language
+// and upper casing its region
+func NormalizeLocale(raw string) (string, error) {
+	locale := strings.ReplaceAll(strings.TrimSpace(raw), "_", "-")
+	if !localePattern.MatchString(locale) {
+		return "", fmt.Errorf("invalid locale: %s", raw)
+	}
+	parts := strings.Split(locale, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// LocaleFallbacks returns the locales a template is looked up in for locale, the most
+// specific first: "pt-BR" tries pt-BR, then pt, then DefaultLocale
+func LocaleFallbacks(locale string) []string {
+	var locales []string
+	if locale != "" {
+		for parts := strings.Split(locale, "-"); len(parts) > 0; parts = parts[:len(parts)-1] {
+			locales = append(locales, strings.Join(parts, "-"))
+		}
+	}
+	if !slices.Contains(locales, DefaultLocale) {
+		locales = append(locales, DefaultLocale)
+	}
+	return locales
+}
+
+// executor is what text and html templates have in common
+type executor interface {
+	Execute(w io.Writer, data any) error
+}
+
+// compiledTemplate holds the parsed title, body and HTML body of a template. Variables
+// the templates use but the request does not set are errors rather than "<no value>".
+type compiledTemplate struct {
+	title, body executor
+	html        executor
+}
+
+// ParseTemplate checks that the title, body and HTML body of tpl are valid templates
+func ParseTemplate(tpl t.Template) error {
+	_, err := compileTemplate(tpl)
+	return err
+}
+
+func compileTemplate(tpl t.Template) (compiledTemplate, error) {
+	title, err := texttemplate.New("title").Option("missingkey=error").Parse(tpl.Title)
+	if err != nil {
+		return compiledTemplate{}, fmt.Errorf("invalid title template: %w", err)
+	}
+	body, err := texttemplate.New("body").Option("missingkey=error").Parse(tpl.Body)
+	if err != nil {
+		return compiledTemplate{}, fmt.Errorf("invalid body template: %w", err)
+	}
+	html, err := htmltemplate.New("html_body").Option("missingkey=error").Parse(tpl.HTMLBody)
+	if err != nil {
+		return compiledTemplate{}, fmt.Errorf("invalid html_body template: %w", err)
+	}
+	return compiledTemplate{title: title, body: body, html: html}, nil
+}
+
+// RenderTemplate renders tpl with vars, the HTML body escaping them for HTML. It fails
+// with ErrMissingVariables when vars lacks some of the variables of tpl.
+func RenderTemplate(tpl t.Template, vars map[string]any) (t.RenderedTemplate, error) {
+	var missing []string
+	for _, name := range tpl.Variables {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return t.RenderedTemplate{}, fmt.Errorf("%w: %s", ErrMissingVariables, strings.Join(missing, ", "))
+	}
+
+	c, err := compileTemplate(tpl)
+	if err != nil {
+		return t.RenderedTemplate{}, fmt.Errorf("%w %s: %v", ErrRenderTemplate, tpl.Name, err)
+	}
+	out := t.RenderedTemplate{Name: tpl.Name, Locale: tpl.Locale, Version: tpl.Version}
+	for _, part := range []struct {
+		tmpl executor
+		dst  *string
+	}{{c.title, &out.Title}, {c.body, &out.Body}, {c.html, &out.HTMLBody}} {
+		var sb strings.Builder
+		if err := part.tmpl.Execute(&sb, vars); err != nil {
+			return t.RenderedTemplate{}, fmt.Errorf("%w %s: %v", ErrRenderTemplate, tpl.Name, err)
+		}
+		*part.dst = sb.String()
+	}
+	return out, nil
+}
+
+// templateKey is the lock serializing the creation of versions of a template
+func templateKey(name, locale string) string {
+	return fmt.Sprintf("template:%s:%s", name, locale)
+}
+
+// CreateTemplate saves tpl as the next version of its name and locale
+func (s *NotificationService) CreateTemplate(ctx context.Context, tpl t.Template) (t.Template, error) {
+	var created t.Template
+	err := s.DB.WithLock(ctx, templateKey(tpl.Name, tpl.Locale), func(db d.Database) error {
+		var err error
+		created, err = db.CreateTemplate(ctx, tpl)
+		return err
+	})
+	if err != nil {
+		return t.Template{}, fmt.Errorf("could not create template: %w", err)
+	}
+	return created, nil
+}
+
+// ResolveTemplate returns the template ref picks, in the first of the fallbacks of its
+// locale that has it
+func (s *NotificationService) ResolveTemplate(ctx context.Context, ref t.TemplateRef) (t.Template, error) {
+	for _, locale := range LocaleFallbacks(ref.Locale) {
+		tpl, err := s.DB.GetTemplate(ctx, ref.Name, locale, ref.Version)
+		if errors.Is(err, d.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return t.Template{}, fmt.Errorf("could not fetch template: %w", err)
+		}
+		return tpl, nil
+	}
+	if ref.Version != 0 {
+		return t.Template{}, fmt.Errorf("%w: %s version %d", ErrUnknownTemplate, ref.Name, ref.Version)
+	}
+	return t.Template{}, fmt.Errorf("%w: %s", ErrUnknownTemplate, ref.Name)
+}
+
+// PreviewTemplate renders the template ref picks with its variables
+func (s *NotificationService) PreviewTemplate(ctx context.Context, ref t.TemplateRef) (t.RenderedTemplate, error) {
+	tpl, err := s.ResolveTemplate(ctx, ref)
+	if err != nil {
+		return t.RenderedTemplate{}, err
+	}
+	return RenderTemplate(tpl, ref.Variables)
+}
+
+// ApplyTemplate renders the template of in into its title and bodies, so that it is sent
+// as if the caller had given them. Inputs without a template are left as they are.
+func (s *NotificationService) ApplyTemplate(ctx context.Context, in *t.InputInfo) error {
+	if in.Template == nil {
+		return nil
+	}
+	rendered, err := s.PreviewTemplate(ctx, *in.Template)
+	if err != nil {
+		return err
+	}
+	in.Title, in.Body, in.HTMLBody = rendered.Title, rendered.Body, rendered.HTMLBody
+	return nil
+}
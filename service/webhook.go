@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookTimeout = 5 * time.Second
+
+	WebhookSignatureHeader = "X-Notification-Signature"
+	WebhookTimestampHeader = "X-Notification-Timestamp"
+)
+
+// ErrUnregisteredWebhook is returned for a webhook notification to a recipient that is not
+// registered: only the webhook URLs of registered recipients are called
+var ErrUnregisteredWebhook = errors.New("webhooks are only sent to registered recipients")
+
+// WebhookStatusError is returned when the webhook endpoint answers with a non 2xx status
+type WebhookStatusError struct {
+	StatusCode int
+}
+
+func (e *WebhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.StatusCode)
+}
+
+// WebhookSender POSTs a signed JSON envelope to the URL given as message address
+type WebhookSender struct {
+	Secret []byte
+	Client *http.Client
+	Logger *zap.Logger
+}
+
+func NewWebhookSender(secret []byte, timeout time.Duration, logger *zap.Logger) *WebhookSender {
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &WebhookSender{
+		Secret: secret,
+		Client: &http.Client{Timeout: timeout},
+		Logger: logger,
+	}
+}
+
+func (s *WebhookSender) Channel() t.Channel {
+	return t.Webhook
+}
+
+func (s *WebhookSender) Send(ctx context.Context, msg t.Message) (t.Receipt, error) {
+	target, err := url.Parse(msg.Address)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return t.Receipt{}, Permanent(fmt.Errorf("invalid webhook URL %q", msg.Address))
+	}
+
+	now := time.Now().UTC()
+	body, err := json.Marshal(t.WebhookPayload{
+		ID:        msg.ID,
+		MessageID: msg.MessageID,
+		Recipient: msg.Recipient,
+		Group:     msg.Group,
+		Title:     msg.Title,
+		Body:      msg.Body,
+		Data:      msg.Data,
+		Timestamp: now,
+
+		UnsubscribeURL: msg.UnsubscribeURL,
+	})
+	if err != nil {
+		return t.Receipt{}, Permanent(fmt.Errorf("could not encode webhook payload: %w", err))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return t.Receipt{}, fmt.Errorf("could not build webhook request: %w", err)
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(s.Secret, timestamp, body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return t.Receipt{}, fmt.Errorf("could not call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	// a webhook answer carries no message id, so the status it answered with is kept as
+	// the reference of the delivery
+	receipt := t.Receipt{Channel: t.Webhook, Reference: fmt.Sprintf("status %d", resp.StatusCode), StatusCode: resp.StatusCode}
+	s.Logger.Info("Webhook called",
+		zap.String("recipient", msg.Recipient),
+		zap.String("host", target.Host),
+		zap.Int("status", resp.StatusCode),
+	)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return receipt, &WebhookStatusError{StatusCode: resp.StatusCode}
+	}
+	return receipt, nil
+}
+
+// SignWebhookPayload returns the signature header value for a payload sent at timestamp.
+// Receivers recompute it over "<timestamp>.<raw body>" with the shared secret.
+func SignWebhookPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	t "notification_service/types"
+
+	"go.uber.org/zap"
+)
+
+// Workers deliver the notifications of the outbox in the background. Every worker claims
+// one notification at a time under a lease; when a worker dies mid-delivery the lease
+// expires and another worker sends the notification again, so delivery is at least once
+// and survives restarts. The workers also dispatch the scheduled notifications and the
+// digests when they are due and fan the running broadcasts out, a page at a time.
+type Workers struct {
+	Svc   *NotificationService
+	Count int
+	// PollInterval is how long an idle worker waits before looking at the outbox again
+	PollInterval time.Duration
+	// Lease is how long a claimed notification stays reserved to its worker
+	Lease time.Duration
+}
+
+func NewWorkers(svc *NotificationService, count int, pollInterval, lease time.Duration) *Workers {
+	return &Workers{Svc: svc, Count: count, PollInterval: pollInterval, Lease: lease}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and all of them stopped
+func (w *Workers) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.Count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *Workers) work(ctx context.Context) {
+	steps := []struct {
+		name string
+		run  func(context.Context, time.Duration) (bool, error)
+	}{
+		{"delivering notification", w.Svc.DeliverNext},
+		{"dispatching scheduled notification", w.Svc.DispatchNext},
+		{"delivering digest", w.Svc.DeliverDigest},
+		{"advancing broadcast", w.Svc.AdvanceBroadcast},
+	}
+	for {
+		busy := false
+		for _, step := range steps {
+			done, err := step.run(ctx, w.Lease)
+			if err != nil {
+				w.Svc.Logger.Error("Error "+step.name, zap.Error(err))
+			}
+			busy = busy || (done && err == nil)
+		}
+		if busy {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.PollInterval):
+		}
+	}
+}
+
+// DeliverNext claims one notification of the outbox and delivers it. It reports whether
+// there was a notification to deliver; delivery failures are recorded on the notification,
+// the returned error is about the outbox itself.
+func (s *NotificationService) DeliverNext(ctx context.Context, lease time.Duration) (bool, error) {
+	claimed, err := s.DB.ClaimNotifications(ctx, 1, lease)
+	if err != nil || len(claimed) == 0 {
+		return false, err
+	}
+	return true, s.deliver(ctx, claimed[0])
+}
+
+// deliver sends a claimed notification. A failed delivery is retried after the backoff
+// of the channel retry policy; errors that cannot be fixed by retrying and notifications
+// out of attempts are filed as dead letters.
+func (s *NotificationService) deliver(ctx context.Context, o t.OutboxMessage) error {
+	sender, err := s.Channels.Sender(o.Channel)
+	if err != nil {
+		return s.DB.MarkFailed(ctx, o.ID, err.Error())
+	}
+	receipt, err := sender.Send(ctx, o.Message())
+	if err != nil {
+		deliveryErr := &DeliveryError{Channel: o.Channel, Err: err}
+		policy := s.retryPolicy(o.Channel)
+		if Retryable(err) && o.Attempts < policy.MaxAttempts {
+			retryAt := time.Now().UTC().Add(policy.Delay(o.Attempts))
+			s.Logger.Warn("notification delivery failed, retrying",
+				zap.String("id", o.ID),
+				zap.String("channel", string(o.Channel)),
+				zap.Int("attempt", o.Attempts),
+				zap.Time("retry_at", retryAt),
+				zap.Error(deliveryErr),
+			)
+			return s.DB.RetryNotification(ctx, o.ID, deliveryErr.Error(), retryAt)
+		}
+		s.Logger.Warn("notification delivery failed for good",
+			zap.String("id", o.ID),
+			zap.String("channel", string(o.Channel)),
+			zap.Int("attempt", o.Attempts),
+			zap.Error(deliveryErr),
+		)
+		return s.DB.MarkFailed(ctx, o.ID, deliveryErr.Error())
+	}
+
+	s.Logger.Info("notification is sent",
+		zap.String("id", o.ID),
+		zap.String("recipient", o.Recipient),
+		zap.String("type", string(o.NotificationGroup)),
+		zap.String("channel", string(receipt.Channel)),
+	)
+	return s.DB.MarkDelivered(ctx, o.ID, receipt.Reference)
+}
+
+func (s *NotificationService) retryPolicy(channel t.Channel) RetryPolicy {
+	if policy, ok := s.Retries[channel]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
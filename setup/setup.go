@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	d "notification_service/db"
+	"notification_service/service"
 	"notification_service/types"
 
 	"github.com/go-playground/validator"
@@ -43,6 +46,229 @@ func Setup(ctx context.Context) (*d.DBConnector, error) {
 	return &d.DBConnector{DB: db, Logger: logger}, err
 }
 
+// SetupChannels registers a sender for every channel configured in the environment
+func SetupChannels(logger *zap.Logger) (*service.Registry, error) {
+	defaultChannel := types.Channel(strings.ToUpper(os.Getenv("DEFAULT_CHANNEL")))
+	if defaultChannel == "" {
+		defaultChannel = types.Telegram
+	}
+	if !types.IsValidChannel(defaultChannel) {
+		return nil, fmt.Errorf("invalid default channel: %s", defaultChannel)
+	}
+	registry := service.NewRegistry(defaultChannel)
+
+	if token := os.Getenv("TELEGRAM_TOKEN"); token != "" {
+		registry.Register(service.NewTelegramSender(token, logger))
+	}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		config, err := smtpConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		registry.Register(service.NewEmailSender(config, logger))
+	}
+
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		var timeout time.Duration
+		if raw := os.Getenv("WEBHOOK_TIMEOUT"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid WEBHOOK_TIMEOUT: %w", err)
+			}
+			timeout = d
+		}
+		registry.Register(service.NewWebhookSender([]byte(secret), timeout, logger))
+	}
+
+	return registry, nil
+}
+
+// SetupUnsubscribe returns the signer for unsubscribe links, nil when UNSUBSCRIBE_SECRET is not set
+func SetupUnsubscribe() (*service.UnsubscribeSigner, error) {
+	secret := os.Getenv("UNSUBSCRIBE_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	baseURL := os.Getenv("PUBLIC_BASE_URL")
+	if baseURL == "" {
+		return nil, fmt.Errorf("PUBLIC_BASE_URL is required when UNSUBSCRIBE_SECRET is set")
+	}
+	return &service.UnsubscribeSigner{Secret: []byte(secret), BaseURL: baseURL}, nil
+}
+
+// SetupWorkers returns the outbox delivery workers configured by DELIVERY_WORKERS,
+// DELIVERY_POLL_INTERVAL and DELIVERY_LEASE
+func SetupWorkers(svc *service.NotificationService) (*service.Workers, error) {
+	count := 4
+	if raw := os.Getenv("DELIVERY_WORKERS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid DELIVERY_WORKERS: %s", raw)
+		}
+		count = n
+	}
+	pollInterval, err := durationEnv("DELIVERY_POLL_INTERVAL", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	lease, err := durationEnv("DELIVERY_LEASE", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return service.NewWorkers(svc, count, pollInterval, lease), nil
+}
+
+// SetupRetryPolicies returns the retry policy of every registered channel. RETRY_MAX_ATTEMPTS,
+// RETRY_BACKOFF, RETRY_MAX_BACKOFF and RETRY_JITTER change the defaults of every channel;
+// the same variables prefixed with the channel name, such as WEBHOOK_RETRY_MAX_ATTEMPTS,
+// change them for that channel only.
+func SetupRetryPolicies(channels *service.Registry) (map[types.Channel]service.RetryPolicy, error) {
+	defaults, err := retryPolicyEnv("RETRY_", service.DefaultRetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[types.Channel]service.RetryPolicy)
+	for _, channel := range channels.Channels() {
+		policy, err := retryPolicyEnv(string(channel)+"_RETRY_", defaults)
+		if err != nil {
+			return nil, err
+		}
+		policies[channel] = policy
+	}
+	return policies, nil
+}
+
+// retryPolicyEnv overrides the fields of policy set in the environment variables with prefix
+func retryPolicyEnv(prefix string, policy service.RetryPolicy) (service.RetryPolicy, error) {
+	if raw := os.Getenv(prefix + "MAX_ATTEMPTS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return service.RetryPolicy{}, fmt.Errorf("invalid %sMAX_ATTEMPTS: %s", prefix, raw)
+		}
+		policy.MaxAttempts = n
+	}
+	var err error
+	if policy.Backoff, err = durationEnv(prefix+"BACKOFF", policy.Backoff); err != nil {
+		return service.RetryPolicy{}, err
+	}
+	if policy.MaxBackoff, err = durationEnv(prefix+"MAX_BACKOFF", policy.MaxBackoff); err != nil {
+		return service.RetryPolicy{}, err
+	}
+	if raw := os.Getenv(prefix + "JITTER"); raw != "" {
+		jitter, err := strconv.ParseFloat(raw, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return service.RetryPolicy{}, fmt.Errorf("invalid %sJITTER: %s", prefix, raw)
+		}
+		policy.Jitter = jitter
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		return service.RetryPolicy{}, fmt.Errorf("%sMAX_BACKOFF must not be shorter than %sBACKOFF", prefix, prefix)
+	}
+	return policy, nil
+}
+
+// SetupIdempotency returns how long responses to idempotency keys are kept, IDEMPOTENCY_TTL
+func SetupIdempotency() (time.Duration, error) {
+	return durationEnv("IDEMPOTENCY_TTL", service.DefaultIdempotencyTTL)
+}
+
+// SetupBroadcasts returns how many segment members a broadcast sends to at once,
+// BROADCAST_PAGE_SIZE
+func SetupBroadcasts() (int, error) {
+	raw := os.Getenv("BROADCAST_PAGE_SIZE")
+	if raw == "" {
+		return service.DefaultBroadcastPageSize, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > service.MaxBatchLocks {
+		return 0, fmt.Errorf("invalid BROADCAST_PAGE_SIZE: %s", raw)
+	}
+	return n, nil
+}
+
+// SetupDigests returns the types in digest mode. <TYPE>_DIGEST, such as NEWS_DIGEST, is
+// "reset" to send the digest when the rate limit resets, or the "HH:MM" time it is sent at
+// in the time zone of the recipient; types without it drop their rate limited notifications.
+func SetupDigests() (map[types.NotificationType]service.DigestPolicy, error) {
+	policies := make(map[types.NotificationType]service.DigestPolicy)
+	for _, nType := range types.ValidNotificationTypes {
+		key := string(nType) + "_DIGEST"
+		switch raw := os.Getenv(key); raw {
+		case "":
+		case "reset":
+			policies[nType] = service.DigestPolicy{}
+		default:
+			if _, err := service.ParseClock(raw); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s, expected reset or HH:MM", key, raw)
+			}
+			policies[nType] = service.DigestPolicy{At: raw}
+		}
+	}
+	return policies, nil
+}
+
+// SetupQuietHoursBypass returns the types sent in the quiet hours of their recipients
+// rather than deferred, those whose <TYPE>_BYPASS_QUIET_HOURS, such as
+// STATUS_BYPASS_QUIET_HOURS, is true
+func SetupQuietHoursBypass() (map[types.NotificationType]bool, error) {
+	bypass := make(map[types.NotificationType]bool)
+	for _, nType := range types.ValidNotificationTypes {
+		key := string(nType) + "_BYPASS_QUIET_HOURS"
+		raw := os.Getenv(key)
+		if raw == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key, raw)
+		}
+		bypass[nType] = enabled
+	}
+	return bypass, nil
+}
+
+// durationEnv parses the duration in the environment variable key, def when it is not set
+func durationEnv(key string, def time.Duration) (time.Duration, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, raw)
+	}
+	return d, nil
+}
+
+func smtpConfig(host string) (types.SMTPConfig, error) {
+	config := types.SMTPConfig{
+		Host:     host,
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		TLSMode:  types.SMTPTLSMode(strings.ToLower(os.Getenv("SMTP_TLS"))),
+	}
+	if raw := os.Getenv("SMTP_PORT"); raw != "" {
+		port, err := strconv.Atoi(raw)
+		if err != nil {
+			return types.SMTPConfig{}, fmt.Errorf("invalid SMTP_PORT: %w", err)
+		}
+		config.Port = port
+	}
+	switch config.TLSMode {
+	case "", types.SMTPTLSNone, types.SMTPTLSStartTLS, types.SMTPTLSImplicit:
+	default:
+		return types.SMTPConfig{}, fmt.Errorf("invalid SMTP_TLS: %s", config.TLSMode)
+	}
+	config.InsecureSkipVerify = os.Getenv("SMTP_INSECURE_SKIP_VERIFY") == "true"
+	if config.From == "" {
+		return types.SMTPConfig{}, fmt.Errorf("SMTP_FROM is required when SMTP_HOST is set")
+	}
+	return config, nil
+}
+
 func setupFlags() (types.DatabaseConfig, error) {
 	args := flags{
 		Host: os.Getenv("POSTGRES_HOST"),
@@ -0,0 +1,212 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestValidateBatch(t *testing.T) {
+	testCases := []struct {
+		name            string
+		body            string
+		expectedItems   int
+		expectedInvalid []int
+		expectedError   string
+	}{
+		{name: "Valid Items", body: `[{"recipient": "a", "group": "news"}, {"recipient": "b", "group": "STATUS"}]`, expectedItems: 2},
+		{name: "Some Invalid Items", body: `[{"recipient": "a", "group": "news"}, {"recipient": "b", "group": "spam"}, 42, {"group": "NEWS"}]`,
+			expectedItems: 1, expectedInvalid: []int{1, 2, 3}},
+		{name: "Scheduled Item", body: `[{"recipient": "a", "group": "news", "send_at": "2030-01-15T09:00:00Z"}]`,
+			expectedItems: 0, expectedInvalid: []int{0}},
+		{name: "Not An Array", body: `{"recipient": "a", "group": "news"}`, expectedError: "invalid JSON format, expected an array of notifications"},
+		{name: "Empty", body: `[]`, expectedError: "the batch is empty"},
+		{name: "Too Large", body: "[" + strings.Repeat(`{},`, 1000) + "{}]", expectedError: "the batch exceeds 1000 notifications"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			items, indexes, invalid, err := server.ValidateBatch([]byte(tc.body))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, items, tc.expectedItems)
+			assert.Len(t, indexes, tc.expectedItems)
+			invalidIndexes := []int{}
+			for _, res := range invalid {
+				assert.Equal(t, types.BatchInvalid, res.Status)
+				assert.NotEmpty(t, res.Error)
+				invalidIndexes = append(invalidIndexes, res.Index)
+			}
+			if tc.expectedInvalid != nil {
+				assert.Equal(t, tc.expectedInvalid, invalidIndexes)
+			}
+		})
+	}
+}
+
+func TestSendBatchHandler(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 2, Duration: 3600}
+	store := newMemStore(rule)
+	s := server.NewServer(context.Background(),
+		service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram})))
+
+	body := `[
+		{"recipient": "romi", "group": "NEWS", "title": "1"},
+		{"recipient": "romi", "group": "NEWS", "title": "2"},
+		{"recipient": "romi", "group": "NEWS", "title": "3"},
+		{"recipient": "romi", "group": "SPAM"},
+		{"recipient": "bob", "group": "NEWS"},
+		{"recipient": "romi", "group": "NEWS", "channel": "EMAIL"}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/V1/notify/batch", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	s.SendBatchHandler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var res types.BatchResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	statuses := []types.BatchStatus{}
+	for i, r := range res.Results {
+		assert.Equal(t, i, r.Index)
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal(t, []types.BatchStatus{types.BatchSent, types.BatchSent, types.BatchRateLimited, types.BatchInvalid,
+		types.BatchSent, types.BatchFailed}, statuses)
+	assert.Equal(t, types.BatchSummary{types.BatchSent: 3, types.BatchRateLimited: 1, types.BatchInvalid: 1,
+		types.BatchFailed: 1}, res.Summary)
+
+	limited := res.Results[2]
+	assert.NotEmpty(t, limited.ID)
+	if assert.NotNil(t, limited.Rule) {
+		assert.Equal(t, "rule-1", limited.Rule.ID)
+	}
+	assert.NotNil(t, limited.ResetAt)
+	assert.Contains(t, res.Results[5].Error, "no sender registered for channel")
+
+	assert.Len(t, store.outbox, 3)
+	assert.Len(t, store.limited, 1)
+	assert.Len(t, store.sent["romi"+string(types.News)], 2)
+}
+
+func TestSendBatchSplitsLocks(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 2, Duration: 3600}
+	store := newMemStore(rule)
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+
+	items := []types.InputInfo{}
+	for i := 0; i < 2*service.MaxBatchLocks+10; i++ {
+		items = append(items, types.InputInfo{Recipient: fmt.Sprintf("user-%d", i), NotificationGroup: types.News})
+	}
+	// the later items of the first recipient join its transaction and its quota
+	for i := 0; i < 3; i++ {
+		items = append(items, types.InputInfo{Recipient: "user-0", NotificationGroup: types.News})
+	}
+	results, err := svc.SendBatch(context.Background(), items)
+	assert.NoError(t, err)
+
+	if assert.Len(t, store.lockSets, 3) {
+		assert.Len(t, store.lockSets[0], service.MaxBatchLocks)
+		assert.Contains(t, store.lockSets[0], "rate_limit:NEWS:user-0")
+		assert.Len(t, store.lockSets[1], service.MaxBatchLocks)
+		assert.Len(t, store.lockSets[2], 10)
+	}
+	statuses := types.BatchSummary{}
+	for _, res := range results {
+		statuses[res.Status]++
+	}
+	assert.Equal(t, types.BatchSummary{types.BatchSent: len(items) - 2, types.BatchRateLimited: 2}, statuses)
+	assert.Len(t, store.sent["user-0"+string(types.News)], 2)
+}
+
+// TestSendBatchQueries checks the database round trips of a batch: one query for the
+// preferences and one for the recipients of every item, one transaction taking all the
+// locks, one query each for the rules, the recent sends and the token buckets, and one
+// statement each for the sends, the buckets and all the notifications
+func TestSendBatchQueries(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	now := time.Now().UTC()
+
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences WHERE recipient = ANY`).
+		WithArgs(pq.Array([]string{"romi", "bob", "carol"})).
+		WillReturnRows(sqlmock.NewRows(preferenceColumns).
+			AddRow("carol", "NEWS", true, "", "", "", now))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipients WHERE id = ANY`).
+		WithArgs(pq.Array([]string{"romi", "bob", "carol"})).
+		WillReturnRows(sqlmock.NewRows(recipientColumns).
+			AddRow("bob", nil, "bob@example.com", "", pq.StringArray{"EMAIL"}, now, now))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(key\)\)`).
+		WithArgs(pq.Array([]string{"rate_limit:NEWS:bob", "rate_limit:NEWS:romi"})).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT keys.recipient AS applies_to, rules.\* FROM unnest\(\$1::text\[\], \$2::text\[\]\)`).
+		WithArgs(pq.Array([]string{"romi", "bob"}), pq.Array([]string{"NEWS", "NEWS"})).
+		WillReturnRows(sqlmock.NewRows(append([]string{"applies_to"}, ruleColumns...)).
+			AddRow("romi", "window", "NEWS", 5, 3600.0, "SLIDING_WINDOW", 0, 0.0, "", "").
+			AddRow("romi", "bucket", "NEWS", 5, 3600.0, "TOKEN_BUCKET", 0, 0.0, "", "").
+			AddRow("bob", "window", "NEWS", 5, 3600.0, "SLIDING_WINDOW", 0, 0.0, "", "").
+			AddRow("bob", "bucket", "NEWS", 5, 3600.0, "TOKEN_BUCKET", 0, 0.0, "", ""))
+	mock.ExpectQuery(`SELECT notifications.recipient, notifications.notification_type, notifications.created_at FROM unnest`).
+		WithArgs(pq.Array([]string{"romi", "bob"}), pq.Array([]string{"NEWS", "NEWS"}), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"recipient", "notification_type", "created_at"}).
+			AddRow("romi", "NEWS", now.Add(-time.Minute)))
+	mock.ExpectQuery(`SELECT token_buckets.\* FROM unnest`).
+		WithArgs(pq.Array([]string{"bucket", "bucket"}), pq.Array([]string{"romi", "bob"})).
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "recipient", "tokens", "updated_at"}).
+			AddRow("bucket", "romi", 3.0, now))
+	mock.ExpectExec(`INSERT INTO notification_service.notifications .* FROM sent`).
+		WithArgs(pq.Array([]string{"romi", "romi", "bob"}), pq.Array([]string{"NEWS", "NEWS", "NEWS"}), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 3))
+	mock.ExpectExec(`INSERT INTO notification_service.token_buckets .* FROM unnest`).
+		WithArgs(pq.Array([]string{"bucket", "bucket"}), pq.Array([]string{"romi", "bob"}), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+		WithArgs(pq.Array([]string{"romi", "romi", "bob"}), pq.Array([]string{"NEWS", "NEWS", "NEWS"}),
+			pq.Array([]string{"TELEGRAM", "TELEGRAM", "EMAIL"}), pq.Array([]string{"romi", "romi", "bob@example.com"}),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			pq.Array([]string{"QUEUED", "QUEUED", "QUEUED"}), sqlmock.AnyArg(), pq.Array([]string{"normal", "normal", "normal"}),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), types.Accepted).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "channel", "status"}).
+			AddRow("n-1", "TELEGRAM", "QUEUED").
+			AddRow("n-2", "TELEGRAM", "QUEUED").
+			AddRow("n-3", "EMAIL", "QUEUED"))
+	mock.ExpectCommit()
+
+	svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}, &fakeSender{channel: types.Email}))
+	results, err := svc.SendBatch(context.Background(), []types.InputInfo{
+		{Recipient: "romi", NotificationGroup: types.News},
+		{Recipient: "romi", NotificationGroup: types.News},
+		{Recipient: "bob", NotificationGroup: types.News},
+		{Recipient: "carol", NotificationGroup: types.News},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 4) {
+		assert.Equal(t, types.BatchResult{Index: 2, Status: types.BatchSent, ID: "n-3", Recipient: "bob", Channel: types.Email}, results[2])
+		assert.Equal(t, types.BatchRejected, results[3].Status)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
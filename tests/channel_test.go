@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+type fakeSender struct {
+	channel types.Channel
+	sent    []types.Message
+	err     error
+	mu      sync.Mutex
+}
+
+func (f *fakeSender) Channel() types.Channel {
+	return f.channel
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg types.Message) (types.Receipt, error) {
+	if f.err != nil {
+		return types.Receipt{}, f.err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, msg)
+	return types.Receipt{Channel: f.channel, Reference: "ref"}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	telegram := &fakeSender{channel: types.Telegram}
+	email := &fakeSender{channel: types.Email}
+	registry := service.NewRegistry(types.Telegram, telegram, email)
+
+	testCases := []struct {
+		name          string
+		channel       types.Channel
+		expected      service.Sender
+		expectedError bool
+	}{
+		{name: "Default Channel", channel: "", expected: telegram},
+		{name: "Explicit Channel", channel: types.Email, expected: email},
+		{name: "Unregistered Channel", channel: types.Webhook, expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sender, err := registry.Sender(tc.channel)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Same(t, tc.expected, sender)
+		})
+	}
+
+	assert.Equal(t, []types.Channel{types.Email, types.Telegram}, registry.Channels())
+}
+
+func TestSendNotificationRoutesToChannel(t *testing.T) {
+	testCases := []struct {
+		name            string
+		channel         types.Channel
+		expectedChannel types.Channel
+	}{
+		{name: "Requested Channel", channel: types.Email, expectedChannel: types.Email},
+		{name: "Default Channel", channel: "", expectedChannel: types.Telegram},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Error creating mock database: %v", err)
+			}
+			defer mockDB.Close()
+			db := sqlx.NewDb(mockDB, "sqlmock")
+			logger := zap.NewNop()
+
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+				WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+				WithArgs("recipient").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			expectRateLimitLock(mock)
+			mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
+					AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "STATUS", 10, 3600.00))
+			mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).
+				WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+			mock.ExpectExec(`INSERT INTO notification_service.notifications`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+				WithArgs("recipient", types.Status, tc.expectedChannel, "recipient", "m-1", "Title", "Body", "",
+					nil, "", types.Queued, "", sqlmock.AnyArg(), types.Accepted, types.Normal).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "channel"}).AddRow("2b1f", tc.expectedChannel))
+			mock.ExpectCommit()
+
+			telegram := &fakeSender{channel: types.Telegram}
+			email := &fakeSender{channel: types.Email}
+			svc := service.NewNotificationService(logger, &d.DBConnector{DB: db, Logger: logger},
+				service.NewRegistry(types.Telegram, telegram, email))
+
+			out, err := svc.SendNotification(context.Background(), types.InputInfo{
+				Recipient:         "recipient",
+				NotificationGroup: types.Status,
+				Channel:           tc.channel,
+				MessageID:         "m-1",
+				Title:             "Title",
+				Body:              "Body",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "2b1f", out.ID)
+			assert.Equal(t, tc.expectedChannel, out.Channel)
+			assert.Equal(t, "m-1", out.MessageID)
+			assert.Empty(t, telegram.sent, "delivery is left to the workers")
+			assert.Empty(t, email.sent, "delivery is left to the workers")
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("Unregistered Webhook", func(t *testing.T) {
+		store := newMemStore()
+		webhook := &fakeSender{channel: types.Webhook}
+		svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Webhook, webhook))
+
+		for _, channel := range []types.Channel{"", types.Webhook} {
+			_, err := svc.SendNotification(context.Background(), types.InputInfo{
+				Recipient: "http://169.254.169.254/latest/meta-data", NotificationGroup: types.Status, Channel: channel})
+			assert.ErrorIs(t, err, service.ErrUnregisteredWebhook)
+		}
+		assert.Empty(t, store.outbox)
+
+		// registered recipients are called on their own webhook URL
+		store.recipients["billing"] = types.Recipient{ID: "billing", WebhookURL: "https://hooks.example.com/billing"}
+		out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "billing", NotificationGroup: types.Status})
+		assert.NoError(t, err)
+		assert.Equal(t, types.Webhook, out.Channel)
+		assert.Equal(t, "https://hooks.example.com/billing", store.outbox[0].Address)
+	})
+}
+
+func TestMessageText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      types.Message
+		expected string
+	}{
+		{name: "Title And Body", msg: types.Message{Title: "Title", Body: "Body"}, expected: "Title\n\nBody"},
+		{name: "Body Only", msg: types.Message{Body: "Body"}, expected: "Body"},
+		{name: "Title Only", msg: types.Message{Title: "Title"}, expected: "Title"},
+		{name: "No Content", msg: types.Message{Group: types.News}, expected: "New NEWS notification"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.msg.Text())
+		})
+	}
+}
@@ -0,0 +1,806 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+// memStore is an in-memory Database for the service paths of a send. It yields the
+// processor between every read and write so unsynchronized callers interleave.
+// Database methods the service paths under test do not call fail with errNotImplemented.
+type memStore struct {
+	rules []types.RateLimitRule
+
+	mu      sync.Mutex
+	sent    map[string][]time.Time
+	buckets map[string]types.Bucket
+	outbox  []types.OutboxMessage
+	dead    []types.DeadLetter
+	limited []types.OutboxMessage
+	keys    map[string]types.IdempotencyKey
+	// members holds the static members of every segment, broadcasts the broadcasts by ID
+	members    map[string][]string
+	broadcasts map[string]types.Broadcast
+	// recipients holds the recipients GetRecipient knows, scheduled the scheduled notifications by ID
+	recipients map[string]types.Recipient
+	scheduled  map[string]types.ScheduledNotification
+	// prefs holds the preferences by recipient and type, digests the digests by ID
+	prefs   map[string]types.Preference
+	digests map[string]types.Digest
+	// templates holds every version of the templates, in creation order
+	templates []types.Template
+	// lockSets holds the distinct keys of every WithLocks call, in call order
+	lockSets [][]string
+	locks    sync.Map
+}
+
+var _ d.Database = (*memStore)(nil)
+
+func newMemStore(rules ...types.RateLimitRule) *memStore {
+	return &memStore{rules: rules, sent: map[string][]time.Time{}, buckets: map[string]types.Bucket{},
+		keys: map[string]types.IdempotencyKey{}, members: map[string][]string{}, broadcasts: map[string]types.Broadcast{},
+		recipients: map[string]types.Recipient{}, scheduled: map[string]types.ScheduledNotification{}, prefs: map[string]types.Preference{},
+		digests: map[string]types.Digest{}}
+}
+
+func (m *memStore) WithLock(ctx context.Context, key string, fn func(d.Database) error) error {
+	l, _ := m.locks.LoadOrStore(key, &sync.Mutex{})
+	l.(*sync.Mutex).Lock()
+	defer l.(*sync.Mutex).Unlock()
+	return fn(m)
+}
+
+func (m *memStore) WithLocks(ctx context.Context, keys []string, fn func(d.Database) error) error {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	m.mu.Lock()
+	m.lockSets = append(m.lockSets, sorted)
+	m.mu.Unlock()
+	for _, key := range sorted {
+		l, _ := m.locks.LoadOrStore(key, &sync.Mutex{})
+		l.(*sync.Mutex).Lock()
+		defer l.(*sync.Mutex).Unlock()
+	}
+	return fn(m)
+}
+
+func (m *memStore) ListPreferencesOf(ctx context.Context, recipients []string) ([]types.Preference, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefs := []types.Preference{}
+	for _, p := range m.prefs {
+		if slices.Contains(recipients, p.Recipient) {
+			prefs = append(prefs, p)
+		}
+	}
+	return prefs, nil
+}
+
+func (m *memStore) GetRecipients(ctx context.Context, ids []string) ([]types.Recipient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recipients := []types.Recipient{}
+	for _, id := range ids {
+		if r, ok := m.recipients[id]; ok {
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients, nil
+}
+
+func (m *memStore) GetPreference(ctx context.Context, recipient string, nType types.NotificationType) (types.Preference, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.prefs[recipient+string(nType)]
+	if !ok {
+		return types.Preference{}, d.ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *memStore) GetRecipient(ctx context.Context, id string) (types.Recipient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.recipients[id]
+	if !ok {
+		return types.Recipient{}, d.ErrNotFound
+	}
+	return r, nil
+}
+
+func (m *memStore) GetRateLimitRules(context.Context, types.NotificationType, string) ([]types.RateLimitRule, error) {
+	return m.rules, nil
+}
+
+func (m *memStore) GetNotificationsSince(ctx context.Context, in types.InputInfo, since time.Time) ([]time.Time, error) {
+	runtime.Gosched()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := []time.Time{}
+	for _, at := range m.sent[in.Recipient+string(in.NotificationGroup)] {
+		if at.After(since) {
+			sent = append(sent, at)
+		}
+	}
+	return sent, nil
+}
+
+func (m *memStore) RecordNotification(ctx context.Context, in *types.InputInfo, sentAt time.Time) error {
+	runtime.Gosched()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := in.Recipient + string(in.NotificationGroup)
+	m.sent[key] = append(m.sent[key], sentAt)
+	return nil
+}
+
+func (m *memStore) GetBucket(ctx context.Context, ruleID, recipient string) (types.Bucket, error) {
+	runtime.Gosched()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[ruleID+recipient]
+	if !ok {
+		return types.Bucket{}, d.ErrNotFound
+	}
+	return b, nil
+}
+
+func (m *memStore) SaveBucket(ctx context.Context, b types.Bucket) error {
+	runtime.Gosched()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[b.RuleID+b.Recipient] = b
+	return nil
+}
+
+func (m *memStore) GetRateLimitRulesOf(ctx context.Context, keys []types.LimitKey) (map[types.LimitKey][]types.RateLimitRule, error) {
+	rules := make(map[types.LimitKey][]types.RateLimitRule, len(keys))
+	for _, key := range keys {
+		rules[key] = m.rules
+	}
+	return rules, nil
+}
+
+func (m *memStore) GetNotificationsSinceOf(ctx context.Context, keys []types.LimitKey, since time.Time) ([]types.SentNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := []types.SentNotification{}
+	for _, key := range keys {
+		for _, at := range m.sent[key.Recipient+string(key.NotificationType)] {
+			if at.After(since) {
+				sent = append(sent, types.SentNotification{Recipient: key.Recipient, NotificationType: key.NotificationType, CreatedAt: at})
+			}
+		}
+	}
+	return sent, nil
+}
+
+func (m *memStore) RecordNotifications(ctx context.Context, sent []types.SentNotification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range sent {
+		key := n.Recipient + string(n.NotificationType)
+		m.sent[key] = append(m.sent[key], n.CreatedAt)
+	}
+	return nil
+}
+
+func (m *memStore) GetBucketsOf(ctx context.Context, ruleIDs, recipients []string) ([]types.Bucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buckets := []types.Bucket{}
+	for i := range ruleIDs {
+		if b, ok := m.buckets[ruleIDs[i]+recipients[i]]; ok {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets, nil
+}
+
+func (m *memStore) SaveBuckets(ctx context.Context, buckets []types.Bucket) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range buckets {
+		m.buckets[b.RuleID+b.Recipient] = b
+	}
+	return nil
+}
+
+func (m *memStore) EnqueueNotification(ctx context.Context, o types.OutboxMessage) (types.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	o.ID = fmt.Sprintf("n-%d", len(m.outbox)+1)
+	o.Status, o.AvailableAt, o.CreatedAt, o.UpdatedAt = types.Queued, now, now, now
+	m.outbox = append(m.outbox, o)
+	return o, nil
+}
+
+func (m *memStore) RecordRateLimited(ctx context.Context, o types.OutboxMessage, reason string) (types.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o.ID = fmt.Sprintf("rl-%d", len(m.limited)+1)
+	o.Status, o.LastError = types.RateLimited, reason
+	m.limited = append(m.limited, o)
+	return o, nil
+}
+
+func (m *memStore) InsertNotifications(ctx context.Context, batch []types.OutboxMessage) ([]types.OutboxMessage, error) {
+	inserted := make([]types.OutboxMessage, 0, len(batch))
+	for _, o := range batch {
+		if o.Status == types.RateLimited {
+			limited, _ := m.RecordRateLimited(ctx, o, o.LastError)
+			inserted = append(inserted, limited)
+			continue
+		}
+		queued, _ := m.EnqueueNotification(ctx, o)
+		inserted = append(inserted, queued)
+	}
+	return inserted, nil
+}
+
+func (m *memStore) ClaimNotifications(ctx context.Context, limit int, lease time.Duration) ([]types.OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	claimed := []types.OutboxMessage{}
+	for _, priority := range types.ValidPriorities {
+		for i := range m.outbox {
+			o := &m.outbox[i]
+			if len(claimed) == limit || o.Priority.OrNormal() != priority || o.AvailableAt.After(now) ||
+				(o.Status != types.Queued && o.Status != types.Sending) {
+				continue
+			}
+			o.Status, o.AvailableAt = types.Sending, now.Add(lease)
+			o.Attempts++
+			claimed = append(claimed, *o)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *memStore) MarkDelivered(ctx context.Context, id, reference string) error {
+	return m.update(id, func(o *types.OutboxMessage) {
+		o.Status, o.Reference = types.Delivered, reference
+	})
+}
+
+func (m *memStore) RetryNotification(ctx context.Context, id, reason string, at time.Time) error {
+	return m.update(id, func(o *types.OutboxMessage) {
+		o.Status, o.LastError, o.AvailableAt = types.Queued, reason, at
+	})
+}
+
+func (m *memStore) MarkFailed(ctx context.Context, id, reason string) error {
+	return m.update(id, func(o *types.OutboxMessage) {
+		o.Status, o.LastError = types.Failed, reason
+		m.dead = append(m.dead, types.DeadLetter{
+			ID:                fmt.Sprintf("dl-%d", len(m.dead)+1),
+			NotificationID:    o.ID,
+			Recipient:         o.Recipient,
+			NotificationGroup: o.NotificationGroup,
+			Channel:           o.Channel,
+			Attempts:          o.Attempts,
+			Reason:            reason,
+		})
+	})
+}
+
+func (m *memStore) GetIdempotencyKey(ctx context.Context, key string) (types.IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[key]
+	if !ok || !k.ExpiresAt.After(time.Now()) {
+		return types.IdempotencyKey{}, d.ErrNotFound
+	}
+	return k, nil
+}
+
+func (m *memStore) SaveIdempotencyKey(ctx context.Context, k types.IdempotencyKey) error {
+	runtime.Gosched()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[k.Key] = k
+	return nil
+}
+
+func (m *memStore) ListSegmentMembers(ctx context.Context, segmentID, after string, limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := slices.Clone(m.members[segmentID])
+	slices.Sort(members)
+	page := []string{}
+	for _, recipient := range members {
+		if recipient > after && len(page) < limit {
+			page = append(page, recipient)
+		}
+	}
+	return page, nil
+}
+
+func (m *memStore) CreateBroadcast(ctx context.Context, b types.Broadcast) (types.Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.members[b.SegmentID]; !ok {
+		return types.Broadcast{}, d.ErrNotFound
+	}
+	b.ID = fmt.Sprintf("bc-%d", len(m.broadcasts)+1)
+	b.Status, b.Total, b.Summary = types.BroadcastRunning, len(m.members[b.SegmentID]), types.BatchSummary{}
+	m.broadcasts[b.ID] = b
+	return b, nil
+}
+
+func (m *memStore) GetBroadcast(ctx context.Context, id string) (types.Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.broadcasts[id]
+	if !ok {
+		return types.Broadcast{}, d.ErrNotFound
+	}
+	return b, nil
+}
+
+func (m *memStore) ClaimBroadcast(ctx context.Context, lease time.Duration) (types.Broadcast, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	for id, b := range m.broadcasts {
+		if b.Status == types.BroadcastRunning && !b.AvailableAt.After(now) {
+			b.AvailableAt = now.Add(lease)
+			m.broadcasts[id] = b
+			return b, nil
+		}
+	}
+	return types.Broadcast{}, d.ErrNotFound
+}
+
+func (m *memStore) SaveBroadcastProgress(ctx context.Context, b types.Broadcast) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.AvailableAt = time.Now().UTC()
+	m.broadcasts[b.ID] = b
+	return nil
+}
+
+func (m *memStore) ScheduleNotification(ctx context.Context, sn types.ScheduledNotification) (types.ScheduledNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sn.ID = fmt.Sprintf("sn-%d", len(m.scheduled)+1)
+	sn.Status, sn.AvailableAt = types.Scheduled, sn.SendAt.UTC()
+	m.scheduled[sn.ID] = sn
+	return sn, nil
+}
+
+func (m *memStore) GetScheduledNotification(ctx context.Context, id string) (types.ScheduledNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sn, ok := m.scheduled[id]
+	if !ok {
+		return types.ScheduledNotification{}, d.ErrNotFound
+	}
+	return sn, nil
+}
+
+func (m *memStore) CancelScheduledNotification(ctx context.Context, id string) (types.ScheduledNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sn, ok := m.scheduled[id]
+	if !ok || sn.Status != types.Scheduled {
+		return types.ScheduledNotification{}, d.ErrNotFound
+	}
+	sn.Status = types.Cancelled
+	m.scheduled[id] = sn
+	return sn, nil
+}
+
+func (m *memStore) ClaimScheduledNotification(ctx context.Context, lease time.Duration) (types.ScheduledNotification, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	for id, sn := range m.scheduled {
+		if sn.Status == types.Scheduled && !sn.AvailableAt.After(now) {
+			sn.AvailableAt = now.Add(lease)
+			m.scheduled[id] = sn
+			return sn, nil
+		}
+	}
+	return types.ScheduledNotification{}, d.ErrNotFound
+}
+
+func (m *memStore) MarkDispatched(ctx context.Context, sn types.ScheduledNotification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sn.Status = types.Dispatched
+	m.scheduled[sn.ID] = sn
+	return nil
+}
+
+func (m *memStore) AddToDigest(ctx context.Context, dg types.Digest) (types.Digest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, pending := range m.digests {
+		if pending.Status == types.DigestPending && pending.Recipient == dg.Recipient && pending.NotificationGroup == dg.NotificationGroup {
+			pending.Items = append(pending.Items, dg.Items...)
+			pending.ItemCount = len(pending.Items)
+			m.digests[id] = pending
+			return pending, nil
+		}
+	}
+	dg.ID = fmt.Sprintf("dg-%d", len(m.digests)+1)
+	dg.Status, dg.ItemCount, dg.AvailableAt = types.DigestPending, len(dg.Items), dg.DeliverAt.UTC()
+	m.digests[dg.ID] = dg
+	return dg, nil
+}
+
+func (m *memStore) GetDigest(ctx context.Context, id string) (types.Digest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dg, ok := m.digests[id]
+	if !ok {
+		return types.Digest{}, d.ErrNotFound
+	}
+	return dg, nil
+}
+
+func (m *memStore) ClaimDigest(ctx context.Context, lease time.Duration) (types.Digest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	for id, dg := range m.digests {
+		if dg.Status == types.DigestPending && !dg.AvailableAt.After(now) {
+			dg.AvailableAt = now.Add(lease)
+			m.digests[id] = dg
+			return dg, nil
+		}
+	}
+	return types.Digest{}, d.ErrNotFound
+}
+
+func (m *memStore) DeferDigest(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dg := m.digests[id]
+	dg.DeliverAt, dg.AvailableAt = at, at
+	m.digests[id] = dg
+	return nil
+}
+
+func (m *memStore) CloseDigest(ctx context.Context, dg types.Digest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.digests[dg.ID] = dg
+	return nil
+}
+
+func (m *memStore) CreateTemplate(ctx context.Context, tpl types.Template) (types.Template, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tpl.Version = 1
+	for _, existing := range m.templates {
+		if existing.Name == tpl.Name && existing.Locale == tpl.Locale {
+			tpl.Version = existing.Version + 1
+		}
+	}
+	tpl.ID = fmt.Sprintf("tpl-%d", len(m.templates)+1)
+	m.templates = append(m.templates, tpl)
+	return tpl, nil
+}
+
+func (m *memStore) GetTemplate(ctx context.Context, name, locale string, version int) (types.Template, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found types.Template
+	for _, tpl := range m.templates {
+		if tpl.Name == name && tpl.Locale == locale && (version == 0 || tpl.Version == version) {
+			found = tpl
+		}
+	}
+	if found.ID == "" {
+		return types.Template{}, d.ErrNotFound
+	}
+	return found, nil
+}
+
+func (m *memStore) update(id string, fn func(o *types.OutboxMessage)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].ID == id {
+			fn(&m.outbox[i])
+			return nil
+		}
+	}
+	return d.ErrNotFound
+}
+
+// errNotImplemented is returned by the Database methods the memStore tests do not need
+var errNotImplemented = errors.New("not implemented by memStore")
+
+func (m *memStore) GetNotification(context.Context, string) (types.OutboxMessage, error) {
+	return types.OutboxMessage{}, errNotImplemented
+}
+
+func (m *memStore) ListNotifications(context.Context, types.NotificationFilter) ([]types.OutboxMessage, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) ListDeadLetters(context.Context, types.Channel, string) ([]types.DeadLetter, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) GetDeadLetter(context.Context, string) (types.DeadLetter, error) {
+	return types.DeadLetter{}, errNotImplemented
+}
+
+func (m *memStore) RequeueDeadLetter(context.Context, string) (types.OutboxMessage, error) {
+	return types.OutboxMessage{}, errNotImplemented
+}
+
+func (m *memStore) ListRateLimitRules(context.Context, types.NotificationType, string, string) ([]types.RateLimitRule, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) GetRateLimitRule(context.Context, string) (types.RateLimitRule, error) {
+	return types.RateLimitRule{}, errNotImplemented
+}
+
+func (m *memStore) CreateRateLimitRule(context.Context, types.RateLimitRule) (types.RateLimitRule, error) {
+	return types.RateLimitRule{}, errNotImplemented
+}
+
+func (m *memStore) UpdateRateLimitRule(context.Context, types.RateLimitRule) (types.RateLimitRule, error) {
+	return types.RateLimitRule{}, errNotImplemented
+}
+
+func (m *memStore) DeleteRateLimitRule(context.Context, string) error {
+	return errNotImplemented
+}
+
+func (m *memStore) CreateRecipient(context.Context, types.Recipient) (types.Recipient, error) {
+	return types.Recipient{}, errNotImplemented
+}
+
+func (m *memStore) UpdateRecipient(context.Context, types.Recipient) (types.Recipient, error) {
+	return types.Recipient{}, errNotImplemented
+}
+
+func (m *memStore) DeleteRecipient(context.Context, string) error {
+	return errNotImplemented
+}
+
+func (m *memStore) ListPreferences(context.Context, string) ([]types.Preference, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) UpsertPreference(context.Context, types.Preference) (types.Preference, error) {
+	return types.Preference{}, errNotImplemented
+}
+
+func (m *memStore) OptOut(context.Context, string, types.NotificationType) error {
+	return errNotImplemented
+}
+
+func (m *memStore) ListSegments(context.Context) ([]types.Segment, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) GetSegment(context.Context, string) (types.Segment, error) {
+	return types.Segment{}, errNotImplemented
+}
+
+func (m *memStore) CreateSegment(context.Context, types.Segment) (types.Segment, error) {
+	return types.Segment{}, errNotImplemented
+}
+
+func (m *memStore) UpdateSegment(context.Context, types.Segment) (types.Segment, error) {
+	return types.Segment{}, errNotImplemented
+}
+
+func (m *memStore) DeleteSegment(context.Context, string) error {
+	return errNotImplemented
+}
+
+func (m *memStore) AddSegmentMember(context.Context, string, string) error {
+	return errNotImplemented
+}
+
+func (m *memStore) RemoveSegmentMember(context.Context, string, string) error {
+	return errNotImplemented
+}
+
+func (m *memStore) ListScheduledNotifications(context.Context, types.ScheduledFilter) ([]types.ScheduledNotification, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) ListTemplates(context.Context) ([]types.Template, error) {
+	return nil, errNotImplemented
+}
+
+func (m *memStore) ListTemplateVersions(context.Context, string, string) ([]types.Template, error) {
+	return nil, errNotImplemented
+}
+
+// deliverAll runs the outbox delivery until nothing is left to claim
+func deliverAll(t *testing.T, svc *service.NotificationService) {
+	for {
+		delivered, err := svc.DeliverNext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		if !delivered {
+			return
+		}
+	}
+}
+
+func TestConcurrentSendsNeverExceedLimit(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule types.RateLimitRule
+	}{
+		{name: "Sliding Window", rule: types.RateLimitRule{ID: "sliding", MaxCount: 5, Duration: 3600}},
+		{name: "Fixed Window", rule: types.RateLimitRule{ID: "fixed", Strategy: types.FixedWindow, MaxCount: 5, Duration: 86400 * 365}},
+		{name: "Token Bucket", rule: types.RateLimitRule{ID: "bucket", Strategy: types.TokenBucket, MaxCount: 5, Duration: 3600}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newMemStore(tc.rule)
+			sender := &fakeSender{channel: types.Telegram}
+			svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender))
+
+			const senders = 64
+			var wg sync.WaitGroup
+			errs := make(chan error, senders)
+			for i := 0; i < senders; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			accepted := 0
+			for err := range errs {
+				var rateLimitErr *service.RateLimitError
+				switch {
+				case err == nil:
+					accepted++
+				case !errors.As(err, &rateLimitErr):
+					t.Fatalf("unexpected error: %v", err)
+				default:
+					assert.NotEmpty(t, rateLimitErr.NotificationID)
+				}
+			}
+			assert.Equal(t, tc.rule.MaxCount, accepted)
+			assert.Len(t, store.sent["romi"+string(types.Marketing)], tc.rule.MaxCount)
+			assert.Len(t, store.outbox, tc.rule.MaxCount)
+			assert.Len(t, store.limited, senders-tc.rule.MaxCount)
+
+			deliverAll(t, svc)
+			assert.Len(t, sender.sent, tc.rule.MaxCount)
+		})
+	}
+}
+
+// TestSendNotificationHoldsRateLimitLock checks on the DBConnector that the rate limit is
+// read and consumed and the notification enqueued in the transaction holding the advisory
+// lock of the recipient, and that nothing of it is kept when a step fails
+func TestSendNotificationHoldsRateLimitLock(t *testing.T) {
+	for _, enqueueErr := range []error{nil, errors.New("connection reset")} {
+		name := "Commits"
+		if enqueueErr != nil {
+			name = "Rolls Back"
+		}
+		t.Run(name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Error creating mock database: %v", err)
+			}
+			defer mockDB.Close()
+			logger := zap.NewNop()
+
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+				WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectBegin()
+			mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+				WithArgs("rate_limit:MARKETING:romi").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+				WithArgs(types.Marketing, "romi").
+				WillReturnRows(sqlmock.NewRows(ruleColumns).
+					AddRow("bucket", "MARKETING", 5, 3600.0, "TOKEN_BUCKET", 0, 0.0, "", ""))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.token_buckets`).
+				WithArgs("bucket", "romi").
+				WillReturnRows(sqlmock.NewRows([]string{"rule_id"}))
+			mock.ExpectExec(`INSERT INTO notification_service.notifications`).
+				WithArgs("romi", types.Marketing, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.token_buckets`).
+				WithArgs("bucket", "romi").
+				WillReturnRows(sqlmock.NewRows([]string{"rule_id"}))
+			mock.ExpectExec(`INSERT INTO notification_service.token_buckets`).
+				WithArgs("bucket", "romi", 4.0, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			enqueue := mock.ExpectQuery(`INSERT INTO notification_service.outbox`)
+			if enqueueErr != nil {
+				enqueue.WillReturnError(enqueueErr)
+				mock.ExpectRollback()
+			} else {
+				enqueue.WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow("n-1", types.Queued))
+				mock.ExpectCommit()
+			}
+
+			svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+				service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+			out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+
+			if enqueueErr != nil {
+				assert.ErrorIs(t, err, enqueueErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "n-1", out.ID)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// TestConcurrentRequestsKeepTheirInput sends different recipients through one shared server
+// at the same time; run with -race to also check the service holds no per-request state.
+func TestConcurrentRequestsKeepTheirInput(t *testing.T) {
+	sender := &fakeSender{channel: types.Email}
+	svc := service.NewNotificationService(zap.NewNop(), newMemStore(), service.NewRegistry(types.Email, sender))
+	s := server.NewServer(context.Background(), svc)
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recipient := fmt.Sprintf("user-%d@example.com", i)
+			body := fmt.Sprintf(`{"recipient": %q, "group": "NEWS", "title": "title for %s"}`, recipient, recipient)
+			req := httptest.NewRequest(http.MethodPost, "/V1/notify", strings.NewReader(body))
+			rr := httptest.NewRecorder()
+			s.SendHandler(rr, req)
+
+			var out types.Output
+			assert.Equal(t, http.StatusAccepted, rr.Code)
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &out))
+			assert.Equal(t, recipient, out.Recipient)
+		}(i)
+	}
+	wg.Wait()
+
+	deliverAll(t, svc)
+	assert.Len(t, sender.sent, requests)
+	for _, msg := range sender.sent {
+		assert.Equal(t, msg.Recipient, msg.Address)
+		assert.Equal(t, "title for "+msg.Recipient, msg.Title)
+	}
+}
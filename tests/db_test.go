@@ -2,10 +2,10 @@ package tests
 
 import (
 	"context"
-	"database/sql/driver"
 	d "notification_service/db"
 	"notification_service/types"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
@@ -28,46 +28,56 @@ func TestRecordNotification(t *testing.T) {
 		Logger: logger,
 	}
 
-	testCases := []struct {
-		description string
-		counter     int
-		expectQuery string
-		expectArgs  []driver.Value
-	}{
-		{
-			description: "Counter = 0 (INSERT)",
-			counter:     0,
-			expectQuery: `INSERT INTO notification_service.notifications`,
-		},
-		{
-			description: "Counter != 0 (UPDATE)",
-			counter:     1,
-			expectQuery: `UPDATE notification_service.notifications`,
-		},
+	now := time.Now().UTC()
+	mock.ExpectExec(`DELETE FROM notification_service.notifications WHERE recipient = \$1 AND notification_type = \$2 AND created_at <= .* INSERT INTO notification_service.notifications`).
+		WithArgs("recipient", types.Marketing, 1, now, now).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = connector.RecordNotification(context.Background(), &types.InputInfo{
+		Recipient:         "recipient",
+		NotificationGroup: types.Marketing,
+	}, now)
+	if err != nil {
+		t.Fatalf("Error recording notification: %v", err)
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.description, func(t *testing.T) {
-			mock.ExpectExec(tc.expectQuery).
-				WithArgs(tc.expectArgs...).
-				WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
+	}
+}
 
-			err := connector.RecordNotification(context.Background(), &types.InputInfo{
-				Recipient:         "recipient",
-				NotificationGroup: "Marketing",
-			}, types.Notifications{
-				ID:               "id",
-				NotificationType: types.Marketing,
-				Counter:          tc.counter,
-				Recipient:        "recipient",
-			})
-			if err != nil {
-				t.Fatalf("Error recording notification: %v", err)
-			}
+func TestGetNotificationsSince(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+
+	connector := &d.DBConnector{
+		DB:     sqlx.NewDb(mockDB, "sqlmock"),
+		Logger: zap.NewNop(),
+	}
+
+	now := time.Now().UTC()
+	since := now.Add(-time.Hour)
+	mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).
+		WithArgs(types.Status, "recipient", since).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).
+			AddRow(now.Add(-30 * time.Minute)).
+			AddRow(now.Add(-time.Minute)))
+
+	sent, err := connector.GetNotificationsSince(context.Background(), types.InputInfo{
+		Recipient:         "recipient",
+		NotificationGroup: types.Status,
+	}, since)
+	if err != nil {
+		t.Fatalf("Error fetching notifications: %v", err)
+	}
+	if len(sent) != 2 {
+		t.Errorf("Expected 2 notifications, got %d", len(sent))
+	}
 
-			if err := mock.ExpectationsWereMet(); err != nil {
-				t.Errorf("Unfulfilled expectations: %v", err)
-			}
-		})
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %v", err)
 	}
 }
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestDigestSummary(t *testing.T) {
+	summary := service.DigestSummary(types.Digest{
+		Recipient:         "romi",
+		NotificationGroup: types.News,
+		Items: types.DigestItems{
+			{Recipient: "romi", NotificationGroup: types.News, Channel: types.Email, Title: "June newsletter", Body: "What's new"},
+			{Recipient: "romi", NotificationGroup: types.News, Title: "Price update"},
+			{Recipient: "romi", NotificationGroup: types.News, Body: "A new office", MessageID: "m-3"},
+		},
+	})
+
+	assert.Equal(t, "romi", summary.Recipient)
+	assert.Equal(t, types.News, summary.NotificationGroup)
+	assert.Equal(t, types.Email, summary.Channel)
+	assert.Equal(t, "3 news notifications", summary.Title)
+	assert.Equal(t, "- June newsletter: What's new\n- Price update\n- A new office", summary.Body)
+	assert.Len(t, summary.Data["digest"], 3)
+}
+
+// makeDigestDue moves the delivery of a digest to the past
+func makeDigestDue(store *memStore, id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	dg := store.digests[id]
+	dg.DeliverAt = time.Now().UTC().Add(-time.Second)
+	dg.AvailableAt = dg.DeliverAt
+	store.digests[id] = dg
+}
+
+func TestDigestMode(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 1, Duration: 3600}
+	store := newMemStore(rule)
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+	svc.Digests = map[types.NotificationType]service.DigestPolicy{types.News: {}}
+	s := server.NewServer(context.Background(), svc)
+
+	assert.Equal(t, http.StatusAccepted, postNotify(s, "", `{"recipient": "romi", "group": "news", "title": "Issue 1"}`).Code)
+
+	var digested []types.Output
+	for _, title := range []string{"Issue 2", "Issue 3"} {
+		rr := postNotify(s, "", `{"recipient": "romi", "group": "news", "title": "`+title+`"}`)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		var out types.Output
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&out))
+		digested = append(digested, out)
+	}
+	assert.Equal(t, digested[0].ID, digested[1].ID)
+	if assert.NotNil(t, digested[0].SendAt) {
+		assert.True(t, digested[0].SendAt.After(time.Now()), "the digest is sent when the rate limit resets")
+	}
+	assert.Len(t, store.outbox, 1)
+	assert.Empty(t, store.limited, "digested notifications are not recorded as rate limited")
+
+	id := digested[0].ID
+	t.Run("Not Due", func(t *testing.T) {
+		delivered, err := svc.DeliverDigest(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, delivered)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		results, err := svc.SendBatch(context.Background(), []types.InputInfo{
+			{Recipient: "romi", NotificationGroup: types.News, Title: "Issue 4"},
+			{Recipient: "ines", NotificationGroup: types.News, Title: "Issue 4"},
+		})
+		assert.NoError(t, err)
+		if assert.Len(t, results, 2) {
+			assert.Equal(t, types.BatchDigested, results[0].Status)
+			assert.Equal(t, id, results[0].ID)
+			assert.NotNil(t, results[0].SendAt)
+			assert.Equal(t, types.BatchSent, results[1].Status)
+		}
+		assert.Equal(t, 3, store.digests[id].ItemCount)
+	})
+
+	t.Run("Deliver", func(t *testing.T) {
+		makeDigestDue(store, id)
+		sent := len(store.sent["romi"+string(types.News)])
+		delivered, err := svc.DeliverDigest(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, delivered)
+		assert.Len(t, store.sent["romi"+string(types.News)], sent, "the summary is not counted against the rate limit")
+
+		if assert.Len(t, store.outbox, 3) {
+			summary := store.outbox[2]
+			assert.Equal(t, "romi", summary.Recipient)
+			assert.Equal(t, "3 news notifications", summary.Title)
+			assert.Equal(t, "- Issue 2\n- Issue 3\n- Issue 4", summary.Body)
+		}
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/digests/"+id, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		s.GetDigestHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var dg types.Digest
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&dg))
+		assert.Equal(t, types.DigestSent, dg.Status)
+		assert.Equal(t, store.outbox[2].ID, dg.NotificationID)
+		assert.Len(t, dg.Items, 3)
+	})
+
+	t.Run("New Digest After Delivery", func(t *testing.T) {
+		out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.News, Title: "Issue 5"})
+		assert.NoError(t, err)
+		assert.NotEqual(t, id, out.ID)
+		assert.Equal(t, 1, store.digests[out.ID].ItemCount)
+	})
+
+	t.Run("Opted Out Since", func(t *testing.T) {
+		out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "ines", NotificationGroup: types.News, Title: "Issue 5"})
+		assert.NoError(t, err)
+		store.prefs["ines"+string(types.News)] = types.Preference{Recipient: "ines", NotificationType: types.News, OptedOut: true}
+		makeDigestDue(store, out.ID)
+
+		delivered, err := svc.DeliverDigest(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, delivered)
+		assert.Equal(t, types.DigestDropped, store.digests[out.ID].Status)
+		assert.Len(t, store.outbox, 3)
+	})
+}
+
+func TestDigestTime(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.Marketing, MaxCount: 1, Duration: 3600}
+	store := newMemStore(rule)
+	chatID := int64(42)
+	store.recipients["romi"] = types.Recipient{ID: "romi", TelegramChatID: &chatID, Timezone: "America/New_York"}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+	svc.Digests = map[types.NotificationType]service.DigestPolicy{types.Marketing: {At: "18:00"}}
+
+	_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+	assert.NoError(t, err)
+	out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+	assert.NoError(t, err)
+
+	newYork := store.recipients["romi"].Location()
+	expected, err := service.NextClock("18:00", time.Now().In(newYork))
+	assert.NoError(t, err)
+	if assert.NotNil(t, out.SendAt) {
+		assert.True(t, expected.Equal(*out.SendAt), "expected %v, got %v", expected, *out.SendAt)
+		assert.Equal(t, 18, out.SendAt.In(newYork).Hour())
+	}
+}
@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"notification_service/service"
+	"notification_service/types"
+)
+
+type receivedEmail struct {
+	from string
+	to   []string
+	auth string
+	data string
+}
+
+// fakeSMTPServer is a minimal in-process SMTP server that records every accepted email
+type fakeSMTPServer struct {
+	listener net.Listener
+	received chan receivedEmail
+	rejectTo string
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start fake SMTP server: %v", err)
+	}
+	s := &fakeSMTPServer{listener: l, received: make(chan receivedEmail, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+
+	var email receivedEmail
+	reply("220 localhost fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH PLAIN"):
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(line[len("AUTH PLAIN"):]))
+			email.auth = string(decoded)
+			reply("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			email.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to := strings.Trim(line[len("RCPT TO:"):], "<> ")
+			if to == s.rejectTo {
+				reply("550 5.1.1 No such user")
+				continue
+			}
+			email.to = append(email.to, to)
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			email.data = data.String()
+			s.received <- email
+			email = receivedEmail{}
+			reply("250 OK queued")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestEmailSender(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	server.rejectTo = "unknown@example.com"
+
+	sender := service.NewEmailSender(types.SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Username: "user",
+		Password: "secret",
+		From:     "Notifications <noreply@example.com>",
+		TLSMode:  types.SMTPTLSNone,
+	}, zap.NewNop())
+
+	t.Run("Plain Text", func(t *testing.T) {
+		receipt, err := sender.Send(context.Background(), types.Message{
+			Recipient: "romi",
+			Address:   "example@example.com",
+			Group:     types.Status,
+			Title:     "Service degraded",
+			Body:      "We are looking into it",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, types.Email, receipt.Channel)
+
+		email := <-server.received
+		assert.Equal(t, "noreply@example.com", email.from)
+		assert.Equal(t, []string{"example@example.com"}, email.to)
+		assert.Equal(t, "\x00user\x00secret", email.auth)
+
+		msg, err := mail.ReadMessage(strings.NewReader(email.data))
+		assert.NoError(t, err)
+		assert.Equal(t, "Service degraded", msg.Header.Get("Subject"))
+		assert.Equal(t, receipt.Reference, msg.Header.Get("Message-ID"))
+		assert.Equal(t, "text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+		body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		assert.NoError(t, err)
+		assert.Equal(t, "We are looking into it", strings.TrimSpace(string(body)))
+	})
+
+	t.Run("HTML Alternative", func(t *testing.T) {
+		_, err := sender.Send(context.Background(), types.Message{
+			Address:  "example@example.com",
+			Group:    types.News,
+			Title:    "Ñews",
+			Body:     "plain version",
+			HTMLBody: "<p>html version</p>",
+		})
+		assert.NoError(t, err)
+
+		email := <-server.received
+		msg, err := mail.ReadMessage(strings.NewReader(email.data))
+		assert.NoError(t, err)
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Ñews", subject)
+
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		assert.Equal(t, "multipart/alternative", mediaType)
+
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		var parts []string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			content, err := io.ReadAll(part)
+			assert.NoError(t, err)
+			parts = append(parts, part.Header.Get("Content-Type")+"|"+string(content))
+		}
+		assert.Equal(t, []string{
+			"text/plain; charset=utf-8|plain version",
+			"text/html; charset=utf-8|<p>html version</p>",
+		}, parts)
+	})
+
+	t.Run("Rejected Recipient", func(t *testing.T) {
+		_, err := sender.Send(context.Background(), types.Message{Address: "unknown@example.com", Group: types.News})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "RCPT TO rejected")
+	})
+
+	t.Run("Invalid Address", func(t *testing.T) {
+		_, err := sender.Send(context.Background(), types.Message{Address: "romi", Group: types.News})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid email address")
+	})
+
+	t.Run("StartTLS Not Supported", func(t *testing.T) {
+		tlsSender := service.NewEmailSender(types.SMTPConfig{
+			Host: "127.0.0.1",
+			Port: server.port(),
+			From: "noreply@example.com",
+		}, zap.NewNop())
+		_, err := tlsSender.Send(context.Background(), types.Message{Address: "example@example.com", Group: types.News})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not support STARTTLS")
+	})
+
+	t.Run("Unreachable Server", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		down := service.NewEmailSender(types.SMTPConfig{Host: "127.0.0.1", Port: port, From: "noreply@example.com", TLSMode: types.SMTPTLSNone}, zap.NewNop())
+		_, err = down.Send(context.Background(), types.Message{Address: "example@example.com", Group: types.News})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "could not connect to SMTP server")
+	})
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+// postNotify sends body to the handler of s with the given idempotency key
+func postNotify(s server.Server, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/V1/notify", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(server.IdempotencyKeyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	s.SendHandler(rr, req)
+	return rr
+}
+
+func TestSendHandlerIdempotencyKey(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 1, Duration: 3600}
+	store := newMemStore(rule)
+	s := server.NewServer(context.Background(),
+		service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram})))
+
+	first := postNotify(s, "order-1", `{"recipient": "romi", "group": "news", "title": "Shipped"}`)
+	assert.Equal(t, http.StatusAccepted, first.Code)
+	assert.Empty(t, first.Header().Get(server.IdempotentReplayedHeader))
+
+	t.Run("Replay", func(t *testing.T) {
+		// the group is normalized before the payload is compared
+		rr := postNotify(s, "order-1", `{"recipient": "romi", "group": "NEWS", "title": "Shipped"}`)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Equal(t, "true", rr.Header().Get(server.IdempotentReplayedHeader))
+		assert.Equal(t, first.Body.String(), rr.Body.String())
+		assert.Len(t, store.outbox, 1)
+		assert.Len(t, store.sent["romi"+string(types.News)], 1)
+	})
+
+	t.Run("Different Payload", func(t *testing.T) {
+		rr := postNotify(s, "order-1", `{"recipient": "romi", "group": "NEWS", "title": "Delivered"}`)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Len(t, store.outbox, 1)
+	})
+
+	t.Run("Rate Limited Replay", func(t *testing.T) {
+		limited := postNotify(s, "order-2", `{"recipient": "romi", "group": "NEWS", "title": "Delivered"}`)
+		assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+
+		rr := postNotify(s, "order-2", `{"recipient": "romi", "group": "NEWS", "title": "Delivered"}`)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "true", rr.Header().Get(server.IdempotentReplayedHeader))
+		assert.Equal(t, limited.Header().Get("Retry-After"), rr.Header().Get("Retry-After"))
+		assert.Equal(t, limited.Body.String(), rr.Body.String())
+		assert.Len(t, store.limited, 1)
+	})
+
+	t.Run("Without Key", func(t *testing.T) {
+		rr := postNotify(s, "", `{"recipient": "romi", "group": "NEWS", "title": "Shipped"}`)
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Len(t, store.limited, 2)
+	})
+
+	t.Run("Key Too Long", func(t *testing.T) {
+		rr := postNotify(s, strings.Repeat("k", 256), `{"recipient": "romi", "group": "NEWS"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	})
+}
+
+func TestConcurrentIdempotentRetries(t *testing.T) {
+	store := newMemStore()
+	s := server.NewServer(context.Background(),
+		service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram})))
+
+	const retries = 16
+	var wg sync.WaitGroup
+	bodies := make(chan string, retries)
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := postNotify(s, "order-1", `{"recipient": "romi", "group": "NEWS"}`)
+			assert.Equal(t, http.StatusAccepted, rr.Code)
+			bodies <- rr.Body.String()
+		}()
+	}
+	wg.Wait()
+	close(bodies)
+
+	first := <-bodies
+	for body := range bodies {
+		assert.Equal(t, first, body)
+	}
+	assert.Len(t, store.outbox, 1)
+}
+
+func TestOnceKeepsNoServerErrors(t *testing.T) {
+	store := newMemStore()
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram))
+	svc.IdempotencyTTL = time.Hour
+
+	runs := 0
+	fn := func(d.Database) types.StoredResponse {
+		runs++
+		if runs == 1 {
+			return types.StoredResponse{StatusCode: http.StatusInternalServerError, Body: []byte(`{}`)}
+		}
+		return types.StoredResponse{StatusCode: http.StatusAccepted, Body: []byte(`{}`)}
+	}
+
+	for i, expected := range []int{http.StatusInternalServerError, http.StatusAccepted, http.StatusAccepted} {
+		res, replayed, err := svc.Once(context.Background(), "order-1", "hash", fn)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res.StatusCode)
+		assert.Equal(t, i == 2, replayed)
+	}
+	assert.Equal(t, 2, runs)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), store.keys["order-1"].ExpiresAt, time.Minute)
+}
+
+// TestIdempotentSendCommitsWithKey checks that the notification is enqueued in the
+// transaction that saves its idempotency key, so it is not sent when the key is not saved
+func TestIdempotentSendCommitsWithKey(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WithArgs("idempotency:order-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.idempotency_keys`).
+		WillReturnRows(sqlmock.NewRows([]string{"key"}))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+		WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	// the rate limit lock is taken in the same transaction
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).
+		WithArgs("rate_limit:NEWS:romi").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+		WillReturnRows(sqlmock.NewRows(ruleColumns))
+	mock.ExpectExec(`INSERT INTO notification_service.notifications`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow("n-1", types.Queued))
+	mock.ExpectExec(`INSERT INTO notification_service.idempotency_keys`).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger,
+		&d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram})))
+	rr := postNotify(s, "order-1", `{"recipient": "romi", "group": "news", "title": "Shipped"}`)
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), "could not save idempotency key")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
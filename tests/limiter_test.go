@@ -0,0 +1,291 @@
+package tests
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestEvaluateSlidingWindowBoundaries(t *testing.T) {
+	rule := types.RateLimitRule{NotificationType: types.Status, MaxCount: 2, Duration: 60}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	window := time.Minute
+
+	testCases := []struct {
+		name              string
+		sent              []time.Time
+		expectedAllowed   bool
+		expectedRemaining int
+		expectedResetAt   time.Time
+	}{
+		{
+			name:              "Empty History",
+			expectedAllowed:   true,
+			expectedRemaining: 2,
+			expectedResetAt:   now,
+		},
+		{
+			name:              "Send Exactly One Window Ago Is Expired",
+			sent:              []time.Time{now.Add(-window), now.Add(-window)},
+			expectedAllowed:   true,
+			expectedRemaining: 2,
+			expectedResetAt:   now,
+		},
+		{
+			name:              "Send Just Inside The Window Counts",
+			sent:              []time.Time{now.Add(-window + time.Nanosecond), now.Add(-time.Second)},
+			expectedAllowed:   false,
+			expectedRemaining: 0,
+			expectedResetAt:   now.Add(time.Nanosecond),
+		},
+		{
+			name:              "One Slot Left",
+			sent:              []time.Time{now.Add(-10 * time.Second)},
+			expectedAllowed:   true,
+			expectedRemaining: 1,
+			expectedResetAt:   now.Add(50 * time.Second),
+		},
+		{
+			name:              "Over Limit Waits For Enough Sends To Expire",
+			sent:              []time.Time{now.Add(-50 * time.Second), now.Add(-40 * time.Second), now.Add(-30 * time.Second)},
+			expectedAllowed:   false,
+			expectedRemaining: 0,
+			expectedResetAt:   now.Add(20 * time.Second),
+		},
+		{
+			name:              "Future Sends Are Ignored",
+			sent:              []time.Time{now.Add(time.Second), now.Add(time.Minute)},
+			expectedAllowed:   true,
+			expectedRemaining: 2,
+			expectedResetAt:   now,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := service.EvaluateSlidingWindow(rule, tc.sent, now)
+			assert.Equal(t, tc.expectedAllowed, decision.Allowed)
+			assert.Equal(t, tc.expectedRemaining, decision.Remaining)
+			assert.Equal(t, 2, decision.Limit)
+			assert.Equal(t, tc.expectedResetAt, decision.ResetAt)
+		})
+	}
+}
+
+// randomHistory returns up to n send times spread over the three windows before now
+func randomHistory(r *rand.Rand, n int, now time.Time, window time.Duration) []time.Time {
+	sent := make([]time.Time, r.Intn(n+1))
+	for i := range sent {
+		sent[i] = now.Add(-time.Duration(r.Int63n(int64(3 * window))))
+	}
+	return sent
+}
+
+func TestEvaluateSlidingWindowProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2000; i++ {
+		rule := types.RateLimitRule{MaxCount: 1 + r.Intn(5), Duration: float64(1 + r.Intn(3600))}
+		window := service.RuleWindow(rule)
+		sent := randomHistory(r, 12, now, window)
+
+		inWindow := 0
+		for _, at := range sent {
+			if at.After(now.Add(-window)) {
+				inWindow++
+			}
+		}
+
+		decision := service.EvaluateSlidingWindow(rule, sent, now)
+
+		// allowed exactly when the window holds fewer than MaxCount sends
+		if decision.Allowed != (inWindow < rule.MaxCount) {
+			t.Fatalf("case %d: allowed=%v with %d sends in window for max %d", i, decision.Allowed, inWindow, rule.MaxCount)
+		}
+		if expected := max(rule.MaxCount-inWindow, 0); decision.Remaining != expected {
+			t.Fatalf("case %d: remaining=%d, expected %d", i, decision.Remaining, expected)
+		}
+		if decision.ResetAt.Before(now) || decision.ResetAt.After(now.Add(window)) {
+			t.Fatalf("case %d: reset %v outside [now, now+window]", i, decision.ResetAt)
+		}
+
+		// a rejected send becomes allowed exactly at ResetAt, not an instant before
+		if !decision.Allowed {
+			if !service.EvaluateSlidingWindow(rule, sent, decision.ResetAt).Allowed {
+				t.Fatalf("case %d: still rejected at reset time %v", i, decision.ResetAt)
+			}
+			if service.EvaluateSlidingWindow(rule, sent, decision.ResetAt.Add(-time.Nanosecond)).Allowed {
+				t.Fatalf("case %d: allowed before reset time %v", i, decision.ResetAt)
+			}
+		}
+	}
+}
+
+func TestSlidingWindowNeverExceedsLimit(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+
+	for i := 0; i < 200; i++ {
+		rule := types.RateLimitRule{MaxCount: 1 + r.Intn(5), Duration: float64(1 + r.Intn(120))}
+		window := service.RuleWindow(rule)
+
+		// attempt sends at random increasing times, recording the accepted ones
+		now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		var sent []time.Time
+		for j := 0; j < 300; j++ {
+			now = now.Add(time.Duration(r.Int63n(int64(window / 2))))
+			if service.EvaluateSlidingWindow(rule, sent, now).Allowed {
+				sent = append(sent, now)
+			}
+		}
+
+		// no window of the rule length may contain more than MaxCount sends
+		for start := range sent {
+			count := 0
+			for _, at := range sent[start:] {
+				if at.Sub(sent[start]) < window {
+					count++
+				}
+			}
+			if count > rule.MaxCount {
+				t.Fatalf("case %d: %d sends within %v of %v, max %d", i, count, window, sent[start], rule.MaxCount)
+			}
+		}
+	}
+}
+
+func TestEvaluateFixedWindow(t *testing.T) {
+	rule := types.RateLimitRule{Strategy: types.FixedWindow, MaxCount: 2, Duration: 3600}
+	now := time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC)
+	windowStart := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name              string
+		sent              []time.Time
+		expectedAllowed   bool
+		expectedRemaining int
+	}{
+		{name: "Empty Window", expectedAllowed: true, expectedRemaining: 2},
+		{name: "Previous Window Is Ignored", sent: []time.Time{windowStart.Add(-time.Second), windowStart.Add(-time.Minute)}, expectedAllowed: true, expectedRemaining: 2},
+		{name: "Send At Window Start Counts", sent: []time.Time{windowStart}, expectedAllowed: true, expectedRemaining: 1},
+		{name: "Window Full", sent: []time.Time{windowStart, now}, expectedAllowed: false, expectedRemaining: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := service.EvaluateFixedWindow(rule, tc.sent, now)
+			assert.Equal(t, tc.expectedAllowed, decision.Allowed)
+			assert.Equal(t, tc.expectedRemaining, decision.Remaining)
+			assert.Equal(t, windowStart.Add(time.Hour), decision.ResetAt)
+		})
+	}
+}
+
+func TestEvaluateTokenBucket(t *testing.T) {
+	// 5 tokens, refilled at one token every 10 seconds
+	rule := types.RateLimitRule{Strategy: types.TokenBucket, MaxCount: 6, Duration: 60, Burst: 5, RefillRate: 0.1}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name              string
+		bucket            types.Bucket
+		expectedAllowed   bool
+		expectedRemaining int
+		expectedTokens    float64
+		expectedResetAt   time.Time
+	}{
+		{
+			name:              "Full Bucket",
+			bucket:            types.Bucket{Tokens: 5, UpdatedAt: now},
+			expectedAllowed:   true,
+			expectedRemaining: 5,
+			expectedTokens:    5,
+			expectedResetAt:   now,
+		},
+		{
+			name:              "Empty Bucket",
+			bucket:            types.Bucket{Tokens: 0.5, UpdatedAt: now},
+			expectedAllowed:   false,
+			expectedRemaining: 0,
+			expectedTokens:    0.5,
+			expectedResetAt:   now.Add(5 * time.Second),
+		},
+		{
+			name:              "Refilled Since Last Use",
+			bucket:            types.Bucket{Tokens: 0, UpdatedAt: now.Add(-25 * time.Second)},
+			expectedAllowed:   true,
+			expectedRemaining: 2,
+			expectedTokens:    2.5,
+			expectedResetAt:   now.Add(5 * time.Second),
+		},
+		{
+			name:              "Refill Is Capped At Burst",
+			bucket:            types.Bucket{Tokens: 1, UpdatedAt: now.Add(-time.Hour)},
+			expectedAllowed:   true,
+			expectedRemaining: 5,
+			expectedTokens:    5,
+			expectedResetAt:   now,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, b := service.EvaluateTokenBucket(rule, tc.bucket, now)
+			assert.Equal(t, tc.expectedAllowed, decision.Allowed)
+			assert.Equal(t, tc.expectedRemaining, decision.Remaining)
+			assert.Equal(t, 5, decision.Limit)
+			assert.InDelta(t, tc.expectedTokens, b.Tokens, 1e-9)
+			assert.Equal(t, tc.expectedResetAt, decision.ResetAt)
+		})
+	}
+
+	capacity, rate := service.BucketParams(types.RateLimitRule{MaxCount: 3, Duration: 60})
+	assert.Equal(t, 3.0, capacity)
+	assert.InDelta(t, 0.05, rate, 1e-9)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	store := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: zap.NewNop()}
+
+	rule := types.RateLimitRule{ID: "rule-1", Strategy: types.TokenBucket, MaxCount: 3, Duration: 60}
+	in := types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing}
+	now := time.Now().UTC()
+	limiter, err := service.LimiterFor(rule.Strategy)
+	assert.NoError(t, err)
+
+	// a recipient without bucket starts full and the send takes one token
+	mock.ExpectQuery(`SELECT \* FROM notification_service.token_buckets`).
+		WithArgs("rule-1", "romi").
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "recipient", "tokens", "updated_at"}))
+	decision, err := limiter.Evaluate(context.Background(), store, rule, in, now)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 3, decision.Remaining)
+
+	mock.ExpectQuery(`SELECT \* FROM notification_service.token_buckets`).
+		WithArgs("rule-1", "romi").
+		WillReturnRows(sqlmock.NewRows([]string{"rule_id", "recipient", "tokens", "updated_at"}))
+	mock.ExpectExec(`INSERT INTO notification_service.token_buckets`).
+		WithArgs("rule-1", "romi", 2.0, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(t, limiter.Consume(context.Background(), store, rule, in, now))
+
+	_, err = service.LimiterFor("LEAKY_BUCKET")
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var eventColumns = []string{"id", "notification_id", "status", "attempt", "detail", "created_at"}
+
+func TestParseNotificationFilter(t *testing.T) {
+	testCases := []struct {
+		name          string
+		query         string
+		expected      types.NotificationFilter
+		expectedError string
+	}{
+		{name: "Defaults", query: "", expected: types.NotificationFilter{Limit: 100}},
+		{name: "All Filters", query: "recipient=romi&group=news&channel=email&status=rate_limited&limit=5",
+			expected: types.NotificationFilter{Recipient: "romi", NotificationGroup: types.News, Channel: types.Email,
+				Status: types.RateLimited, Limit: 5}},
+		{name: "Invalid Group", query: "group=spam", expectedError: "invalid notification type: SPAM"},
+		{name: "Invalid Channel", query: "channel=fax", expectedError: "invalid channel: FAX"},
+		{name: "Invalid Status", query: "status=lost", expectedError: "invalid status: LOST"},
+		{name: "Limit Too Large", query: "limit=5000", expectedError: "limit must be between 1 and 1000"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			assert.NoError(t, err)
+			f, err := server.ParseNotificationFilter(q)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, f)
+		})
+	}
+}
+
+func TestNotificationHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now().UTC()
+
+	t.Run("Get", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.outbox WHERE id = \$1`).
+			WithArgs("2b1f").
+			WillReturnRows(sqlmock.NewRows(outboxColumns).AddRow(
+				"2b1f", "romi", "NEWS", "WEBHOOK", "https://example.com/hook", "", "Title", "Body",
+				"", nil, "", "DELIVERED", 2, now, "", "", now, now))
+		mock.ExpectQuery(`SELECT \* FROM notification_service.notification_events`).
+			WithArgs("2b1f").
+			WillReturnRows(sqlmock.NewRows(eventColumns).
+				AddRow(1, "2b1f", "ACCEPTED", 0, "", now).
+				AddRow(2, "2b1f", "QUEUED", 0, "", now).
+				AddRow(3, "2b1f", "SENDING", 1, "", now).
+				AddRow(4, "2b1f", "QUEUED", 1, "could not send WEBHOOK message: webhook responded with status 503", now).
+				AddRow(5, "2b1f", "SENDING", 2, "", now).
+				AddRow(6, "2b1f", "DELIVERED", 2, "", now))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/notifications/2b1f", nil), map[string]string{"id": "2b1f"})
+		rr := httptest.NewRecorder()
+		s.GetNotificationHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var out types.OutboxMessage
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&out))
+		assert.Equal(t, types.Delivered, out.Status)
+		if assert.Len(t, out.Events, 6) {
+			assert.Equal(t, types.Accepted, out.Events[0].Status)
+			assert.Equal(t, 1, out.Events[3].Attempt)
+			assert.Contains(t, out.Events[3].Detail, "status 503")
+		}
+	})
+
+	t.Run("Get Unknown", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.outbox WHERE id = \$1`).
+			WithArgs("nope").
+			WillReturnRows(sqlmock.NewRows(outboxColumns))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/notifications/nope", nil), map[string]string{"id": "nope"})
+		rr := httptest.NewRecorder()
+		s.GetNotificationHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.outbox`).
+			WithArgs("romi", "", "", "RATE_LIMITED", 10).
+			WillReturnRows(sqlmock.NewRows(outboxColumns).AddRow(
+				"7c0e", "romi", "MARKETING", "TELEGRAM", "romi", "", "", "",
+				"", nil, "", "RATE_LIMITED", 0, now, "rate limit exceeded for recipient romi", "", now, now))
+
+		req := httptest.NewRequest(http.MethodGet, "/V1/notifications?recipient=romi&status=rate_limited&limit=10", nil)
+		rr := httptest.NewRecorder()
+		s.ListNotificationsHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"status":"RATE_LIMITED"`)
+		assert.NotContains(t, rr.Body.String(), `"events"`)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
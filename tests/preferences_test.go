@@ -0,0 +1,316 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var preferenceColumns = []string{"recipient", "notification_type", "opted_out", "quiet_hours_start", "quiet_hours_end", "preferred_channel", "updated_at"}
+
+func TestInQuietHours(t *testing.T) {
+	at := func(clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 6, 1, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		expected   bool
+	}{
+		{name: "No Window", now: at("03:00"), expected: false},
+		{name: "Inside Same Day Window", start: "12:00", end: "14:00", now: at("13:00"), expected: true},
+		{name: "End Is Exclusive", start: "12:00", end: "14:00", now: at("14:00"), expected: false},
+		{name: "Start Is Inclusive", start: "12:00", end: "14:00", now: at("12:00"), expected: true},
+		{name: "Inside Overnight Window Before Midnight", start: "22:00", end: "07:00", now: at("23:30"), expected: true},
+		{name: "Inside Overnight Window After Midnight", start: "22:00", end: "07:00", now: at("03:00"), expected: true},
+		{name: "Outside Overnight Window", start: "22:00", end: "07:00", now: at("12:00"), expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			quiet, err := service.InQuietHours(tc.start, tc.end, tc.now)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, quiet)
+		})
+	}
+
+	_, err := service.InQuietHours("25:00", "07:00", at("03:00"))
+	assert.Error(t, err)
+}
+
+func TestQuietUntil(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatalf("Error loading location: %v", err)
+	}
+	testCases := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		expected   time.Time
+	}{
+		{name: "Outside", start: "22:00", end: "07:00", now: time.Date(2024, 6, 1, 12, 0, 0, 0, madrid)},
+		{name: "Same Day", start: "12:00", end: "14:00", now: time.Date(2024, 6, 1, 13, 0, 0, 0, madrid),
+			expected: time.Date(2024, 6, 1, 14, 0, 0, 0, madrid)},
+		{name: "Before Midnight", start: "22:00", end: "07:00", now: time.Date(2024, 6, 1, 23, 30, 0, 0, madrid),
+			expected: time.Date(2024, 6, 2, 7, 0, 0, 0, madrid)},
+		{name: "After Midnight", start: "22:00", end: "07:00", now: time.Date(2024, 6, 2, 3, 0, 0, 0, madrid),
+			expected: time.Date(2024, 6, 2, 7, 0, 0, 0, madrid)},
+		// the clocks go forward on the night of March 31, the window still ends at 07:00 local time
+		{name: "Across A Time Change", start: "22:00", end: "07:00", now: time.Date(2024, 3, 30, 23, 0, 0, 0, madrid),
+			expected: time.Date(2024, 3, 31, 5, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			until, err := service.QuietUntil(tc.start, tc.end, tc.now)
+			assert.NoError(t, err)
+			assert.True(t, tc.expected.Equal(until), "expected %v, got %v", tc.expected, until)
+		})
+	}
+}
+
+func TestQuietHoursDeferral(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("Error loading location: %v", err)
+	}
+	now := time.Now().In(tokyo)
+	start, end := now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")
+	until := now.Add(time.Hour).Truncate(time.Minute)
+
+	store := newMemStore()
+	chatID := int64(42)
+	for _, r := range []types.Recipient{{ID: "romi", TelegramChatID: &chatID, Timezone: "Asia/Tokyo"}, {ID: "ines", TelegramChatID: &chatID}} {
+		store.recipients[r.ID] = r
+		for _, nType := range []types.NotificationType{types.Marketing, types.Status} {
+			store.prefs[r.ID+string(nType)] = types.Preference{Recipient: r.ID, NotificationType: nType, QuietHoursStart: start, QuietHoursEnd: end}
+		}
+	}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+
+	t.Run("Deferred", func(t *testing.T) {
+		out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing, Title: "Sale"})
+		assert.NoError(t, err)
+		if assert.NotNil(t, out.SendAt) {
+			assert.True(t, until.Equal(*out.SendAt), "expected %v, got %v", until, *out.SendAt)
+		}
+		assert.Empty(t, store.outbox)
+		if assert.Contains(t, store.scheduled, out.ID) {
+			assert.Equal(t, "Sale", store.scheduled[out.ID].Payload.Title)
+		}
+	})
+
+	t.Run("Window Read In The Time Zone Of The Recipient", func(t *testing.T) {
+		// the window is over nine hours away in UTC, the time zone of ines
+		out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "ines", NotificationGroup: types.Marketing})
+		assert.NoError(t, err)
+		assert.Nil(t, out.SendAt)
+		assert.Len(t, store.outbox, 1)
+	})
+
+	t.Run("Status Bypass", func(t *testing.T) {
+		bypass := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+		bypass.QuietHoursBypass = map[types.NotificationType]bool{types.Status: true}
+
+		out, err := bypass.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Status})
+		assert.NoError(t, err)
+		assert.Nil(t, out.SendAt)
+		assert.Len(t, store.outbox, 2)
+
+		// the bypass is a setting of the type, not of the notification
+		out, err = bypass.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+		assert.NoError(t, err)
+		assert.NotNil(t, out.SendAt)
+		assert.Len(t, store.outbox, 2)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		results, err := svc.SendBatch(context.Background(), []types.InputInfo{
+			{Recipient: "romi", NotificationGroup: types.Status},
+			{Recipient: "ines", NotificationGroup: types.Status},
+		})
+		assert.NoError(t, err)
+		if assert.Len(t, results, 2) {
+			assert.Equal(t, types.BatchDeferred, results[0].Status)
+			assert.Contains(t, store.scheduled, results[0].ID)
+			if assert.NotNil(t, results[0].SendAt) {
+				assert.True(t, until.Equal(*results[0].SendAt))
+			}
+			assert.Equal(t, types.BatchSent, results[1].Status)
+		}
+		assert.Len(t, store.outbox, 3)
+	})
+}
+
+func TestSendNotificationPreferences(t *testing.T) {
+	now := time.Now().UTC()
+
+	testCases := []struct {
+		name          string
+		optedOut      bool
+		start, end    string
+		expectedError error
+	}{
+		{name: "Opted Out", optedOut: true, expectedError: service.ErrOptedOut},
+		// opting out wins over the quiet hours, the notification is not deferred
+		{name: "Opted Out In Quiet Hours", optedOut: true, start: now.Add(-time.Hour).Format("15:04"),
+			end: now.Add(time.Hour).Format("15:04"), expectedError: service.ErrOptedOut},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Error creating mock database: %v", err)
+			}
+			defer mockDB.Close()
+			logger := zap.NewNop()
+
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+				WithArgs("romi", types.Marketing).
+				WillReturnRows(sqlmock.NewRows(preferenceColumns).
+					AddRow("romi", "MARKETING", tc.optedOut, tc.start, tc.end, "", now))
+
+			sender := &fakeSender{channel: types.Telegram}
+			svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+				service.NewRegistry(types.Telegram, sender))
+
+			_, err = svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Marketing})
+			assert.ErrorIs(t, err, tc.expectedError)
+			assert.Empty(t, sender.sent)
+			assert.NoError(t, mock.ExpectationsWereMet(), "nothing must be recorded for suppressed notifications")
+		})
+	}
+}
+
+func TestValidatePreference(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		expectedError string
+		expected      types.Preference
+	}{
+		{
+			name:     "Valid Preference",
+			input:    `{"opted_out": false, "quiet_hours_start": "22:00", "quiet_hours_end": "07:00", "preferred_channel": "email"}`,
+			expected: types.Preference{QuietHoursStart: "22:00", QuietHoursEnd: "07:00", PreferredChannel: types.Email},
+		},
+		{
+			name:          "Half Quiet Hours Window",
+			input:         `{"quiet_hours_start": "22:00"}`,
+			expectedError: "must be set together",
+		},
+		{
+			name:          "Invalid Clock",
+			input:         `{"quiet_hours_start": "10pm", "quiet_hours_end": "07:00"}`,
+			expectedError: "expected HH:MM",
+		},
+		{
+			name:          "Invalid Channel",
+			input:         `{"preferred_channel": "sms"}`,
+			expectedError: "invalid channel: SMS",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := server.ValidatePreference(strings.NewReader(tc.input))
+			if tc.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, p)
+		})
+	}
+}
+
+func TestUnsubscribeHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+
+	signer := &service.UnsubscribeSigner{Secret: []byte("unsubscribe_secret"), BaseURL: "https://notify.example.com/"}
+	svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram))
+	svc.Unsubscribe = signer
+	s := server.NewServer(context.Background(), svc)
+
+	link := signer.Link("romi", types.Marketing)
+	assert.True(t, strings.HasPrefix(link, "https://notify.example.com/unsubscribe?"))
+
+	t.Run("GET Asks To Confirm", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, link, nil)
+		rr := httptest.NewRecorder()
+		s.UnsubscribeHandler(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+		assert.Contains(t, rr.Body.String(), `<form method="post"`)
+		assert.Contains(t, rr.Body.String(), "Stop sending MARKETING notifications to romi?")
+		// nothing is written until the page is submitted
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Confirmation Page", func(t *testing.T) {
+		mock.ExpectExec(`INSERT INTO notification_service.recipient_preferences`).
+			WithArgs("romi", types.Marketing, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := httptest.NewRequest(http.MethodPost, link, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		rr := httptest.NewRecorder()
+		s.UnsubscribeHandler(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "romi no longer receives MARKETING notifications.")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("One-Click POST", func(t *testing.T) {
+		mock.ExpectExec(`INSERT INTO notification_service.recipient_preferences`).
+			WithArgs("romi", types.Marketing, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := httptest.NewRequest(http.MethodPost, link, nil)
+		rr := httptest.NewRecorder()
+		s.UnsubscribeHandler(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Tampered Link", func(t *testing.T) {
+		u, _ := url.Parse(link)
+		q := u.Query()
+		q.Set("group", "STATUS")
+		u.RawQuery = q.Encode()
+
+		req := httptest.NewRequest(http.MethodGet, u.String(), nil)
+		rr := httptest.NewRecorder()
+		s.UnsubscribeHandler(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+	})
+}
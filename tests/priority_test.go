@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestCriticalBypass(t *testing.T) {
+	testCases := []struct {
+		name           string
+		criticalBypass bool
+		priority       string
+		expectedStatus int
+	}{
+		{name: "Critical Bypassing", criticalBypass: true, priority: "critical", expectedStatus: http.StatusAccepted},
+		{name: "High Not Bypassing", criticalBypass: true, priority: "high", expectedStatus: http.StatusTooManyRequests},
+		{name: "Rule Without Bypass", priority: "critical", expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.Status, MaxCount: 1, Duration: 3600, CriticalBypass: tc.criticalBypass}
+			store := newMemStore(rule)
+			svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+			s := server.NewServer(context.Background(), svc)
+
+			assert.Equal(t, http.StatusAccepted, postNotify(s, "", `{"recipient": "romi", "group": "status"}`).Code)
+			assert.Equal(t, http.StatusTooManyRequests, postNotify(s, "", `{"recipient": "romi", "group": "status"}`).Code)
+			rr := postNotify(s, "", `{"recipient": "romi", "group": "status", "priority": "`+tc.priority+`"}`)
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+		})
+	}
+
+	t.Run("Still Counted", func(t *testing.T) {
+		rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.Status, MaxCount: 1, Duration: 3600, CriticalBypass: true}
+		store := newMemStore(rule)
+		svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+
+		_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Status, Priority: types.Critical})
+		assert.NoError(t, err)
+		_, err = svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Status})
+		var rateLimitErr *service.RateLimitError
+		assert.ErrorAs(t, err, &rateLimitErr, "the critical send counts against the rule")
+
+		quota, err := svc.Quota(context.Background(), "romi", types.Status, types.Critical)
+		assert.NoError(t, err)
+		assert.True(t, quota.Allowed)
+		assert.Equal(t, 0, quota.Remaining)
+	})
+
+	t.Run("Empty Bucket Is Not Overdrawn", func(t *testing.T) {
+		rule := types.RateLimitRule{ID: "bucket", NotificationType: types.Status, Strategy: types.TokenBucket,
+			MaxCount: 1, Duration: 3600, CriticalBypass: true}
+		store := newMemStore(rule)
+		svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+
+		for i := 0; i < 3; i++ {
+			_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.Status, Priority: types.Critical})
+			assert.NoError(t, err)
+		}
+		assert.Zero(t, store.buckets["bucketromi"].Tokens)
+	})
+}
+
+func TestDeliverByPriority(t *testing.T) {
+	store := newMemStore()
+	sender := &fakeSender{channel: types.Telegram}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender))
+	for _, in := range []types.InputInfo{
+		{Recipient: "romi", NotificationGroup: types.Marketing, Title: "low", Priority: types.Low},
+		{Recipient: "romi", NotificationGroup: types.News, Title: "normal"},
+		{Recipient: "romi", NotificationGroup: types.Status, Title: "critical", Priority: types.Critical},
+		{Recipient: "romi", NotificationGroup: types.News, Title: "high", Priority: types.High},
+		{Recipient: "romi", NotificationGroup: types.Status, Title: "second critical", Priority: types.Critical},
+	} {
+		_, err := svc.SendNotification(context.Background(), in)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, types.Normal, store.outbox[1].Priority, "notifications without a priority are normal")
+
+	for {
+		delivered, err := svc.DeliverNext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		if !delivered {
+			break
+		}
+	}
+	titles := make([]string, 0, len(sender.sent))
+	for _, msg := range sender.sent {
+		titles = append(titles, msg.Title)
+	}
+	assert.Equal(t, []string{"critical", "second critical", "high", "normal", "low"}, titles)
+}
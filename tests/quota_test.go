@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestQuotaHandler(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 2, Duration: 3600}
+
+	testCases := []struct {
+		name              string
+		url               string
+		rules             []types.RateLimitRule
+		sent              int
+		expectedStatus    int
+		expectedAllowed   bool
+		expectedRemaining int
+		expectedRule      bool
+	}{
+		{name: "No Rules", url: "/V1/quota?recipient=romi&group=news", expectedStatus: http.StatusOK, expectedAllowed: true},
+		{name: "Quota Left", url: "/V1/quota?recipient=romi&group=NEWS", rules: []types.RateLimitRule{rule}, sent: 1,
+			expectedStatus: http.StatusOK, expectedAllowed: true, expectedRemaining: 1, expectedRule: true},
+		{name: "Quota Exhausted", url: "/V1/quota?recipient=romi&group=NEWS", rules: []types.RateLimitRule{rule}, sent: 2,
+			expectedStatus: http.StatusOK, expectedAllowed: false, expectedRemaining: 0, expectedRule: true},
+		{name: "Missing Recipient", url: "/V1/quota?group=NEWS", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "Invalid Group", url: "/V1/quota?recipient=romi&group=alerts", expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newMemStore(tc.rules...)
+			key := "romi" + string(types.News)
+			for i := 0; i < tc.sent; i++ {
+				store.sent[key] = append(store.sent[key], time.Now().UTC().Add(-time.Minute))
+			}
+			s := server.NewServer(context.Background(),
+				service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram)))
+
+			rr := httptest.NewRecorder()
+			s.QuotaHandler(rr, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			var quota types.Quota
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &quota))
+			assert.Equal(t, types.News, quota.NotificationGroup)
+			assert.Equal(t, tc.expectedAllowed, quota.Allowed)
+			assert.Equal(t, tc.expectedRemaining, quota.Remaining)
+			if tc.expectedRule {
+				assert.Equal(t, "rule-1", quota.Rule.ID)
+				assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Limit"))
+			} else {
+				assert.Nil(t, quota.Rule)
+			}
+			assert.Len(t, store.sent[key], tc.sent, "a dry run must not record anything")
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var recipientColumns = []string{"id", "telegram_chat_id", "email", "webhook_url", "preferred_channels", "created_at", "updated_at"}
+
+func TestValidateRecipient(t *testing.T) {
+	chatID := int64(5751493884)
+	testCases := []struct {
+		name          string
+		input         string
+		expectedError string
+		expected      types.Recipient
+	}{
+		{
+			name:  "Valid Recipient",
+			input: `{"id": "romi", "telegram_chat_id": 5751493884, "email": "romi@example.com", "preferred_channels": ["email", "telegram"]}`,
+			expected: types.Recipient{
+				ID:                "romi",
+				TelegramChatID:    &chatID,
+				Email:             "romi@example.com",
+				PreferredChannels: types.ChannelList{types.Email, types.Telegram},
+			},
+		},
+		{
+			name:          "Invalid Email",
+			input:         `{"id": "romi", "email": "romi"}`,
+			expectedError: "invalid email: romi",
+		},
+		{
+			name:          "Invalid Webhook URL",
+			input:         `{"id": "romi", "webhook_url": "ftp://example.com"}`,
+			expectedError: "invalid webhook_url",
+		},
+		{
+			name:          "Invalid Channel",
+			input:         `{"id": "romi", "preferred_channels": ["sms"]}`,
+			expectedError: "invalid channel: SMS",
+		},
+		{
+			name:          "Preferred Channel Without Address",
+			input:         `{"id": "romi", "preferred_channels": ["WEBHOOK"]}`,
+			expectedError: "preferred channel WEBHOOK has no address",
+		},
+		{
+			name:          "Invalid Timezone",
+			input:         `{"id": "romi", "timezone": "Mars/Olympus_Mons"}`,
+			expectedError: "invalid timezone: Mars/Olympus_Mons",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := server.ValidateRecipient(strings.NewReader(tc.input))
+			if tc.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, r)
+		})
+	}
+}
+
+func TestRecipientHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now()
+
+	t.Run("Create", func(t *testing.T) {
+		mock.ExpectQuery(`INSERT INTO notification_service.recipients`).
+			WithArgs("romi", nil, "romi@example.com", "", "", sqlmock.AnyArg(), types.JSONObject{"service": "billing"},
+				"Europe/Madrid", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows(append(recipientColumns, "attributes")).
+				AddRow("romi", nil, "romi@example.com", "", "{EMAIL}", now, now, `{"service": "billing"}`))
+
+		req := httptest.NewRequest(http.MethodPost, "/V1/recipients", strings.NewReader(
+			`{"id": "romi", "email": "romi@example.com", "preferred_channels": ["EMAIL"], "attributes": {"service": "billing"}, "timezone": "Europe/Madrid"}`))
+		rr := httptest.NewRecorder()
+		s.CreateRecipientHandler(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"preferred_channels":["EMAIL"]`)
+		assert.Contains(t, rr.Body.String(), `"attributes":{"service":"billing"}`)
+	})
+
+	t.Run("Get Missing", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+			WithArgs("nobody").
+			WillReturnRows(sqlmock.NewRows(recipientColumns))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/recipients/nobody", nil), map[string]string{"id": "nobody"})
+		rr := httptest.NewRecorder()
+		s.GetRecipientHandler(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		mock.ExpectExec(`DELETE FROM notification_service.recipients`).
+			WithArgs("romi").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/V1/recipients/romi", nil), map[string]string{"id": "romi"})
+		rr := httptest.NewRecorder()
+		s.DeleteRecipientHandler(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendNotificationResolvesRecipient(t *testing.T) {
+	testCases := []struct {
+		name            string
+		channel         types.Channel
+		preferred       string
+		expectedChannel types.Channel
+		expectedAddress string
+		expectedError   string
+	}{
+		{
+			name:            "Preferred Channel",
+			preferred:       "{WEBHOOK,EMAIL}",
+			expectedChannel: types.Email,
+			expectedAddress: "romi@example.com",
+		},
+		{
+			name:            "Requested Channel",
+			channel:         types.Telegram,
+			preferred:       "{EMAIL}",
+			expectedChannel: types.Telegram,
+			expectedAddress: "5751493884",
+		},
+		{
+			name:            "No Preference Falls Back To Any Address",
+			preferred:       "{}",
+			expectedChannel: types.Email,
+			expectedAddress: "romi@example.com",
+		},
+		{
+			name:          "Requested Channel Without Address",
+			channel:       types.Webhook,
+			preferred:     "{EMAIL}",
+			expectedError: "recipient romi cannot be reached on channel WEBHOOK",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Error creating mock database: %v", err)
+			}
+			defer mockDB.Close()
+			logger := zap.NewNop()
+			now := time.Now()
+
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+				WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+			mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+				WithArgs("romi").
+				WillReturnRows(sqlmock.NewRows(recipientColumns).
+					AddRow("romi", 5751493884, "romi@example.com", "", tc.preferred, now, now))
+			if tc.expectedError == "" {
+				expectRateLimitLock(mock)
+				mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
+						AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "NEWS", 10, 3600.00))
+				mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+				mock.ExpectExec(`INSERT INTO notification_service.notifications`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+					WithArgs("romi", types.News, tc.expectedChannel, tc.expectedAddress, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+						sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+						types.Normal).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "channel", "address"}).AddRow("2b1f", tc.expectedChannel, tc.expectedAddress))
+				mock.ExpectCommit()
+			}
+
+			senders := map[types.Channel]*fakeSender{
+				types.Telegram: {channel: types.Telegram},
+				types.Email:    {channel: types.Email},
+				types.Webhook:  {channel: types.Webhook},
+			}
+			registry := service.NewRegistry(types.Telegram, senders[types.Telegram], senders[types.Email], senders[types.Webhook])
+			svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}, registry)
+
+			out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.News, Channel: tc.channel})
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedChannel, out.Channel)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var deadLetterColumns = []string{"id", "notification_id", "recipient", "notification_type", "channel", "attempts", "reason", "created_at"}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := service.RetryPolicy{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	testCases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: time.Second},
+		{attempt: 2, expected: 2 * time.Second},
+		{attempt: 3, expected: 4 * time.Second},
+		{attempt: 4, expected: 8 * time.Second},
+		{attempt: 5, expected: 10 * time.Second},
+		{attempt: 60, expected: 10 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Attempt %d", tc.attempt), func(t *testing.T) {
+			assert.Equal(t, tc.expected, policy.Delay(tc.attempt))
+
+			jittered := policy
+			jittered.Jitter = 0.5
+			for i := 0; i < 20; i++ {
+				delay := jittered.Delay(tc.attempt)
+				assert.LessOrEqual(t, delay, tc.expected)
+				assert.GreaterOrEqual(t, delay, tc.expected/2)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "Network Error", err: errors.New("connection refused"), expected: true},
+		{name: "Permanent", err: service.Permanent(errors.New("invalid address")), expected: false},
+		{name: "Wrapped Permanent", err: fmt.Errorf("send: %w", service.Permanent(errors.New("invalid address"))), expected: false},
+		{name: "Webhook Server Error", err: &service.WebhookStatusError{StatusCode: http.StatusBadGateway}, expected: true},
+		{name: "Webhook Too Many Requests", err: &service.WebhookStatusError{StatusCode: http.StatusTooManyRequests}, expected: true},
+		{name: "Webhook Not Found", err: &service.WebhookStatusError{StatusCode: http.StatusNotFound}, expected: false},
+		{name: "SMTP Temporary Failure", err: fmt.Errorf("SMTP RCPT TO rejected: %w", &textproto.Error{Code: 451}), expected: true},
+		{name: "SMTP Mailbox Unavailable", err: fmt.Errorf("SMTP RCPT TO rejected: %w", &textproto.Error{Code: 550}), expected: false},
+		{name: "Telegram Chat Not Found", err: fmt.Errorf("could not send message: %w", tgbotapi.Error{Message: "Bad Request: chat not found"}), expected: false},
+		{name: "Telegram Flood Control", err: fmt.Errorf("could not send message: %w", tgbotapi.Error{Message: "Too Many Requests: retry after 5"}), expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, service.Retryable(tc.err))
+		})
+	}
+}
+
+func TestDeliveryRetriesUntilDeadLetter(t *testing.T) {
+	store := newMemStore()
+	sender := &fakeSender{channel: types.Telegram, err: errors.New("connection refused")}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender))
+	svc.Retries = map[types.Channel]service.RetryPolicy{types.Telegram: {MaxAttempts: 3}}
+
+	_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.News})
+	assert.NoError(t, err)
+	deliverAll(t, svc)
+
+	assert.Equal(t, types.Failed, store.outbox[0].Status)
+	assert.Equal(t, 3, store.outbox[0].Attempts)
+	if assert.Len(t, store.dead, 1) {
+		assert.Equal(t, store.outbox[0].ID, store.dead[0].NotificationID)
+		assert.Equal(t, 3, store.dead[0].Attempts)
+		assert.Equal(t, "could not send TELEGRAM message: connection refused", store.dead[0].Reason)
+	}
+}
+
+func TestDeadLetterHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now().UTC()
+
+	t.Run("List", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.dead_letters`).
+			WithArgs("WEBHOOK", "").
+			WillReturnRows(sqlmock.NewRows(deadLetterColumns).
+				AddRow("dl-1", "2b1f", "romi", "NEWS", "WEBHOOK", 5, "could not send WEBHOOK message: webhook responded with status 503", now))
+
+		req := httptest.NewRequest(http.MethodGet, "/V1/dead-letters?channel=webhook", nil)
+		rr := httptest.NewRecorder()
+		s.ListDeadLettersHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"notification_id":"2b1f"`)
+	})
+
+	t.Run("List Invalid Channel", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/V1/dead-letters?channel=fax", nil)
+		rr := httptest.NewRecorder()
+		s.ListDeadLettersHandler(rr, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	})
+
+	t.Run("Requeue", func(t *testing.T) {
+		mock.ExpectQuery(`DELETE FROM notification_service.dead_letters`).
+			WithArgs("dl-1", types.Queued, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows(outboxColumns).AddRow(
+				"2b1f", "romi", "NEWS", "WEBHOOK", "https://example.com/hook", "", "Title", "Body",
+				"", nil, "", "QUEUED", 0, now, "", "", now, now))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/dead-letters/dl-1/requeue", nil), map[string]string{"id": "dl-1"})
+		rr := httptest.NewRecorder()
+		s.RequeueDeadLetterHandler(rr, req)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"status":"QUEUED"`)
+	})
+
+	t.Run("Requeue Unknown", func(t *testing.T) {
+		mock.ExpectQuery(`DELETE FROM notification_service.dead_letters`).
+			WithArgs("nope", types.Queued, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows(outboxColumns))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/dead-letters/nope/requeue", nil), map[string]string{"id": "nope"})
+		rr := httptest.NewRecorder()
+		s.RequeueDeadLetterHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// flakySender fails the first failures sends and records every attempt
+type flakySender struct {
+	channel  types.Channel
+	failures int
+	attempts []types.Message
+}
+
+func (f *flakySender) Channel() types.Channel {
+	return f.channel
+}
+
+func (f *flakySender) Send(ctx context.Context, msg types.Message) (types.Receipt, error) {
+	f.attempts = append(f.attempts, msg)
+	if len(f.attempts) <= f.failures {
+		return types.Receipt{}, errors.New("connection refused")
+	}
+	return types.Receipt{Channel: f.channel, Reference: "ref"}, nil
+}
+
+func TestRedeliveryKeepsID(t *testing.T) {
+	store := newMemStore()
+	sender := &flakySender{channel: types.Telegram, failures: 2}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender))
+	svc.Retries = map[types.Channel]service.RetryPolicy{types.Telegram: {MaxAttempts: 3}}
+
+	_, err := svc.SendNotification(context.Background(), types.InputInfo{
+		Recipient: "romi", NotificationGroup: types.News, MessageID: "m-1"})
+	assert.NoError(t, err)
+	deliverAll(t, svc)
+
+	assert.Equal(t, types.Delivered, store.outbox[0].Status)
+	if assert.Len(t, sender.attempts, 3) {
+		for _, msg := range sender.attempts {
+			// receivers deduplicate retries by id, which is the notification and not the message_id
+			assert.Equal(t, store.outbox[0].ID, msg.ID)
+			assert.Equal(t, "m-1", msg.MessageID)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var ruleColumns = []string{"id", "notification_type", "max_count", "duration", "strategy", "burst", "refill_rate", "recipient", "tenant"}
+
+func TestResolveRules(t *testing.T) {
+	global := types.RateLimitRule{ID: "global-hourly", MaxCount: 3, Duration: 3600}
+	globalDaily := types.RateLimitRule{ID: "global-daily", MaxCount: 10, Duration: 86400}
+	tenant := types.RateLimitRule{ID: "tenant", MaxCount: 100, Duration: 3600, Tenant: "acme"}
+	recipient := types.RateLimitRule{ID: "recipient", MaxCount: 1000, Duration: 3600, Recipient: "romi"}
+
+	testCases := []struct {
+		name     string
+		rules    []types.RateLimitRule
+		expected []string
+	}{
+		{name: "No Rules", expected: []string{}},
+		{name: "Global Rules", rules: []types.RateLimitRule{global, globalDaily}, expected: []string{"global-hourly", "global-daily"}},
+		{name: "Tenant Overrides Global", rules: []types.RateLimitRule{global, tenant, globalDaily}, expected: []string{"tenant"}},
+		{name: "Recipient Overrides Tenant", rules: []types.RateLimitRule{global, tenant, recipient}, expected: []string{"recipient"}},
+		{name: "Recipient Overrides Global", rules: []types.RateLimitRule{recipient, global}, expected: []string{"recipient"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids := []string{}
+			for _, rule := range service.ResolveRules(tc.rules) {
+				ids = append(ids, rule.ID)
+			}
+			assert.Equal(t, tc.expected, ids)
+		})
+	}
+}
+
+func TestSendNotificationRecipientOverride(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	now := time.Now().UTC()
+
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+		WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	// the global rule is exhausted, the VIP override of the recipient is not
+	expectRateLimitLock(mock)
+	mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+		WithArgs(types.Marketing, "vip").
+		WillReturnRows(sqlmock.NewRows(ruleColumns).
+			AddRow("global", "MARKETING", 1, 3600.00, "SLIDING_WINDOW", 0, 0, "", "").
+			AddRow("vip", "MARKETING", 5, 3600.00, "SLIDING_WINDOW", 0, 0, "vip", ""))
+	mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(now.Add(-time.Minute)))
+	mock.ExpectExec(`INSERT INTO notification_service.notifications`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("2b1f"))
+	mock.ExpectCommit()
+
+	sender := &fakeSender{channel: types.Telegram}
+	svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram, sender))
+
+	out, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "vip", NotificationGroup: types.Marketing})
+	assert.NoError(t, err)
+	assert.Equal(t, "2b1f", out.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestValidateRule(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		expectedError string
+		expected      types.RateLimitRule
+	}{
+		{
+			name:  "Recipient Override",
+			input: `{"group": "marketing", "max_count": 100, "duration": 3600, "recipient": "vip"}`,
+			expected: types.RateLimitRule{
+				NotificationType: types.Marketing,
+				MaxCount:         100,
+				Duration:         3600,
+				Strategy:         types.SlidingWindow,
+				Recipient:        "vip",
+			},
+		},
+		{
+			name:          "Invalid Group",
+			input:         `{"group": "alerts", "max_count": 1, "duration": 60}`,
+			expectedError: "invalid notification type: ALERTS",
+		},
+		{
+			name:          "Missing Duration",
+			input:         `{"group": "NEWS", "max_count": 1}`,
+			expectedError: "duration must be positive",
+		},
+		{
+			name:          "Unknown Strategy",
+			input:         `{"group": "NEWS", "max_count": 1, "duration": 60, "strategy": "leaky_bucket"}`,
+			expectedError: `unknown rate limit strategy "LEAKY_BUCKET"`,
+		},
+		{
+			name:          "Recipient And Tenant",
+			input:         `{"group": "NEWS", "max_count": 1, "duration": 60, "recipient": "romi", "tenant": "acme"}`,
+			expectedError: "either a recipient or a tenant",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := server.ValidateRule(strings.NewReader(tc.input))
+			if tc.expectedError != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rule)
+		})
+	}
+}
+
+func TestRuleHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+
+	t.Run("Create Tenant Override", func(t *testing.T) {
+		mock.ExpectQuery(`INSERT INTO notification_service.rate_limit_rules`).
+			WithArgs(types.Status, 50, 60.0, types.SlidingWindow, 0, 0.0, "", "acme", false).
+			WillReturnRows(sqlmock.NewRows(ruleColumns).
+				AddRow("6f1c", "STATUS", 50, 60.0, "SLIDING_WINDOW", 0, 0, "", "acme"))
+
+		req := httptest.NewRequest(http.MethodPost, "/V1/rules", strings.NewReader(`{"group": "STATUS", "max_count": 50, "duration": 60, "tenant": "acme"}`))
+		rr := httptest.NewRecorder()
+		s.CreateRuleHandler(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"tenant":"acme"`)
+	})
+
+	t.Run("List By Recipient", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+			WithArgs("", "vip", "").
+			WillReturnRows(sqlmock.NewRows(ruleColumns).
+				AddRow("7a2d", "MARKETING", 100, 3600.0, "SLIDING_WINDOW", 0, 0, "vip", ""))
+
+		req := httptest.NewRequest(http.MethodGet, "/V1/rules?recipient=vip", nil)
+		rr := httptest.NewRecorder()
+		s.ListRulesHandler(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"recipient":"vip"`)
+	})
+
+	t.Run("Get Malformed ID", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+			WithArgs("nope").
+			WillReturnError(&pq.Error{Code: "22P02"})
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/rules/nope", nil), map[string]string{"id": "nope"})
+		rr := httptest.NewRecorder()
+		s.GetRuleHandler(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		mock.ExpectExec(`DELETE FROM notification_service.rate_limit_rules`).
+			WithArgs("7a2d").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/V1/rules/7a2d", nil), map[string]string{"id": "7a2d"})
+		rr := httptest.NewRecorder()
+		s.DeleteRuleHandler(rr, req)
+
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
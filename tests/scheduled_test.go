@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestParseSendAt(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatalf("Error loading location: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		raw           string
+		expected      time.Time
+		expectedError bool
+	}{
+		{name: "RFC 3339", raw: "2030-01-15T09:00:00Z", expected: time.Date(2030, 1, 15, 9, 0, 0, 0, time.UTC)},
+		{name: "Offset Wins Over Time Zone", raw: "2030-01-15T09:00:00+02:00", expected: time.Date(2030, 1, 15, 7, 0, 0, 0, time.UTC)},
+		{name: "Local Time", raw: "2030-01-15T09:00:00", expected: time.Date(2030, 1, 15, 8, 0, 0, 0, time.UTC)},
+		{name: "Local Time In Summer", raw: "2030-07-15T09:00", expected: time.Date(2030, 7, 15, 7, 0, 0, 0, time.UTC)},
+		{name: "Invalid", raw: "tomorrow", expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			at, err := service.ParseSendAt(tc.raw, madrid)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tc.expected.Equal(at), "expected %v, got %v", tc.expected, at)
+		})
+	}
+}
+
+// makeDue moves the send_at of a scheduled notification to the past
+func makeDue(store *memStore, id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	sn := store.scheduled[id]
+	sn.SendAt = time.Now().UTC().Add(-time.Second)
+	sn.AvailableAt = sn.SendAt
+	store.scheduled[id] = sn
+}
+
+// cancelScheduled cancels a scheduled notification through its endpoint
+func cancelScheduled(handler http.HandlerFunc, id string) *httptest.ResponseRecorder {
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/scheduled/"+id+"/cancel", nil), map[string]string{"id": id})
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func TestScheduleNotification(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.News, MaxCount: 1, Duration: 3600}
+	store := newMemStore(rule)
+	chatID := int64(42)
+	store.recipients["romi"] = types.Recipient{ID: "romi", TelegramChatID: &chatID, Timezone: "America/New_York"}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+	s := server.NewServer(context.Background(), svc)
+
+	sendAt := time.Now().In(store.recipients["romi"].Location()).Add(time.Hour).Truncate(time.Minute)
+	rr := postNotify(s, "", `{"recipient": "romi", "group": "news", "title": "Weekly digest", "send_at": "`+sendAt.Format("2006-01-02T15:04")+`"}`)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var out types.Output
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&out))
+	if assert.NotNil(t, out.SendAt) {
+		// the local time is read in the time zone of the recipient
+		assert.True(t, sendAt.Equal(*out.SendAt), "expected %v, got %v", sendAt, *out.SendAt)
+	}
+	assert.Empty(t, store.outbox)
+
+	t.Run("Not Due", func(t *testing.T) {
+		dispatched, err := svc.DispatchNext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, dispatched)
+	})
+
+	t.Run("Dispatch", func(t *testing.T) {
+		// romi got the NEWS notification of the hour while this one waited
+		_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "romi", NotificationGroup: types.News})
+		assert.NoError(t, err)
+		makeDue(store, out.ID)
+
+		dispatched, err := svc.DispatchNext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, dispatched)
+
+		sn := store.scheduled[out.ID]
+		assert.Equal(t, types.Dispatched, sn.Status)
+		assert.Equal(t, types.BatchRateLimited, sn.Result)
+		if assert.Len(t, store.limited, 1) {
+			assert.Equal(t, "Weekly digest", store.limited[0].Title)
+		}
+	})
+
+	t.Run("Cancel Dispatched", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, cancelScheduled(s.CancelScheduledHandler, out.ID).Code)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		rr := postNotify(s, "", `{"recipient": "romi", "group": "news", "send_at": "`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		var pending types.Output
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&pending))
+
+		cancelled := cancelScheduled(s.CancelScheduledHandler, pending.ID)
+		assert.Equal(t, http.StatusOK, cancelled.Code)
+		assert.Contains(t, cancelled.Body.String(), `"status":"CANCELLED"`)
+
+		makeDue(store, pending.ID)
+		dispatched, err := svc.DispatchNext(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		assert.False(t, dispatched)
+	})
+
+	t.Run("Cancel Unknown", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, cancelScheduled(s.CancelScheduledHandler, "nope").Code)
+	})
+
+	t.Run("In The Past", func(t *testing.T) {
+		rr := postNotify(s, "", `{"recipient": "romi", "group": "news", "send_at": "2020-01-01T09:00:00Z"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		rr := postNotify(s, "", `{"recipient": "romi", "group": "news", "send_at": "tomorrow"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	})
+}
+
+func TestListScheduledHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now().UTC()
+
+	t.Run("Filtered", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.scheduled_notifications WHERE .* ORDER BY send_at, id LIMIT \$3`).
+			WithArgs("romi", "SCHEDULED", 10).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "recipient", "notification_type", "payload", "send_at", "status", "result",
+				"notification_id", "error", "available_at", "created_at", "updated_at"}).
+				AddRow("3a9d", "romi", "NEWS", `{"recipient": "romi", "group": "NEWS", "send_at": "2030-01-15T09:00"}`, now, "SCHEDULED", "",
+					"", "", now, now, now))
+
+		req := httptest.NewRequest(http.MethodGet, "/V1/scheduled?recipient=romi&status=scheduled&limit=10", nil)
+		rr := httptest.NewRecorder()
+		s.ListScheduledHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"status":"SCHEDULED"`)
+		assert.NotContains(t, rr.Body.String(), `available_at`)
+	})
+
+	t.Run("Invalid Status", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/V1/scheduled?status=sent", nil)
+		rr := httptest.NewRecorder()
+		s.ListScheduledHandler(rr, req)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCancelScheduledHandlerInvalidID(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\(\$1\)\)`).
+		WithArgs("scheduled:nope").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.scheduled_notifications WHERE id = \$1`).
+		WithArgs("nope").
+		WillReturnError(&pq.Error{Code: "22P02", Message: `invalid input syntax for type uuid: "nope"`})
+	mock.ExpectRollback()
+
+	assert.Equal(t, http.StatusNotFound, cancelScheduled(s.CancelScheduledHandler, "nope").Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
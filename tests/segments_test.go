@@ -0,0 +1,240 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var segmentColumns = []string{"id", "name", "description", "filter", "created_at", "updated_at"}
+
+func TestValidateSegment(t *testing.T) {
+	testCases := []struct {
+		name          string
+		body          string
+		expected      types.Segment
+		expectedError string
+	}{
+		{name: "Static", body: `{"name": " billing "}`, expected: types.Segment{Name: "billing", Filter: types.SegmentFilter{Channels: types.ChannelList{}}}},
+		{name: "Filter", body: `{"name": "billing", "filter": {"tenant": "acme", "channels": ["email"], "attributes": {"service": "billing"}}}`,
+			expected: types.Segment{Name: "billing", Filter: types.SegmentFilter{Tenant: "acme", Channels: types.ChannelList{types.Email},
+				Attributes: types.JSONObject{"service": "billing"}}}},
+		{name: "Missing Name", body: `{"filter": {"tenant": "acme"}}`, expectedError: "missing required fields"},
+		{name: "Name Too Long", body: `{"name": "` + strings.Repeat("n", 256) + `"}`, expectedError: "name exceeds 255 characters"},
+		{name: "Invalid Channel", body: `{"name": "billing", "filter": {"channels": ["fax"]}}`, expectedError: "invalid channel: FAX"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			segment, err := server.ValidateSegment(strings.NewReader(tc.body))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, segment)
+		})
+	}
+}
+
+func TestValidateBroadcast(t *testing.T) {
+	testCases := []struct {
+		name          string
+		body          string
+		expected      types.InputInfo
+		expectedError string
+	}{
+		{name: "Valid", body: `{"group": "status", "channel": "email", "title": "Billing is down"}`,
+			expected: types.InputInfo{NotificationGroup: types.Status, Channel: types.Email, Title: "Billing is down"}},
+		{name: "With Recipient", body: `{"recipient": "romi", "group": "STATUS"}`,
+			expectedError: "a broadcast is sent to the members of the segment, not to a recipient"},
+		{name: "Missing Group", body: `{"title": "Billing is down"}`, expectedError: "missing required fields"},
+		{name: "Scheduled", body: `{"group": "status", "send_at": "2030-01-15T09:00:00Z"}`, expectedError: "send_at is not supported in a broadcast"},
+		{name: "Invalid Group", body: `{"group": "spam"}`, expectedError: "invalid notification type: SPAM"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in, err := server.ValidateBroadcast(strings.NewReader(tc.body))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, in)
+		})
+	}
+}
+
+// getBroadcast reads the progress of a broadcast through its endpoint
+func getBroadcast(t *testing.T, handler http.HandlerFunc, id string) types.Broadcast {
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/broadcasts/"+id, nil), map[string]string{"id": id})
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var b types.Broadcast
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&b))
+	return b
+}
+
+func TestBroadcast(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.Status, MaxCount: 1, Duration: 3600}
+	store := newMemStore(rule)
+	store.members["billing"] = []string{"erin", "carol", "alice", "dave", "bob"}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+	svc.BroadcastPageSize = 2
+	s := server.NewServer(context.Background(), svc)
+
+	// carol already got her STATUS notification of the hour
+	_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "carol", NotificationGroup: types.Status})
+	assert.NoError(t, err)
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/segments/billing/notify",
+		strings.NewReader(`{"group": "status", "title": "Billing is down"}`)), map[string]string{"id": "billing"})
+	rr := httptest.NewRecorder()
+	s.BroadcastHandler(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var started types.Broadcast
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&started))
+	assert.Equal(t, types.BroadcastRunning, started.Status)
+	assert.Equal(t, 5, started.Total)
+
+	advanced, err := svc.AdvanceBroadcast(context.Background(), time.Minute)
+	assert.True(t, advanced)
+	assert.NoError(t, err)
+	progress := getBroadcast(t, s.GetBroadcastHandler, started.ID)
+	assert.Equal(t, types.BroadcastRunning, progress.Status)
+	assert.Equal(t, 2, progress.Processed)
+	assert.Equal(t, types.BatchSummary{types.BatchSent: 2}, progress.Summary)
+
+	for {
+		advanced, err := svc.AdvanceBroadcast(context.Background(), time.Minute)
+		assert.NoError(t, err)
+		if !advanced {
+			break
+		}
+	}
+	done := getBroadcast(t, s.GetBroadcastHandler, started.ID)
+	assert.Equal(t, types.BroadcastCompleted, done.Status)
+	assert.Equal(t, 5, done.Processed)
+	assert.Equal(t, types.BatchSummary{types.BatchSent: 4, types.BatchRateLimited: 1}, done.Summary)
+	assert.NotNil(t, done.CompletedAt)
+
+	assert.Len(t, store.outbox, 5)
+	if assert.Len(t, store.limited, 1) {
+		assert.Equal(t, "carol", store.limited[0].Recipient)
+		assert.Equal(t, "Billing is down", store.limited[0].Title)
+	}
+
+	t.Run("Unknown Segment", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/segments/nope/notify",
+			strings.NewReader(`{"group": "status"}`)), map[string]string{"id": "nope"})
+		rr := httptest.NewRecorder()
+		s.BroadcastHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestSegmentHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now().UTC()
+
+	t.Run("Create", func(t *testing.T) {
+		mock.ExpectQuery(`INSERT INTO notification_service.segments`).
+			WithArgs("billing", "", types.SegmentFilter{Channels: types.ChannelList{}, Attributes: types.JSONObject{"service": "billing"}},
+				sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows(segmentColumns).
+				AddRow("5e1d", "billing", "", `{"attributes": {"service": "billing"}}`, now, now))
+
+		req := httptest.NewRequest(http.MethodPost, "/V1/segments", strings.NewReader(`{"name": "billing", "filter": {"attributes": {"service": "billing"}}}`))
+		rr := httptest.NewRecorder()
+		s.CreateSegmentHandler(rr, req)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"filter":{"attributes":{"service":"billing"}}`)
+	})
+
+	t.Run("Create Duplicate", func(t *testing.T) {
+		mock.ExpectQuery(`INSERT INTO notification_service.segments`).
+			WillReturnError(&pq.Error{Code: "23505"})
+
+		req := httptest.NewRequest(http.MethodPost, "/V1/segments", strings.NewReader(`{"name": "billing"}`))
+		rr := httptest.NewRecorder()
+		s.CreateSegmentHandler(rr, req)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("List Members", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.segments WHERE id = \$1`).
+			WithArgs("5e1d").
+			WillReturnRows(sqlmock.NewRows(segmentColumns).AddRow("5e1d", "billing", "", `{}`, now, now))
+		mock.ExpectQuery(`SELECT id FROM \(.*segment_members.*recipients.*\) AS members WHERE id > \$2 ORDER BY id LIMIT \$3`).
+			WithArgs("5e1d", "alice", 2).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("bob").AddRow("carol"))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/segments/5e1d/members?after=alice&limit=2", nil),
+			map[string]string{"id": "5e1d"})
+		rr := httptest.NewRecorder()
+		s.ListSegmentMembersHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var page types.SegmentMembers
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&page))
+		assert.Equal(t, types.SegmentMembers{Members: []string{"bob", "carol"}, Next: "carol"}, page)
+	})
+
+	t.Run("Add Member To Unknown Segment", func(t *testing.T) {
+		mock.ExpectExec(`INSERT INTO notification_service.segment_members`).
+			WithArgs("7a2c", "romi", sqlmock.AnyArg()).
+			WillReturnError(&pq.Error{Code: "23503"})
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/V1/segments/7a2c/members/romi", nil),
+			map[string]string{"id": "7a2c", "recipient": "romi"})
+		rr := httptest.NewRecorder()
+		s.AddSegmentMemberHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("Broadcast", func(t *testing.T) {
+		mock.ExpectQuery(`INSERT INTO notification_service.broadcasts .* SELECT .* count\(\*\)`).
+			WithArgs("5e1d", types.InputInfo{NotificationGroup: types.Status, Title: "Billing is down"}, types.BroadcastRunning, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "segment_id", "payload", "status", "total", "processed", "summary",
+				"last_recipient", "available_at", "created_at", "updated_at", "completed_at"}).
+				AddRow("b0c1", "5e1d", `{"recipient": "", "group": "STATUS", "title": "Billing is down"}`, "RUNNING", 1200, 0, `{}`,
+					"", now, now, now, nil))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/segments/5e1d/notify",
+			strings.NewReader(`{"group": "status", "title": "Billing is down"}`)), map[string]string{"id": "5e1d"})
+		rr := httptest.NewRecorder()
+		s.BroadcastHandler(rr, req)
+		assert.Equal(t, http.StatusAccepted, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"total":1200`)
+		assert.NotContains(t, rr.Body.String(), `last_recipient`)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
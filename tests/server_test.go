@@ -7,12 +7,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"notification_service/server"
+	"notification_service/service"
 	"notification_service/types"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
 )
 
 type MockNotificationService struct {
@@ -26,8 +30,8 @@ func (m *MockNotificationService) SendNotification(ctx context.Context, input ty
 }
 
 // IsAllowed simula el método IsAllowed.
-func (m *MockNotificationService) IsAllowed(ctx context.Context, nType types.NotificationType) bool {
-	args := m.Called(ctx, nType)
+func (m *MockNotificationService) IsAllowed(ctx context.Context, recipient string, nType types.NotificationType) bool {
+	args := m.Called(ctx, recipient, nType)
 	return args.Bool(0)
 }
 
@@ -57,6 +61,23 @@ func TestValidateInputData(t *testing.T) {
 			expectedError:  "", // Happy path
 			expectedFields: types.InputInfo{Recipient: "example@example.com", NotificationGroup: "MARKETING"},
 		},
+		{
+			name:  "Valid Input With Content",
+			input: `{"recipient": "example@example.com", "group": "news", "message_id": "m-1", "title": "Hi", "body": "Hello there", "data": {"k": "v"}}`,
+			expectedFields: types.InputInfo{
+				Recipient:         "example@example.com",
+				NotificationGroup: "NEWS",
+				MessageID:         "m-1",
+				Title:             "Hi",
+				Body:              "Hello there",
+				Data:              map[string]any{"k": "v"},
+			},
+		},
+		{
+			name:          "Title Too Long",
+			input:         `{"recipient": "example@example.com", "group": "news", "title": "` + strings.Repeat("a", 256) + `"}`,
+			expectedError: "title exceeds 255 characters",
+		},
 		{
 			name:          "Invalid JSON",
 			input:         `invalid json`,
@@ -72,6 +93,16 @@ func TestValidateInputData(t *testing.T) {
 			input:         `{"recipient": "example@example.com", "group": "invalidType"}`,
 			expectedError: "invalid notification type: INVALIDTYPE",
 		},
+		{
+			name:           "Priority",
+			input:          `{"recipient": "example@example.com", "group": "status", "priority": "Critical"}`,
+			expectedFields: types.InputInfo{Recipient: "example@example.com", NotificationGroup: "STATUS", Priority: types.Critical},
+		},
+		{
+			name:          "Invalid Priority",
+			input:         `{"recipient": "example@example.com", "group": "status", "priority": "urgent"}`,
+			expectedError: "invalid priority: urgent",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -191,3 +222,71 @@ func TestSendHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestSendHandlerErrorStatus(t *testing.T) {
+	rule := types.RateLimitRule{ID: "rule-1", NotificationType: types.Status, MaxCount: 2, Duration: 60}
+
+	testCases := []struct {
+		name           string
+		sentAgo        []time.Duration
+		expectedStatus int
+	}{
+		{name: "Accepted", sentAgo: []time.Duration{10 * time.Second}, expectedStatus: http.StatusAccepted},
+		{name: "Rate Limited", sentAgo: []time.Duration{10 * time.Second, 5 * time.Second}, expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now().UTC()
+			store := newMemStore(rule)
+			for _, ago := range tc.sentAgo {
+				store.sent["romi"+string(types.Status)] = append(store.sent["romi"+string(types.Status)], now.Add(-ago))
+			}
+			sender := &fakeSender{channel: types.Telegram}
+			s := server.NewServer(context.Background(),
+				service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender)))
+
+			req := httptest.NewRequest(http.MethodPost, "/V1/notify", strings.NewReader(`{"recipient": "romi", "group": "STATUS"}`))
+			rr := httptest.NewRecorder()
+			s.SendHandler(rr, req)
+
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedStatus != http.StatusTooManyRequests {
+				assert.Empty(t, rr.Header().Get("Retry-After"))
+				return
+			}
+
+			// the oldest send leaves the window 50 seconds from now
+			resetAt := now.Add(50 * time.Second)
+			retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+			assert.NoError(t, err)
+			assert.InDelta(t, 50, retryAfter, 1)
+			assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Limit"))
+			assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+			reset, err := strconv.ParseInt(rr.Header().Get("X-RateLimit-Reset"), 10, 64)
+			assert.NoError(t, err)
+			assert.InDelta(t, resetAt.Unix(), reset, 1)
+			assert.Contains(t, rr.Body.String(), `"rule":{"id":"rule-1"`)
+		})
+	}
+}
+
+func TestRateLimitErrorRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		resetAt  time.Time
+		expected time.Duration
+	}{
+		{name: "Whole Seconds", resetAt: now.Add(30 * time.Second), expected: 30 * time.Second},
+		{name: "Rounded Up", resetAt: now.Add(1500 * time.Millisecond), expected: 2 * time.Second},
+		{name: "At Least One Second", resetAt: now, expected: time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := &service.RateLimitError{Decision: types.RateLimitDecision{ResetAt: tc.resetAt}}
+			assert.Equal(t, tc.expected, err.RetryAfter(now))
+		})
+	}
+}
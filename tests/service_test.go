@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"database/sql"
 	"testing"
 	"time"
 
@@ -15,6 +16,13 @@ import (
 	"notification_service/types"
 )
 
+// expectRateLimitLock expects the transaction and advisory lock SendNotification takes
+// around the rate limit check
+func expectRateLimitLock(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
 func TestIsAllowed(t *testing.T) {
 	mockDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -29,35 +37,46 @@ func TestIsAllowed(t *testing.T) {
 	testCases := []struct {
 		name              string
 		inputType         types.NotificationType
-		mockGetLastResult *sqlmock.Rows
 		mockGetRateResult *sqlmock.Rows
+		mockGetSentResult *sqlmock.Rows
 		expectedAllowed   bool
 		expectedError     bool
 	}{
 		{
-			name:              "First Notification",
-			inputType:         types.Status,
-			mockGetLastResult: sqlmock.NewRows([]string{"id", "notification_type", "counter", "recipient", "created_at", "updated_at"}), // Simulate no rows returned
+			name:      "First Notification",
+			inputType: types.Status,
 			mockGetRateResult: sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
 				AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "Status", 10, 3600.00),
-			expectedAllowed: true,
-			expectedError:   false,
+			mockGetSentResult: sqlmock.NewRows([]string{"created_at"}), // Simulate no rows returned
+			expectedAllowed:   true,
+			expectedError:     false,
 		},
 		{
 			name:      "Exceeds Max Count",
 			inputType: types.Marketing,
-			mockGetLastResult: sqlmock.NewRows([]string{"id", "notification_type", "counter", "recipient", "created_at", "updated_at"}).
-				AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "Marketing", 3, "recipient", now.Add(-time.Minute), now),
 			mockGetRateResult: sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
 				AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "Marketing", 3, 100.00),
+			mockGetSentResult: sqlmock.NewRows([]string{"created_at"}).
+				AddRow(now.Add(-time.Minute)).
+				AddRow(now.Add(-30 * time.Second)).
+				AddRow(now.Add(-time.Second)),
 			expectedAllowed: false,
 			expectedError:   false,
 		},
 		{
-			name:      "Error Getting Rate Limit Rules",
-			inputType: types.Status,
-			mockGetLastResult: sqlmock.NewRows([]string{"id", "notification_type", "counter", "recipient", "created_at", "updated_at"}).
-				AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "Status", 0, "recipient", now, now),
+			name:      "Below Max Count",
+			inputType: types.Marketing,
+			mockGetRateResult: sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
+				AddRow("cbd060ef-f620-489d-8ffc-49f73cde4f54", "Marketing", 3, 100.00),
+			mockGetSentResult: sqlmock.NewRows([]string{"created_at"}).
+				AddRow(now.Add(-time.Minute)).
+				AddRow(now.Add(-time.Second)),
+			expectedAllowed: true,
+			expectedError:   false,
+		},
+		{
+			name:              "Error Getting Rate Limit Rules",
+			inputType:         types.Status,
 			mockGetRateResult: nil,
 			expectedAllowed:   false,
 			expectedError:     true,
@@ -67,22 +86,23 @@ func TestIsAllowed(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Log("Running test case:", tc.name)
-			mock.ExpectQuery(`SELECT \* FROM notification_service.notifications`).
-				WithArgs(tc.inputType, "recipient").
-				WillReturnRows(tc.mockGetLastResult)
-
 			if tc.mockGetRateResult != nil {
 				mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
 					WillReturnRows(tc.mockGetRateResult)
+				mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).
+					WithArgs(tc.inputType, "recipient", sqlmock.AnyArg()).
+					WillReturnRows(tc.mockGetSentResult)
+			} else {
+				mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+					WillReturnError(sql.ErrConnDone)
 			}
 
 			service := &service.NotificationService{
 				DB:     &d.DBConnector{DB: db, Logger: logger},
 				Logger: logger,
-				Input:  types.InputInfo{Recipient: "recipient", NotificationGroup: tc.inputType},
 			}
 
-			allowed := service.IsAllowed(context.Background(), tc.inputType)
+			allowed := service.IsAllowed(context.Background(), "recipient", tc.inputType)
 
 			if tc.expectedError {
 				assert.False(t, allowed, "Expected not allowed due to error")
@@ -93,3 +113,109 @@ func TestIsAllowed(t *testing.T) {
 		})
 	}
 }
+
+func TestCombineDecisions(t *testing.T) {
+	now := time.Now()
+	hourly := types.RateLimitRule{ID: "hourly", MaxCount: 3, Duration: 3600}
+	daily := types.RateLimitRule{ID: "daily", MaxCount: 10, Duration: 86400}
+
+	testCases := []struct {
+		name            string
+		decisions       []types.RateLimitDecision
+		expectedAllowed bool
+		expectedRule    string
+	}{
+		{
+			name:            "No Rules",
+			expectedAllowed: true,
+		},
+		{
+			name: "All Allow Reports Fewest Remaining",
+			decisions: []types.RateLimitDecision{
+				{Allowed: true, Rule: hourly, Remaining: 2},
+				{Allowed: true, Rule: daily, Remaining: 1},
+			},
+			expectedAllowed: true,
+			expectedRule:    "daily",
+		},
+		{
+			name: "Any Rejection Rejects",
+			decisions: []types.RateLimitDecision{
+				{Allowed: true, Rule: hourly, Remaining: 2},
+				{Allowed: false, Rule: daily, ResetAt: now.Add(time.Hour)},
+			},
+			expectedAllowed: false,
+			expectedRule:    "daily",
+		},
+		{
+			name: "Several Rejections Report The Last To Reset",
+			decisions: []types.RateLimitDecision{
+				{Allowed: false, Rule: daily, ResetAt: now.Add(5 * time.Hour)},
+				{Allowed: false, Rule: hourly, ResetAt: now.Add(time.Minute)},
+			},
+			expectedAllowed: false,
+			expectedRule:    "daily",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := service.CombineDecisions(tc.decisions)
+			assert.Equal(t, tc.expectedAllowed, decision.Allowed)
+			assert.Equal(t, tc.expectedRule, decision.Rule.ID)
+		})
+	}
+}
+
+func TestSendNotificationLayeredRules(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	now := time.Now().UTC()
+
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipient_preferences`).
+		WillReturnRows(sqlmock.NewRows([]string{"recipient"}))
+	mock.ExpectQuery(`SELECT \* FROM notification_service.recipients`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	expectRateLimitLock(mock)
+	mock.ExpectQuery(`SELECT \* FROM notification_service.rate_limit_rules`).
+		WithArgs(types.Marketing, "recipient").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "notification_type", "max_count", "duration"}).
+			AddRow("hourly", "MARKETING", 3, 3600.00).
+			AddRow("daily", "MARKETING", 4, 86400.00))
+	// two sends in the last hour and two more earlier today: hourly allows one more, daily is full
+	hourlySends := sqlmock.NewRows([]string{"created_at"}).
+		AddRow(now.Add(-30 * time.Minute)).
+		AddRow(now.Add(-10 * time.Minute))
+	dailySends := sqlmock.NewRows([]string{"created_at"}).
+		AddRow(now.Add(-5 * time.Hour)).
+		AddRow(now.Add(-3 * time.Hour)).
+		AddRow(now.Add(-30 * time.Minute)).
+		AddRow(now.Add(-10 * time.Minute))
+	mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).WillReturnRows(hourlySends)
+	mock.ExpectQuery(`SELECT created_at FROM notification_service.notifications`).WillReturnRows(dailySends)
+	mock.ExpectRollback()
+	mock.ExpectQuery(`INSERT INTO notification_service.outbox`).
+		WithArgs("recipient", types.Marketing, types.Telegram, "recipient", "", "", "", "",
+			nil, "", types.RateLimited, sqlmock.AnyArg(), sqlmock.AnyArg(), types.Accepted, types.Normal).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow("7c0e", types.RateLimited))
+
+	sender := &fakeSender{channel: types.Telegram}
+	svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram, sender))
+
+	_, err = svc.SendNotification(context.Background(), types.InputInfo{Recipient: "recipient", NotificationGroup: types.Marketing})
+
+	var rateLimitErr *service.RateLimitError
+	if assert.ErrorAs(t, err, &rateLimitErr) {
+		assert.Equal(t, "daily", rateLimitErr.Decision.Rule.ID)
+		assert.WithinDuration(t, now.Add(19*time.Hour), rateLimitErr.Decision.ResetAt, time.Second)
+		assert.Contains(t, err.Error(), "rule daily allows 4 MARKETING per 24h0m0s")
+		assert.Equal(t, "7c0e", rateLimitErr.NotificationID)
+	}
+	assert.Empty(t, sender.sent)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,285 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/server"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var templateColumns = []string{"id", "name", "locale", "version", "title", "body", "html_body", "variables", "created_at"}
+
+func TestNormalizeLocale(t *testing.T) {
+	testCases := []struct {
+		raw           string
+		expected      string
+		fallbacks     []string
+		expectedError string
+	}{
+		{raw: "en", expected: "en", fallbacks: []string{"en"}},
+		{raw: "pt_br", expected: "pt-BR", fallbacks: []string{"pt-BR", "pt", "en"}},
+		{raw: "zh-Hant-TW", expected: "zh-Hant-TW", fallbacks: []string{"zh-Hant-TW", "zh-Hant", "zh", "en"}},
+		{raw: "english", expectedError: "invalid locale: english"},
+		{raw: "pt-", expectedError: "invalid locale: pt-"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.raw, func(t *testing.T) {
+			locale, err := service.NormalizeLocale(tc.raw)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, locale)
+			assert.Equal(t, tc.fallbacks, service.LocaleFallbacks(locale))
+		})
+	}
+	assert.Equal(t, []string{"en"}, service.LocaleFallbacks(""))
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tpl := types.Template{
+		Name:      "order-shipped",
+		Locale:    "en",
+		Version:   2,
+		Title:     "Order {{.order}} shipped",
+		Body:      "Hi {{.name}}, it arrives on {{.date}}.",
+		HTMLBody:  "<p>Hi {{.name}}</p>",
+		Variables: pq.StringArray{"order", "name", "date"},
+	}
+
+	t.Run("Rendered", func(t *testing.T) {
+		out, err := service.RenderTemplate(tpl, map[string]any{"order": 1234, "name": "<Romi>", "date": "June 3"})
+		assert.NoError(t, err)
+		assert.Equal(t, types.RenderedTemplate{
+			Name:     "order-shipped",
+			Locale:   "en",
+			Version:  2,
+			Title:    "Order 1234 shipped",
+			Body:     "Hi <Romi>, it arrives on June 3.",
+			HTMLBody: "<p>Hi &lt;Romi&gt;</p>",
+		}, out)
+	})
+
+	t.Run("Missing Variables", func(t *testing.T) {
+		_, err := service.RenderTemplate(tpl, map[string]any{"name": "Romi"})
+		assert.True(t, errors.Is(err, service.ErrMissingVariables))
+		assert.EqualError(t, err, "missing template variables: order, date")
+	})
+
+	t.Run("Undeclared Variable", func(t *testing.T) {
+		undeclared := tpl
+		undeclared.Variables = nil
+		_, err := service.RenderTemplate(undeclared, map[string]any{"name": "Romi"})
+		assert.True(t, errors.Is(err, service.ErrRenderTemplate))
+	})
+}
+
+func TestValidateTemplate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		body          string
+		expected      types.Template
+		expectedError string
+	}{
+		{name: "Default Locale", body: `{"name": "welcome", "title": "Hi {{.name}}", "variables": ["name", " name "]}`,
+			expected: types.Template{Name: "welcome", Locale: "en", Title: "Hi {{.name}}", Variables: pq.StringArray{"name"}}},
+		{name: "Locale", body: `{"name": "welcome", "locale": "pt_br", "body": "Olá"}`,
+			expected: types.Template{Name: "welcome", Locale: "pt-BR", Body: "Olá", Variables: pq.StringArray{}}},
+		{name: "Missing Text", body: `{"name": "welcome"}`, expectedError: "missing required fields"},
+		{name: "Invalid Name", body: `{"name": "welcome/en", "body": "Hi"}`,
+			expectedError: "invalid template name: welcome/en, expected letters, digits, '.', '_' and '-'"},
+		{name: "Invalid Locale", body: `{"name": "welcome", "locale": "english", "body": "Hi"}`, expectedError: "invalid locale: english"},
+		{name: "Empty Variable", body: `{"name": "welcome", "body": "Hi", "variables": [""]}`, expectedError: "template variables cannot be empty"},
+		{name: "Invalid Template", body: `{"name": "welcome", "body": "Hi {{.name"}`,
+			expectedError: `invalid body template: template: body:1: unclosed action`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tpl, err := server.ValidateTemplate(strings.NewReader(tc.body))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tpl)
+		})
+	}
+}
+
+func TestNotifyWithTemplate(t *testing.T) {
+	store := newMemStore()
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, &fakeSender{channel: types.Telegram}))
+	s := server.NewServer(context.Background(), svc)
+	ctx := context.Background()
+
+	for _, tpl := range []types.Template{
+		{Name: "order-shipped", Locale: "en", Title: "Order shipped", Body: "Order {{.order}} is on its way"},
+		{Name: "order-shipped", Locale: "en", Title: "Order {{.order}} shipped", Body: "It arrives on {{.date}}", Variables: pq.StringArray{"order", "date"}},
+		{Name: "order-shipped", Locale: "pt", Title: "Pedido {{.order}} enviado", Body: "Chega em {{.date}}", Variables: pq.StringArray{"order", "date"}},
+	} {
+		_, err := svc.CreateTemplate(ctx, tpl)
+		assert.NoError(t, err)
+	}
+	latest, err := store.GetTemplate(ctx, "order-shipped", "en", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, latest.Version)
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedTitle  string
+		expectedBody   string
+		expectedError  string
+	}{
+		{name: "Latest Version", body: `{"recipient": "romi", "group": "status", "template": {"name": "order-shipped", "variables": {"order": 1234, "date": "June 3"}}}`,
+			expectedStatus: http.StatusAccepted, expectedTitle: "Order 1234 shipped", expectedBody: "It arrives on June 3"},
+		{name: "Pinned Version", body: `{"recipient": "romi", "group": "status", "template": {"name": "order-shipped", "version": 1, "variables": {"order": 1234}}}`,
+			expectedStatus: http.StatusAccepted, expectedTitle: "Order shipped", expectedBody: "Order 1234 is on its way"},
+		{name: "Locale Fallback", body: `{"recipient": "romi", "group": "status", "template": {"name": "order-shipped", "locale": "pt-BR", "variables": {"order": 1234, "date": "3 de junho"}}}`,
+			expectedStatus: http.StatusAccepted, expectedTitle: "Pedido 1234 enviado", expectedBody: "Chega em 3 de junho"},
+		{name: "Missing Variables", body: `{"recipient": "romi", "group": "status", "template": {"name": "order-shipped", "variables": {"order": 1234}}}`,
+			expectedStatus: http.StatusUnprocessableEntity, expectedError: "missing template variables: date"},
+		{name: "Unknown Template", body: `{"recipient": "romi", "group": "status", "template": {"name": "order-lost"}}`,
+			expectedStatus: http.StatusUnprocessableEntity, expectedError: "unknown template: order-lost"},
+		{name: "Title With Template", body: `{"recipient": "romi", "group": "status", "title": "Shipped", "template": {"name": "order-shipped"}}`,
+			expectedStatus: http.StatusUnprocessableEntity, expectedError: "title, body and html_body are rendered from the template and cannot be given with it"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			queued := len(store.outbox)
+			rr := postNotify(s, "", tc.body)
+			assert.Equal(t, tc.expectedStatus, rr.Code)
+			if tc.expectedError != "" {
+				var res types.ErrorResponse
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+				assert.Equal(t, tc.expectedError, res.Message)
+				assert.Len(t, store.outbox, queued, "nothing is sent when the template cannot be rendered")
+				return
+			}
+			if assert.Len(t, store.outbox, queued+1) {
+				o := store.outbox[queued]
+				assert.Equal(t, tc.expectedTitle, o.Title)
+				assert.Equal(t, tc.expectedBody, o.Body)
+			}
+		})
+	}
+
+	t.Run("Batch", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/V1/notify/batch", strings.NewReader(`[
+			{"recipient": "romi", "group": "status", "template": {"name": "order-shipped", "variables": {"order": 1, "date": "June 3"}}},
+			{"recipient": "ines", "group": "status", "template": {"name": "order-shipped", "variables": {"order": 2}}}
+		]`))
+		rr := httptest.NewRecorder()
+		s.SendBatchHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var res types.BatchResponse
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+		if assert.Len(t, res.Results, 2) {
+			assert.Equal(t, types.BatchSent, res.Results[0].Status)
+			assert.Equal(t, types.BatchInvalid, res.Results[1].Status)
+			assert.Equal(t, "missing template variables: date", res.Results[1].Error)
+		}
+		assert.Equal(t, "Order 1 shipped", store.outbox[len(store.outbox)-1].Title)
+	})
+
+	t.Run("Preview", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/templates/order-shipped/preview",
+			strings.NewReader(`{"locale": "pt", "variables": {"order": 7, "date": "amanhã"}}`)), map[string]string{"name": "order-shipped"})
+		rr := httptest.NewRecorder()
+		s.PreviewTemplateHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var out types.RenderedTemplate
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&out))
+		assert.Equal(t, types.RenderedTemplate{Name: "order-shipped", Locale: "pt", Version: 1, Title: "Pedido 7 enviado", Body: "Chega em amanhã"}, out)
+	})
+
+	t.Run("Preview Unknown Template", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/V1/templates/order-lost/preview",
+			strings.NewReader(`{}`)), map[string]string{"name": "order-lost"})
+		rr := httptest.NewRecorder()
+		s.PreviewTemplateHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestTemplateHandlers(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+	conn := &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger}
+	s := server.NewServer(context.Background(), service.NewNotificationService(logger, conn, service.NewRegistry(types.Telegram)))
+	now := time.Now().UTC()
+
+	t.Run("Get Version", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.templates WHERE name = \$1 AND locale = \$2 AND \(\$3 = 0 OR version = \$3\)`).
+			WithArgs("welcome", "pt-BR", 2).
+			WillReturnRows(sqlmock.NewRows(templateColumns).AddRow("9f1c", "welcome", "pt-BR", 2, "Olá {{.name}}", "", "", "{name}", now))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/templates/welcome?locale=pt_BR&version=2", nil),
+			map[string]string{"name": "welcome"})
+		rr := httptest.NewRecorder()
+		s.GetTemplateHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var tpl types.Template
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&tpl))
+		assert.Equal(t, 2, tpl.Version)
+		assert.Equal(t, pq.StringArray{"name"}, tpl.Variables)
+	})
+
+	t.Run("Get Unknown", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.templates`).
+			WithArgs("welcome", "en", 0).
+			WillReturnRows(sqlmock.NewRows(templateColumns))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/templates/welcome", nil), map[string]string{"name": "welcome"})
+		rr := httptest.NewRecorder()
+		s.GetTemplateHandler(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("List Versions", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT \* FROM notification_service.templates WHERE name = \$1 AND \(\$2 = '' OR locale = \$2\) ORDER BY locale, version DESC`).
+			WithArgs("welcome", "").
+			WillReturnRows(sqlmock.NewRows(templateColumns).
+				AddRow("9f1c", "welcome", "en", 2, "Hi {{.name}}", "", "", "{name}", now).
+				AddRow("8e0b", "welcome", "en", 1, "Hi", "", "", "{}", now))
+
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/V1/templates/welcome/versions", nil), map[string]string{"name": "welcome"})
+		rr := httptest.NewRecorder()
+		s.ListTemplateVersionsHandler(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var versions []types.Template
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&versions))
+		assert.Len(t, versions, 2)
+	})
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"notification_service/service"
+	"notification_service/types"
+)
+
+func TestWebhookSender(t *testing.T) {
+	secret := []byte("webhook_secret")
+	msg := types.Message{
+		ID:        "2b1f",
+		MessageID: "m-1",
+		Recipient: "billing",
+		Group:     types.Status,
+		Title:     "Invoice ready",
+		Body:      "Invoice 42 is ready",
+		Data:      map[string]any{"invoice": "42"},
+	}
+
+	t.Run("Signed Delivery", func(t *testing.T) {
+		var (
+			payload   types.WebhookPayload
+			signature string
+			timestamp string
+			body      []byte
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			body, _ = io.ReadAll(r.Body)
+			signature = r.Header.Get(service.WebhookSignatureHeader)
+			timestamp = r.Header.Get(service.WebhookTimestampHeader)
+			assert.NoError(t, json.Unmarshal(body, &payload))
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer ts.Close()
+
+		sender := service.NewWebhookSender(secret, time.Second, zap.NewNop())
+		m := msg
+		m.Address = ts.URL
+		receipt, err := sender.Send(context.Background(), m)
+
+		assert.NoError(t, err)
+		assert.Equal(t, types.Receipt{Channel: types.Webhook, Reference: "status 202", StatusCode: http.StatusAccepted}, receipt)
+		assert.Equal(t, service.SignWebhookPayload(secret, timestamp, body), signature)
+		assert.NotEqual(t, service.SignWebhookPayload([]byte("other"), timestamp, body), signature)
+		assert.Equal(t, "2b1f", payload.ID)
+		assert.Equal(t, "m-1", payload.MessageID)
+		assert.Equal(t, "billing", payload.Recipient)
+		assert.Equal(t, types.Status, payload.Group)
+		assert.Equal(t, "Invoice 42 is ready", payload.Body)
+		assert.Equal(t, map[string]any{"invoice": "42"}, payload.Data)
+		assert.WithinDuration(t, time.Now(), payload.Timestamp, 5*time.Second)
+	})
+
+	t.Run("Error Status Is Recorded", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		sender := service.NewWebhookSender(secret, time.Second, zap.NewNop())
+		m := msg
+		m.Address = ts.URL
+		receipt, err := sender.Send(context.Background(), m)
+
+		var statusErr *service.WebhookStatusError
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+		assert.Equal(t, http.StatusServiceUnavailable, receipt.StatusCode)
+	})
+
+	t.Run("Status Is Kept On Delivery", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer ts.Close()
+
+		store := newMemStore()
+		store.recipients["billing"] = types.Recipient{ID: "billing", WebhookURL: ts.URL}
+		svc := service.NewNotificationService(zap.NewNop(), store,
+			service.NewRegistry(types.Webhook, service.NewWebhookSender(secret, time.Second, zap.NewNop())))
+		_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: "billing", NotificationGroup: types.Status, Body: "Invoice 42 is ready"})
+		assert.NoError(t, err)
+		deliverAll(t, svc)
+
+		if assert.Len(t, store.outbox, 1) {
+			assert.Equal(t, types.Delivered, store.outbox[0].Status)
+			assert.Equal(t, "status 202", store.outbox[0].Reference)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer ts.Close()
+		defer close(release)
+
+		sender := service.NewWebhookSender(secret, 50*time.Millisecond, zap.NewNop())
+		m := msg
+		m.Address = ts.URL
+		_, err := sender.Send(context.Background(), m)
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "could not call webhook")
+	})
+
+	t.Run("Invalid URL", func(t *testing.T) {
+		sender := service.NewWebhookSender(secret, time.Second, zap.NewNop())
+		m := msg
+		m.Address = "billing"
+		_, err := sender.Send(context.Background(), m)
+
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid webhook URL")
+	})
+}
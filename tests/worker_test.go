@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	d "notification_service/db"
+	"notification_service/service"
+	"notification_service/types"
+)
+
+var outboxColumns = []string{"id", "recipient", "notification_type", "channel", "address", "message_id", "title", "body",
+	"html_body", "data", "unsubscribe_url", "status", "attempts", "available_at", "last_error", "reference", "created_at", "updated_at"}
+
+func TestDeliverNext(t *testing.T) {
+	refused := "could not send EMAIL message: connection refused"
+	testCases := []struct {
+		name           string
+		senderErr      error
+		attempts       int
+		expectedQuery  string
+		expectedStatus types.DeliveryStatus
+		expectedDetail string
+	}{
+		{name: "Delivered", attempts: 1, expectedQuery: `UPDATE notification_service.outbox`,
+			expectedStatus: types.Delivered, expectedDetail: "ref"},
+		{name: "Retried", senderErr: errors.New("connection refused"), attempts: 1,
+			expectedQuery: `UPDATE notification_service.outbox`, expectedStatus: types.Queued, expectedDetail: refused},
+		{name: "Permanent Error", senderErr: service.Permanent(errors.New("connection refused")), attempts: 1,
+			expectedQuery: `INSERT INTO notification_service.dead_letters`, expectedStatus: types.Failed, expectedDetail: refused},
+		{name: "Out Of Attempts", senderErr: errors.New("connection refused"), attempts: service.DefaultRetryPolicy.MaxAttempts,
+			expectedQuery: `INSERT INTO notification_service.dead_letters`, expectedStatus: types.Failed, expectedDetail: refused},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Error creating mock database: %v", err)
+			}
+			defer mockDB.Close()
+			logger := zap.NewNop()
+			now := time.Now().UTC()
+
+			mock.ExpectQuery(`UPDATE notification_service.outbox`).
+				WithArgs(types.Sending, sqlmock.AnyArg(), sqlmock.AnyArg(), types.Queued, 1).
+				WillReturnRows(sqlmock.NewRows(outboxColumns).AddRow(
+					"2b1f", "romi", "NEWS", "EMAIL", "romi@example.com", "m-1", "Title", "Body",
+					"<p>Body</p>", []byte(`{"edition": 6}`), "", "SENDING", tc.attempts, now.Add(time.Minute), "", "", now, now))
+			args := []driver.Value{"2b1f", tc.expectedStatus, tc.expectedDetail, sqlmock.AnyArg()}
+			if tc.expectedStatus == types.Queued {
+				args = append(args, sqlmock.AnyArg())
+			}
+			mock.ExpectExec(tc.expectedQuery).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			sender := &fakeSender{channel: types.Email, err: tc.senderErr}
+			svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+				service.NewRegistry(types.Telegram, sender))
+
+			delivered, err := svc.DeliverNext(context.Background(), time.Minute)
+			assert.True(t, delivered)
+			assert.NoError(t, err)
+			if tc.senderErr == nil {
+				assert.Len(t, sender.sent, 1)
+				assert.Equal(t, "romi@example.com", sender.sent[0].Address)
+				assert.Equal(t, "<p>Body</p>", sender.sent[0].HTMLBody)
+				assert.Equal(t, map[string]any{"edition": 6.0}, sender.sent[0].Data)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeliverNextEmptyOutbox(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer mockDB.Close()
+	logger := zap.NewNop()
+
+	mock.ExpectQuery(`UPDATE notification_service.outbox`).
+		WillReturnRows(sqlmock.NewRows(outboxColumns))
+
+	svc := service.NewNotificationService(logger, &d.DBConnector{DB: sqlx.NewDb(mockDB, "sqlmock"), Logger: logger},
+		service.NewRegistry(types.Telegram))
+	delivered, err := svc.DeliverNext(context.Background(), time.Minute)
+	assert.False(t, delivered)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWorkersRun(t *testing.T) {
+	store := newMemStore()
+	sender := &fakeSender{channel: types.Telegram}
+	svc := service.NewNotificationService(zap.NewNop(), store, service.NewRegistry(types.Telegram, sender))
+	for _, recipient := range []string{"1", "2", "3"} {
+		_, err := svc.SendNotification(context.Background(), types.InputInfo{Recipient: recipient, NotificationGroup: types.News})
+		assert.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.NewWorkers(svc, 2, 10*time.Millisecond, time.Minute).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return len(sender.sent) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	for _, o := range store.outbox {
+		assert.Equal(t, types.Delivered, o.Status)
+		assert.Equal(t, 1, o.Attempts)
+	}
+}
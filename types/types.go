@@ -1,7 +1,14 @@
 package types
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type NotificationType string
@@ -12,12 +19,134 @@ const (
 	Marketing NotificationType = "MARKETING"
 )
 
+// Channel identifies the delivery backend used to reach a recipient
+type Channel string
+
+const (
+	Telegram Channel = "TELEGRAM"
+	Email    Channel = "EMAIL"
+	Webhook  Channel = "WEBHOOK"
+)
+
+// Priority is how urgent a notification is. Critical ones get through the rate limit
+// rules that let them bypass it, and the delivery workers send the most urgent first.
+type Priority string
+
+const (
+	Critical Priority = "critical"
+	High     Priority = "high"
+	Normal   Priority = "normal"
+	Low      Priority = "low"
+)
+
+// ValidPriorities lists the priorities from the most to the least urgent
+var ValidPriorities = []Priority{Critical, High, Normal, Low}
+
+func IsValidPriority(p Priority) bool {
+	for _, valid := range ValidPriorities {
+		if p == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// OrNormal returns p, Normal when it is not set
+func (p Priority) OrNormal() Priority {
+	if p == "" {
+		return Normal
+	}
+	return p
+}
+
+// LimiterStrategy is the algorithm a rate limit rule is enforced with
+type LimiterStrategy string
+
+const (
+	FixedWindow   LimiterStrategy = "FIXED_WINDOW"
+	SlidingWindow LimiterStrategy = "SLIDING_WINDOW"
+	TokenBucket   LimiterStrategy = "TOKEN_BUCKET"
+)
+
 type RateLimitRule struct {
-	ID               string           `db:"id"`
+	ID               string           `db:"id" json:"id"`
+	NotificationType NotificationType `db:"notification_type" json:"group"`
+	MaxCount         int              `db:"max_count" json:"max_count"`
+	Duration         float64          `db:"duration" json:"duration"`
+	Strategy         LimiterStrategy  `db:"strategy" json:"strategy,omitempty"`
+	// Burst and RefillRate (tokens per second) only apply to TOKEN_BUCKET rules
+	Burst      int     `db:"burst" json:"burst,omitempty"`
+	RefillRate float64 `db:"refill_rate" json:"refill_rate,omitempty"`
+	// Recipient or Tenant make the rule an override for that recipient or tenant only
+	Recipient string `db:"recipient" json:"recipient,omitempty"`
+	Tenant    string `db:"tenant" json:"tenant,omitempty"`
+	// CriticalBypass lets critical notifications through the rule, still counting them
+	CriticalBypass bool `db:"critical_bypass" json:"critical_bypass,omitempty"`
+}
+
+// RuleScope is who a rate limit rule applies to, from the most to the least specific
+type RuleScope int
+
+const (
+	GlobalScope RuleScope = iota
+	TenantScope
+	RecipientScope
+)
+
+func (r RateLimitRule) Scope() RuleScope {
+	switch {
+	case r.Recipient != "":
+		return RecipientScope
+	case r.Tenant != "":
+		return TenantScope
+	default:
+		return GlobalScope
+	}
+}
+
+// Bucket is the persisted state of a token bucket rule for one recipient
+type Bucket struct {
+	RuleID    string    `db:"rule_id"`
+	Recipient string    `db:"recipient"`
+	Tokens    float64   `db:"tokens"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// LimitKey names the rate limit state of a recipient for a notification type
+type LimitKey struct {
+	Recipient        string
+	NotificationType NotificationType
+}
+
+// SentNotification is an entry of the sliding log of the rate limiter
+type SentNotification struct {
+	Recipient        string           `db:"recipient"`
 	NotificationType NotificationType `db:"notification_type"`
-	MaxCount         int              `db:"max_count"`
-	Duration         float64          `db:"duration"`
+	CreatedAt        time.Time        `db:"created_at"`
 }
+
+// RateLimitDecision is the outcome of evaluating a rule for a recipient at a given time
+type RateLimitDecision struct {
+	Allowed   bool
+	Rule      RateLimitRule
+	Limit     int
+	Remaining int
+	// ResetAt is when the next notification will be allowed again
+	ResetAt time.Time
+}
+
+// Quota is the answer of a dry run: whether a notification would be allowed now and the
+// state of the rule in effect. Rule is nil when the type has no rule, so nothing is limited.
+type Quota struct {
+	Recipient         string           `json:"recipient"`
+	NotificationGroup NotificationType `json:"group"`
+	Allowed           bool             `json:"allowed"`
+	Limit             int              `json:"limit"`
+	Remaining         int              `json:"remaining"`
+	ResetAt           time.Time        `json:"reset_at"`
+	Rule              *RateLimitRule   `json:"rule,omitempty"`
+}
+
 type Notifications struct {
 	ID               string           `db:"id"`
 	NotificationType NotificationType `db:"notification_type"`
@@ -27,15 +156,577 @@ type Notifications struct {
 	UpdatedAt        time.Time        `db:"updated_at"`
 }
 
+// Recipient maps a logical recipient ID to its address on every channel
+type Recipient struct {
+	ID                string      `db:"id" json:"id"`
+	TelegramChatID    *int64      `db:"telegram_chat_id" json:"telegram_chat_id,omitempty"`
+	Email             string      `db:"email" json:"email,omitempty"`
+	WebhookURL        string      `db:"webhook_url" json:"webhook_url,omitempty"`
+	Tenant            string      `db:"tenant" json:"tenant,omitempty"`
+	PreferredChannels ChannelList `db:"preferred_channels" json:"preferred_channels"`
+	// Attributes are free form properties, such as the services the recipient follows,
+	// that segment filters match
+	Attributes JSONObject `db:"attributes" json:"attributes,omitempty"`
+	// Timezone is the IANA time zone of the recipient, UTC when empty
+	Timezone  string    `db:"timezone" json:"timezone,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Location returns the time zone of the recipient, UTC when it has none or it is unknown
+func (r Recipient) Location() *time.Location {
+	if r.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Address returns the recipient address for channel, empty when it has none
+func (r Recipient) Address(c Channel) string {
+	switch c {
+	case Telegram:
+		if r.TelegramChatID != nil {
+			return fmt.Sprint(*r.TelegramChatID)
+		}
+	case Email:
+		return r.Email
+	case Webhook:
+		return r.WebhookURL
+	}
+	return ""
+}
+
+// Preference holds what a recipient accepts for one notification type.
+// Quiet hours are "HH:MM" bounds in the time zone of the recipient; the window may wrap
+// around midnight.
+type Preference struct {
+	Recipient        string           `db:"recipient" json:"recipient"`
+	NotificationType NotificationType `db:"notification_type" json:"group"`
+	OptedOut         bool             `db:"opted_out" json:"opted_out"`
+	QuietHoursStart  string           `db:"quiet_hours_start" json:"quiet_hours_start,omitempty"`
+	QuietHoursEnd    string           `db:"quiet_hours_end" json:"quiet_hours_end,omitempty"`
+	PreferredChannel Channel          `db:"preferred_channel" json:"preferred_channel,omitempty"`
+	UpdatedAt        time.Time        `db:"updated_at" json:"updated_at"`
+}
+
+// ChannelList is stored as a postgres TEXT[] column
+type ChannelList []Channel
+
+func (c *ChannelList) Scan(src any) error {
+	var raw pq.StringArray
+	if err := raw.Scan(src); err != nil {
+		return err
+	}
+	list := make(ChannelList, 0, len(raw))
+	for _, v := range raw {
+		list = append(list, Channel(v))
+	}
+	*c = list
+	return nil
+}
+
+func (c ChannelList) Value() (driver.Value, error) {
+	raw := make(pq.StringArray, 0, len(c))
+	for _, v := range c {
+		raw = append(raw, string(v))
+	}
+	return raw.Value()
+}
+
+// JSONObject is a JSON object stored in a JSONB column
+type JSONObject map[string]any
+
+func (o *JSONObject) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case nil:
+		*o = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return errors.New("unsupported type for JSONObject")
+	}
+	return json.Unmarshal(raw, o)
+}
+
+func (o JSONObject) Value() (driver.Value, error) {
+	if o == nil {
+		return nil, nil
+	}
+	return json.Marshal(o)
+}
+
 type InputInfo struct {
 	Recipient         string           `json:"recipient"  validate:"required"`
 	NotificationGroup NotificationType `json:"group"  validate:"required"`
+	Channel           Channel          `json:"channel,omitempty"`
+	MessageID         string           `json:"message_id,omitempty"`
+	Title             string           `json:"title,omitempty"`
+	Body              string           `json:"body,omitempty"`
+	HTMLBody          string           `json:"html_body,omitempty"`
+	Data              map[string]any   `json:"data,omitempty"`
+	// SendAt schedules the notification: an RFC 3339 time, or a local "2006-01-02T15:04"
+	// time read in the time zone of the recipient
+	SendAt string `json:"send_at,omitempty"`
+	// Template renders the title and bodies of the notification instead of giving them
+	Template *TemplateRef `json:"template,omitempty"`
+	// Priority is Normal when empty
+	Priority Priority `json:"priority,omitempty"`
+}
+
+// Scan reads an InputInfo stored in a JSONB column, such as the payload of a broadcast
+func (in *InputInfo) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, in)
+	case string:
+		return json.Unmarshal([]byte(v), in)
+	default:
+		return errors.New("unsupported type for InputInfo")
+	}
 }
+
+func (in InputInfo) Value() (driver.Value, error) {
+	return json.Marshal(in)
+}
+
 type Output struct {
+	// ID identifies the accepted notification
+	ID                string           `json:"id,omitempty"`
 	Recipient         string           `json:"recipient"`
 	NotificationGroup NotificationType `json:"group"`
+	Channel           Channel          `json:"channel,omitempty"`
+	MessageID         string           `json:"message_id,omitempty"`
 	TimeStamp         time.Time        `json:"timestamp,omitempty"`
-	Message           string           `json:"message,omitempty"`
+	// SendAt is when a scheduled notification, or the digest a notification was added to,
+	// will be sent
+	SendAt  *time.Time `json:"send_at,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// BatchStatus is the outcome of one item of a batch send
+type BatchStatus string
+
+const (
+	// BatchSent items are accepted and queued for delivery
+	BatchSent        BatchStatus = "sent"
+	BatchRateLimited BatchStatus = "rate_limited"
+	BatchInvalid     BatchStatus = "invalid"
+	// BatchRejected items are suppressed by the recipient preferences
+	BatchRejected BatchStatus = "rejected"
+	// BatchFailed items could not be routed to a channel
+	BatchFailed BatchStatus = "failed"
+	// BatchDeferred items fell in the quiet hours of their recipient and are scheduled
+	// for when they end
+	BatchDeferred BatchStatus = "deferred"
+	// BatchDigested items were rate limited and added to the digest of their recipient
+	BatchDigested BatchStatus = "digested"
+)
+
+// BatchResult reports the outcome of the item of a batch at Index
+type BatchResult struct {
+	Index     int         `json:"index"`
+	Status    BatchStatus `json:"status"`
+	ID        string      `json:"id,omitempty"`
+	Recipient string      `json:"recipient,omitempty"`
+	Channel   Channel     `json:"channel,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	// Rule is the rate limit rule that rejected a rate limited item
+	Rule    *RateLimitRule `json:"rule,omitempty"`
+	ResetAt *time.Time     `json:"reset_at,omitempty"`
+	// SendAt is when a deferred or digested item will be sent, its ID is then the scheduled
+	// notification's or the digest's
+	SendAt *time.Time `json:"send_at,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+	Summary BatchSummary  `json:"summary"`
+}
+
+// BatchSummary counts the items of a batch per status, stored in a JSONB column
+type BatchSummary map[BatchStatus]int
+
+func (b *BatchSummary) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, b)
+	case string:
+		return json.Unmarshal([]byte(v), b)
+	default:
+		return errors.New("unsupported type for BatchSummary")
+	}
+}
+
+func (b BatchSummary) Value() (driver.Value, error) {
+	if b == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(b)
+}
+
+// SegmentFilter selects the registered recipients with the tenant, at least one of the
+// preferred channels and all the attributes of every non empty field. An empty filter
+// selects nobody, leaving the segment to its static members.
+type SegmentFilter struct {
+	Tenant     string      `json:"tenant,omitempty"`
+	Channels   ChannelList `json:"channels,omitempty"`
+	Attributes JSONObject  `json:"attributes,omitempty"`
+}
+
+func (f SegmentFilter) IsEmpty() bool {
+	return f.Tenant == "" && len(f.Channels) == 0 && len(f.Attributes) == 0
+}
+
+func (f *SegmentFilter) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, f)
+	case string:
+		return json.Unmarshal([]byte(v), f)
+	default:
+		return errors.New("unsupported type for SegmentFilter")
+	}
+}
+
+func (f SegmentFilter) Value() (driver.Value, error) {
+	return json.Marshal(f)
+}
+
+// Segment is a named group of recipients: its static members and the recipients matching
+// its filter
+type Segment struct {
+	ID          string        `db:"id" json:"id"`
+	Name        string        `db:"name" json:"name"`
+	Description string        `db:"description" json:"description,omitempty"`
+	Filter      SegmentFilter `db:"filter" json:"filter"`
+	CreatedAt   time.Time     `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time     `db:"updated_at" json:"updated_at"`
+}
+
+// SegmentMembers is a page of the members of a segment; Next is where the following page
+// starts, empty on the last one
+type SegmentMembers struct {
+	Members []string `json:"members"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// BroadcastStatus is the state of a broadcast
+type BroadcastStatus string
+
+const (
+	BroadcastRunning   BroadcastStatus = "RUNNING"
+	BroadcastCompleted BroadcastStatus = "COMPLETED"
+)
+
+// Broadcast fans Payload out to the members of a segment, a page of recipients at a time.
+// Total is the number of members when it started; Processed and Summary grow with every
+// page, LastRecipient is the last recipient of the last page sent. AvailableAt is when a worker
+// may claim the next page.
+type Broadcast struct {
+	ID            string          `db:"id" json:"id"`
+	SegmentID     string          `db:"segment_id" json:"segment_id"`
+	Payload       InputInfo       `db:"payload" json:"payload"`
+	Status        BroadcastStatus `db:"status" json:"status"`
+	Total         int             `db:"total" json:"total"`
+	Processed     int             `db:"processed" json:"processed"`
+	Summary       BatchSummary    `db:"summary" json:"summary"`
+	LastRecipient string          `db:"last_recipient" json:"-"`
+	AvailableAt   time.Time       `db:"available_at" json:"-"`
+	CreatedAt     time.Time       `db:"created_at" json:"created_at"`
+	UpdatedAt     time.Time       `db:"updated_at" json:"updated_at"`
+	CompletedAt   *time.Time      `db:"completed_at" json:"completed_at,omitempty"`
+}
+
+// DeliveryStatus is the state of a notification. Every notification is ACCEPTED, then
+// either RATE_LIMITED or QUEUED; queued ones go through SENDING until DELIVERED or FAILED,
+// back to QUEUED between retries.
+type DeliveryStatus string
+
+const (
+	Accepted    DeliveryStatus = "ACCEPTED"
+	RateLimited DeliveryStatus = "RATE_LIMITED"
+	Queued      DeliveryStatus = "QUEUED"
+	Sending     DeliveryStatus = "SENDING"
+	Delivered   DeliveryStatus = "DELIVERED"
+	Failed      DeliveryStatus = "FAILED"
+)
+
+var ValidDeliveryStatuses = []DeliveryStatus{Accepted, RateLimited, Queued, Sending, Delivered, Failed}
+
+func IsValidDeliveryStatus(status DeliveryStatus) bool {
+	for _, s := range ValidDeliveryStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// OutboxMessage is an accepted notification persisted until a worker delivers it.
+// AvailableAt is when a worker may claim it: while SENDING it is the end of the lease of
+// the worker delivering it, after which another worker takes over.
+type OutboxMessage struct {
+	ID                string           `db:"id" json:"id"`
+	Recipient         string           `db:"recipient" json:"recipient"`
+	NotificationGroup NotificationType `db:"notification_type" json:"group"`
+	Channel           Channel          `db:"channel" json:"channel"`
+	Address           string           `db:"address" json:"address"`
+	MessageID         string           `db:"message_id" json:"message_id,omitempty"`
+	Title             string           `db:"title" json:"title,omitempty"`
+	Body              string           `db:"body" json:"body,omitempty"`
+	HTMLBody          string           `db:"html_body" json:"html_body,omitempty"`
+	Data              JSONObject       `db:"data" json:"data,omitempty"`
+	UnsubscribeURL    string           `db:"unsubscribe_url" json:"unsubscribe_url,omitempty"`
+	Priority          Priority         `db:"priority" json:"priority"`
+	Status            DeliveryStatus   `db:"status" json:"status"`
+	Attempts          int              `db:"attempts" json:"attempts"`
+	AvailableAt       time.Time        `db:"available_at" json:"available_at"`
+	LastError         string           `db:"last_error" json:"last_error,omitempty"`
+	Reference         string           `db:"reference" json:"reference,omitempty"`
+	CreatedAt         time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time        `db:"updated_at" json:"updated_at"`
+	// Events is the status history of the notification, only loaded when it is looked up by ID
+	Events []NotificationEvent `db:"-" json:"events,omitempty"`
+}
+
+// NotificationEvent records a status change of a notification. Attempt is the delivery
+// attempt it belongs to, 0 before the first one; Detail is the error of a failed attempt
+// or the channel reference of a delivery.
+type NotificationEvent struct {
+	ID             int64          `db:"id" json:"-"`
+	NotificationID string         `db:"notification_id" json:"-"`
+	Status         DeliveryStatus `db:"status" json:"status"`
+	Attempt        int            `db:"attempt" json:"attempt"`
+	Detail         string         `db:"detail" json:"detail,omitempty"`
+	CreatedAt      time.Time      `db:"created_at" json:"at"`
+}
+
+// NotificationFilter selects notifications by every non empty field, newest first
+type NotificationFilter struct {
+	Recipient         string
+	NotificationGroup NotificationType
+	Channel           Channel
+	Status            DeliveryStatus
+	Limit             int
+}
+
+// ScheduleStatus is the state of a scheduled notification
+type ScheduleStatus string
+
+const (
+	Scheduled  ScheduleStatus = "SCHEDULED"
+	Dispatched ScheduleStatus = "DISPATCHED"
+	Cancelled  ScheduleStatus = "CANCELLED"
+)
+
+var ValidScheduleStatuses = []ScheduleStatus{Scheduled, Dispatched, Cancelled}
+
+func IsValidScheduleStatus(status ScheduleStatus) bool {
+	for _, s := range ValidScheduleStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledNotification is a notification kept until SendAt. Once dispatched, Result is
+// its outcome as a batch item, NotificationID the notification it became and Error why
+// it was not sent. AvailableAt is when a worker may claim it.
+type ScheduledNotification struct {
+	ID                string           `db:"id" json:"id"`
+	Recipient         string           `db:"recipient" json:"recipient"`
+	NotificationGroup NotificationType `db:"notification_type" json:"group"`
+	Payload           InputInfo        `db:"payload" json:"payload"`
+	SendAt            time.Time        `db:"send_at" json:"send_at"`
+	Status            ScheduleStatus   `db:"status" json:"status"`
+	Result            BatchStatus      `db:"result" json:"result,omitempty"`
+	NotificationID    string           `db:"notification_id" json:"notification_id,omitempty"`
+	Error             string           `db:"error" json:"error,omitempty"`
+	AvailableAt       time.Time        `db:"available_at" json:"-"`
+	CreatedAt         time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time        `db:"updated_at" json:"updated_at"`
+}
+
+// DigestStatus is the state of a digest
+type DigestStatus string
+
+const (
+	// DigestPending digests still take notifications until they are delivered
+	DigestPending DigestStatus = "PENDING"
+	DigestSent    DigestStatus = "SENT"
+	// DigestDropped digests could not be sent, such as when the recipient opted out since
+	DigestDropped DigestStatus = "DROPPED"
+)
+
+// DigestItems are the notifications of a digest, stored as a JSONB array
+type DigestItems []InputInfo
+
+func (d *DigestItems) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return errors.New("unsupported type for DigestItems")
+	}
+}
+
+func (d DigestItems) Value() (driver.Value, error) {
+	if d == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(d)
+}
+
+// Digest gathers the rate limited notifications of one type for a recipient, delivered
+// together as one summary at DeliverAt. NotificationID is the summary once sent and
+// Error why a dropped digest was not sent.
+type Digest struct {
+	ID                string           `db:"id" json:"id"`
+	Recipient         string           `db:"recipient" json:"recipient"`
+	NotificationGroup NotificationType `db:"notification_type" json:"group"`
+	Status            DigestStatus     `db:"status" json:"status"`
+	Items             DigestItems      `db:"items" json:"items"`
+	ItemCount         int              `db:"item_count" json:"item_count"`
+	DeliverAt         time.Time        `db:"deliver_at" json:"deliver_at"`
+	NotificationID    string           `db:"notification_id" json:"notification_id,omitempty"`
+	Error             string           `db:"error" json:"error,omitempty"`
+	AvailableAt       time.Time        `db:"available_at" json:"-"`
+	CreatedAt         time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time        `db:"updated_at" json:"updated_at"`
+	SentAt            *time.Time       `db:"sent_at" json:"sent_at,omitempty"`
+}
+
+// Template is one version of the text of a message in a locale. Title and Body are Go
+// text/template templates and HTMLBody an html/template one; Variables are the names a
+// request has to set to render it.
+type Template struct {
+	ID        string         `db:"id" json:"id"`
+	Name      string         `db:"name" json:"name"`
+	Locale    string         `db:"locale" json:"locale"`
+	Version   int            `db:"version" json:"version"`
+	Title     string         `db:"title" json:"title,omitempty"`
+	Body      string         `db:"body" json:"body,omitempty"`
+	HTMLBody  string         `db:"html_body" json:"html_body,omitempty"`
+	Variables pq.StringArray `db:"variables" json:"variables"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+// TemplateRef picks the template a notification is rendered with: the latest version
+// when Version is zero, in Locale or the closest locale there is
+type TemplateRef struct {
+	Name      string         `json:"name"`
+	Locale    string         `json:"locale,omitempty"`
+	Version   int            `json:"version,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+}
+
+// RenderedTemplate is a template rendered with the variables of a request
+type RenderedTemplate struct {
+	Name     string `json:"name"`
+	Locale   string `json:"locale"`
+	Version  int    `json:"version"`
+	Title    string `json:"title,omitempty"`
+	Body     string `json:"body,omitempty"`
+	HTMLBody string `json:"html_body,omitempty"`
+}
+
+// ScheduledFilter selects scheduled notifications by every non empty field, soonest first
+type ScheduledFilter struct {
+	Recipient string
+	Status    ScheduleStatus
+	Limit     int
+}
+
+// Message returns what the sender of the outbox message channel delivers
+func (o OutboxMessage) Message() Message {
+	return Message{
+		ID:             o.ID,
+		MessageID:      o.MessageID,
+		Recipient:      o.Recipient,
+		Address:        o.Address,
+		Group:          o.NotificationGroup,
+		Title:          o.Title,
+		Body:           o.Body,
+		HTMLBody:       o.HTMLBody,
+		Data:           o.Data,
+		UnsubscribeURL: o.UnsubscribeURL,
+	}
+}
+
+// DeadLetter is a notification whose delivery failed for good: its error could not be
+// fixed by retrying or it ran out of attempts. Requeuing it sends the notification again.
+type DeadLetter struct {
+	ID                string           `db:"id" json:"id"`
+	NotificationID    string           `db:"notification_id" json:"notification_id"`
+	Recipient         string           `db:"recipient" json:"recipient"`
+	NotificationGroup NotificationType `db:"notification_type" json:"group"`
+	Channel           Channel          `db:"channel" json:"channel"`
+	Attempts          int              `db:"attempts" json:"attempts"`
+	Reason            string           `db:"reason" json:"reason"`
+	CreatedAt         time.Time        `db:"created_at" json:"created_at"`
+}
+
+// Message is what a channel sender delivers to a single destination
+type Message struct {
+	// ID is the outbox notification, the same on every delivery attempt, and MessageID the
+	// message_id the client sent it with
+	ID        string
+	MessageID string
+	Recipient string
+	Address   string
+	Group     NotificationType
+	Title     string
+	Body      string
+	HTMLBody  string
+	Data      map[string]any
+	// UnsubscribeURL is a signed one-click link that opts the recipient out of Group
+	UnsubscribeURL string
+}
+
+// Text renders the message as plain text for channels without a subject line
+func (m Message) Text() string {
+	switch {
+	case m.Title != "" && m.Body != "":
+		return m.Title + "\n\n" + m.Body
+	case m.Title != "":
+		return m.Title
+	case m.Body != "":
+		return m.Body
+	default:
+		return fmt.Sprintf("New %s notification", m.Group)
+	}
+}
+
+// Receipt describes a successful delivery as reported by the channel
+type Receipt struct {
+	Channel    Channel
+	Reference  string
+	StatusCode int
+}
+
+// WebhookPayload is the JSON envelope POSTed to webhook recipients
+type WebhookPayload struct {
+	ID        string           `json:"id"`
+	MessageID string           `json:"message_id,omitempty"`
+	Recipient string           `json:"recipient"`
+	Group     NotificationType `json:"group"`
+	Title     string           `json:"title,omitempty"`
+	Body      string           `json:"body,omitempty"`
+	Data      map[string]any   `json:"data,omitempty"`
+	Timestamp time.Time        `json:"timestamp"`
+
+	UnsubscribeURL string `json:"unsubscribe_url,omitempty"`
 }
 
 // harcoded by the moment, could be given by argument flags or secrets etc
@@ -48,9 +739,65 @@ type DatabaseConfig struct {
 	SSLMode  string
 }
 
+// SMTPTLSMode selects how the SMTP connection is secured
+type SMTPTLSMode string
+
+const (
+	SMTPTLSNone     SMTPTLSMode = "none"
+	SMTPTLSStartTLS SMTPTLSMode = "starttls"
+	SMTPTLSImplicit SMTPTLSMode = "tls"
+)
+
+type SMTPConfig struct {
+	Host               string
+	Port               int
+	Username           string
+	Password           string
+	From               string
+	TLSMode            SMTPTLSMode
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+// StoredResponse is an HTTP response kept to be replayed, stored in a JSONB column
+type StoredResponse struct {
+	StatusCode int             `json:"status_code"`
+	Header     http.Header     `json:"header,omitempty"`
+	Body       json.RawMessage `json:"body"`
+}
+
+func (r *StoredResponse) Scan(src any) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return errors.New("unsupported type for StoredResponse")
+	}
+}
+
+func (r StoredResponse) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+// IdempotencyKey remembers the response to a request sent with an Idempotency-Key header
+// until ExpiresAt. RequestHash identifies the payload the key was first used with.
+type IdempotencyKey struct {
+	Key         string         `db:"key"`
+	RequestHash string         `db:"request_hash"`
+	Response    StoredResponse `db:"response"`
+	CreatedAt   time.Time      `db:"created_at"`
+	ExpiresAt   time.Time      `db:"expires_at"`
+}
+
 type ErrorResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// ID identifies the rejected notification when it was recorded
+	ID string `json:"id,omitempty"`
+	// Rule is the rate limit rule that rejected the request, if any
+	Rule *RateLimitRule `json:"rule,omitempty"`
 }
 
 var ValidNotificationTypes = []NotificationType{Status, Marketing, News}
@@ -63,3 +810,14 @@ func IsValidNotificationType(t NotificationType) bool {
 	}
 	return false
 }
+
+var ValidChannels = []Channel{Telegram, Email, Webhook}
+
+func IsValidChannel(c Channel) bool {
+	for _, validChannel := range ValidChannels {
+		if c == validChannel {
+			return true
+		}
+	}
+	return false
+}